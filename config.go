@@ -23,6 +23,8 @@ type Configuration struct {
 	TraktClientSecret string `json:"trakt_client_secret"`
 	TraktAccessToken string `json:"trakt_access_token"`
 	TraktRefreshToken string `json:"trakt_refresh_token"`
+	TraktSyncDisabled bool `json:"trakt_sync_disabled"`
+	TraktSyncIntervalMinutes int `json:"trakt_sync_interval_minutes"`
 	
 	DownloadUriOauth string `json:"download_uri_oauth"`
 	DownloadUriOauthParam string `json:"download_uri_oauth_param"`
@@ -35,8 +37,21 @@ type Configuration struct {
 	TitleQualityHDKeywords []string `mapstructure:"hd_titles"`
 
 	OmdbApiKeys []string `json:"omdbapi_keys"`
+	PosterCacheDir string `json:"poster_cache_dir"`
+	ReleaseCountry string `json:"release_country"`
+	ReleaseCheckIntervalHours int `json:"release_check_interval_hours"`
 	
 	Sources []SourceConfig `json:"sources"`
+	SourceTimeoutSeconds int `json:"source_timeout_seconds"`
+	SubtitleProviders []SourceConfig `json:"subtitle_providers"`
+	QualityProfiles []QualityProfile `json:"quality_profiles"`
+	DefaultQualityProfile string `json:"default_quality_profile"`
+	Feeds []FeedConfig `json:"feeds"`
+	FeedPollMinutes int `json:"feed_poll_minutes"`
+	SourceCacheMinutes int `json:"source_cache_minutes"`
+	TorrentMetadataUrls []string `json:"torrent_metadata_urls"`
+	InspectMinVideoMB int `json:"inspect_min_video_mb"`
+	InspectLanguages []string `json:"inspect_languages"`
 }
 
 var configuration = Configuration{}
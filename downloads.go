@@ -55,6 +55,7 @@ type DownloadItem struct {
 
 	IsLocalToClient bool `json:"isLocalToClient"` /* true if on local disk */
 	Collection string `json:"collection"` /* name of collection item belongs to, if/a */
+	Subtitles []*SubtitleTrack `json:"subtitles,omitempty"` /* sidecar subtitle files next to item, if/a */
 }
 
 type Downloads struct {
@@ -253,6 +254,7 @@ func (dl *Downloads) RefreshDiskDownloads() {
 			HasUploadedClient: hasUploadedClient,
 			IsLocalToClient: is_local,
 			Collection: collection,
+			Subtitles: findSidecarSubtitles(cloud_id_path),
 		}
 		toAdd = append(toAdd, item)
 		return nil
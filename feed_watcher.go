@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FEEDS_FILENAME = "feeds.json"
+	DEFAULT_FEED_POLL_MINUTES = 15
+	FEED_SEEN_DAYS = 14 /* how long item ids are remembered so they are not matched twice */
+	FEED_MATCH_DAYS = 30
+)
+
+type FeedConfig struct {
+	Name string `json:"name"`
+	Url string `json:"url"`
+	Hostname string `json:"hostname"` // shown as the source of matched releases
+}
+
+type WantedItem struct {
+	ImdbID string `json:"imdb_id"`
+	Profile string `json:"profile,omitempty"` // quality profile releases must pass to match
+	AddedAt int64 `json:"added_at"`
+}
+
+type FeedMatch struct {
+	ImdbID string `json:"imdb_id"`
+	Feed string `json:"feed"`
+	Source ItemSource `json:"source"`
+	FoundAt int64 `json:"found_at"`
+}
+
+type feedTitle struct {
+	Title string `json:"title"`
+	Year int `json:"year"`
+}
+
+type feedState struct {
+	ETag string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	LastPoll int64 `json:"last_poll"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type FeedWatcher struct {
+	lock *sync.Mutex
+	poll_lock *sync.Mutex
+	Wanted map[string]*WantedItem `json:"wanted"`
+	Matches []FeedMatch `json:"matches"`
+	Seen map[string]int64 `json:"seen"` // feed item id -> when it was last listed
+	Feeds map[string]*feedState `json:"feeds"`
+	Titles map[string]feedTitle `json:"titles"` // title and year of watched items, for matching names
+	wake chan bool
+}
+
+var feedWatcher = FeedWatcher{
+	lock: &sync.Mutex{},
+	poll_lock: &sync.Mutex{},
+	Wanted: make(map[string]*WantedItem),
+	Seen: make(map[string]int64),
+	Feeds: make(map[string]*feedState),
+	Titles: make(map[string]feedTitle),
+	wake: make(chan bool, 1),
+}
+
+/* RSS 2.0 items, with torznab/newznab attributes when present */
+type rssFeed struct {
+	Items []struct {
+		torznabItem
+		Guid string `xml:"guid"`
+	} `xml:"channel>item"`
+}
+
+type atomFeed struct {
+	Entries []struct {
+		Id string `xml:"id"`
+		Title string `xml:"title"`
+		Updated string `xml:"updated"`
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel string `xml:"rel,attr"`
+			Length int64 `xml:"length,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+func (fw *FeedWatcher) ReadFromDisk() {
+	content, err := ioutil.ReadFile(FEEDS_FILENAME)
+	if err != nil {
+		return
+	}
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	if err = json.Unmarshal(content, fw); err != nil {
+		fmt.Println("Could not parse feed watcher state:", err)
+	}
+	if fw.Wanted == nil {
+		fw.Wanted = make(map[string]*WantedItem)
+	}
+	if fw.Seen == nil {
+		fw.Seen = make(map[string]int64)
+	}
+	if fw.Feeds == nil {
+		fw.Feeds = make(map[string]*feedState)
+	}
+	if fw.Titles == nil {
+		fw.Titles = make(map[string]feedTitle)
+	}
+}
+
+func (fw *FeedWatcher) saveToDisk() (error) {
+	feeds_json, err := json.Marshal(fw)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(FEEDS_FILENAME, feeds_json)
+}
+
+/* Lowercased alphanumeric words, so "Spider-Man: Far From Home" matches "Spider.Man.Far.From.Home" */
+func normalizeTitle(title string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	}), " ")
+}
+
+/* Title and year of an item, remembered so unreleased items need no lookup on every poll */
+func (fw *FeedWatcher) titleOf(imdb_id string) (feedTitle, bool) {
+	fw.lock.Lock()
+	known, ok := fw.Titles[imdb_id]
+	fw.lock.Unlock()
+	if ok {
+		return known, true
+	}
+	got, err := omdbQuery(url.Values{"i": {imdb_id}})
+	if err != nil {
+		return feedTitle{}, false
+	}
+	known.Title, _ = got["Title"].(string)
+	year, _ := got["Year"].(string)
+	if len(year) >= 4 {
+		known.Year, _ = strconv.Atoi(year[:4])
+	}
+	fw.lock.Lock()
+	fw.Titles[imdb_id] = known
+	fw.lock.Unlock()
+	return known, true
+}
+
+/* Normalized title (with and without year) of every watched or wanted item */
+func (fw *FeedWatcher) targets() (map[string]bool, map[string]string) {
+	ids := idSet(watchStore.GetWatchlist())
+	fw.lock.Lock()
+	for imdb_id := range fw.Wanted {
+		ids[imdb_id] = true
+	}
+	fw.lock.Unlock()
+	titles := make(map[string]string)
+	for imdb_id := range ids {
+		known, ok := fw.titleOf(imdb_id)
+		if !ok || len(known.Title) == 0 {
+			continue
+		}
+		titles[normalizeTitle(known.Title)] = imdb_id
+		titles[fmt.Sprintf("%s|%d", normalizeTitle(known.Title), known.Year)] = imdb_id
+	}
+	return ids, titles
+}
+
+func (fw *FeedWatcher) fetch(feed FeedConfig) ([]string, []ItemSource, error) {
+	fw.lock.Lock()
+	state, ok := fw.Feeds[feed.Name]
+	if !ok {
+		state = &feedState{}
+		fw.Feeds[feed.Name] = state
+	}
+	etag, last_modified := state.ETag, state.LastModified
+	fw.lock.Unlock()
+
+	/* Conditional request, so unchanged feeds cost nothing */
+	req, err := http.NewRequest("GET", feed.Url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(etag) > 0 {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if len(last_modified) > 0 {
+		req.Header.Set("If-Modified-Since", last_modified)
+	}
+	resp, err := netClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, errors.New(fmt.Sprintf("Feed returned %s", resp.Status))
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	/* Both kinds of feed become items for the Torznab parser */
+	parser := &TorznabSource{SourceApiHostname: feed.Hostname}
+	var ids []string
+	var found []ItemSource
+	var rss rssFeed
+	var atom atomFeed
+	if err = xml.Unmarshal(body, &rss); err == nil && len(rss.Items) > 0 {
+		for _, item := range rss.Items {
+			id := item.Guid
+			if len(id) == 0 {
+				id = item.Link
+			}
+			ids = append(ids, id)
+			found = append(found, parser.itemSource(item.torznabItem))
+		}
+	} else if err = xml.Unmarshal(body, &atom); err == nil {
+		for _, entry := range atom.Entries {
+			item := torznabItem{Title: entry.Title}
+			for _, link := range entry.Links {
+				if len(item.Link) == 0 || link.Rel == "enclosure" {
+					item.Link, item.Enclosure.Length = link.Href, link.Length
+				}
+			}
+			on := parser.itemSource(item)
+			if updated, err := time.Parse(time.RFC3339, entry.Updated); err == nil {
+				on.UploadedAt = updated.Unix()
+			}
+			ids = append(ids, entry.Id)
+			found = append(found, on)
+		}
+	} else {
+		return nil, nil, err
+	}
+
+	/* Only remember the validators once the feed could be read, so a */
+	/* broken response is fetched again in full rather than skipped */
+	fw.lock.Lock()
+	state.ETag, state.LastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	fw.lock.Unlock()
+	return ids, found, nil
+}
+
+// Poll reads every configured feed and records new releases of watched or
+// wanted items, adding them to the cached sources of those items.
+func (fw *FeedWatcher) Poll() (map[string]int) {
+	fw.poll_lock.Lock()
+	defer fw.poll_lock.Unlock()
+	stats := map[string]int{"feeds": 0, "items": 0, "matched": 0, "failed": 0}
+	if len(configuration.Feeds) == 0 {
+		return stats
+	}
+	ids, titles := fw.targets()
+	now := time.Now().Unix()
+	matched := make(map[string][]ItemSource)
+
+	for _, feed := range configuration.Feeds {
+		item_ids, found, err := fw.fetch(feed)
+		fw.lock.Lock()
+		state := fw.Feeds[feed.Name]
+		state.LastPoll, state.LastError = now, ""
+		if err != nil {
+			state.LastError = err.Error()
+			stats["failed"] += 1
+			fmt.Printf("Warning: could not read feed %s: %s\n", feed.Name, err)
+		}
+		fw.lock.Unlock()
+		stats["feeds"] += 1
+
+		for idx, on := range found {
+			seen_key := feed.Name + "|" + item_ids[idx]
+			fw.lock.Lock()
+			_, seen := fw.Seen[seen_key]
+			fw.Seen[seen_key] = now
+			fw.lock.Unlock()
+			if seen {
+				continue
+			}
+			stats["items"] += 1
+
+			/* Match by the feed's IMDb id, else by title and year */
+			imdb_id := on.ImdbCode
+			if len(imdb_id) == 0 {
+				title := normalizeTitle(on.Release.Title)
+				if imdb_id = titles[fmt.Sprintf("%s|%d", title, on.Release.Year)]; len(imdb_id) == 0 && on.Release.Year == 0 {
+					imdb_id = titles[title]
+				}
+			}
+			if len(imdb_id) == 0 || !ids[imdb_id] {
+				continue
+			}
+
+			/* Wanted items with a profile only match releases it accepts */
+			fw.lock.Lock()
+			wanted, is_wanted := fw.Wanted[imdb_id]
+			fw.lock.Unlock()
+			if is_wanted && len(wanted.Profile) > 0 {
+				if profile, err := FindQualityProfile(wanted.Profile); err == nil && profile.Score(on, 0).Rejected != "" {
+					continue
+				}
+			}
+			on.ImdbCode = imdb_id
+			matched[imdb_id] = append(matched[imdb_id], on)
+			fw.lock.Lock()
+			fw.Matches = append(fw.Matches, FeedMatch{ImdbID: imdb_id, Feed: feed.Name, Source: on, FoundAt: now})
+			fw.lock.Unlock()
+			stats["matched"] += 1
+		}
+	}
+
+	/* Matches show up as sources without searching */
+	for imdb_id, found := range matched {
+		sourceCache.Store(imdb_id, found, false)
+	}
+
+	/* Forget old matches and item ids */
+	fw.lock.Lock()
+	match_cutoff := now - FEED_MATCH_DAYS * 24 * 60 * 60
+	kept := make([]FeedMatch, 0, len(fw.Matches))
+	for _, on := range fw.Matches {
+		if on.FoundAt >= match_cutoff {
+			kept = append(kept, on)
+		}
+	}
+	fw.Matches = kept
+	for key, last_seen := range fw.Seen {
+		if now - last_seen > FEED_SEEN_DAYS * 24 * 60 * 60 {
+			delete(fw.Seen, key)
+		}
+	}
+	if err := fw.saveToDisk(); err != nil {
+		fmt.Println("Warning: could not save feed watcher state:", err)
+	}
+	fw.lock.Unlock()
+	return stats
+}
+
+func (fw *FeedWatcher) Trigger() {
+	select {
+		case fw.wake <- true:
+		default:
+	}
+}
+
+func (fw *FeedWatcher) Run() {
+	interval := time.Duration(configuration.FeedPollMinutes) * time.Minute
+	if interval <= 0 {
+		interval = DEFAULT_FEED_POLL_MINUTES * time.Minute
+	}
+	for {
+		if stats := fw.Poll(); stats["feeds"] > 0 {
+			fmt.Println("Polled release feeds:", stats)
+		}
+		select {
+			case <-fw.wake:
+			case <-time.After(interval):
+		}
+	}
+}
+
+// RecentMatches lists releases matched within the last days, newest first.
+func (fw *FeedWatcher) RecentMatches(days int) []FeedMatch {
+	if days <= 0 {
+		days = FEED_MATCH_DAYS
+	}
+	cutoff := time.Now().Add(-time.Duration(days) * 24 * time.Hour).Unix()
+	fw.lock.Lock()
+	ret := make([]FeedMatch, 0)
+	for _, on := range fw.Matches {
+		if on.FoundAt >= cutoff {
+			ret = append(ret, on)
+		}
+	}
+	fw.lock.Unlock()
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].FoundAt > ret[j].FoundAt
+	})
+	return ret
+}
+
+func (fw *FeedWatcher) GetWanted() []WantedItem {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	ret := make([]WantedItem, 0)
+	for _, on := range fw.Wanted {
+		ret = append(ret, *on)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].AddedAt > ret[j].AddedAt
+	})
+	return ret
+}
+
+func (fw *FeedWatcher) AddWanted(imdb_id string, profile string) (error) {
+	if len(profile) > 0 {
+		if _, err := FindQualityProfile(profile); err != nil {
+			return err
+		}
+	}
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	fw.Wanted[imdb_id] = &WantedItem{ImdbID: imdb_id, Profile: profile, AddedAt: time.Now().Unix()}
+	return fw.saveToDisk()
+}
+
+func (fw *FeedWatcher) RemoveWanted(imdb_id string) (error) {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	if _, ok := fw.Wanted[imdb_id]; !ok {
+		return errors.New("Item is not on the wanted list")
+	}
+	delete(fw.Wanted, imdb_id)
+	return fw.saveToDisk()
+}
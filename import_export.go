@@ -0,0 +1,726 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	IMPORT_RATINGS_BATCH_SIZE = 100
+)
+
+type ImportRow struct {
+	Title string `json:"title"`
+	Year int `json:"year,omitempty"`
+	ImdbID string `json:"imdb_id,omitempty"`
+	ItemType string `json:"item_type"` /* "movie" or "show" */
+	Timestamp int64 `json:"timestamp,omitempty"` /* watched, listed or rated at (unix seconds) */
+	Rating int `json:"rating,omitempty"` /* 1-10, 0 if unrated */
+}
+
+type ImportMatch struct {
+	Row int `json:"row"`
+	Title string `json:"title"`
+	Year int `json:"year,omitempty"`
+	ImdbID string `json:"imdb_id,omitempty"`
+	MatchedBy string `json:"matched_by,omitempty"` /* "id", "title" or "search" */
+	Status string `json:"status"` /* "imported", "duplicate" or "unmatched" */
+}
+
+type TransferJob struct {
+	ID string `json:"id"`
+	Kind string `json:"kind"` /* "import" or "export" */
+	Format string `json:"format"` /* "letterboxd", "imdb" or "trakt" */
+	Target string `json:"target"` /* "history", "watchlist", "ratings" or "library" */
+	Status string `json:"status"` /* "running", "done" or "failed" */
+	Total int `json:"total"`
+	Processed int `json:"processed"`
+	Summary map[string]int `json:"summary"`
+	Report []ImportMatch `json:"report,omitempty"`
+	Output string `json:"output,omitempty"` /* exported file contents */
+	Err string `json:"err,omitempty"`
+	Started int64 `json:"started"`
+	Finished int64 `json:"finished,omitempty"`
+}
+
+type TransferJobs struct {
+	lock *sync.Mutex
+	jobs map[string]*TransferJob
+}
+
+var transferJobs = TransferJobs{
+	lock: &sync.Mutex{},
+	jobs: make(map[string]*TransferJob),
+}
+
+func (tj *TransferJobs) create(kind, format, target string) *TransferJob {
+	job := &TransferJob{
+		ID: strconv.FormatInt(time.Now().UnixNano(), 36),
+		Kind: kind,
+		Format: format,
+		Target: target,
+		Status: "running",
+		Summary: make(map[string]int),
+		Started: time.Now().Unix(),
+	}
+	tj.lock.Lock()
+	tj.jobs[job.ID] = job
+	tj.lock.Unlock()
+	return job
+}
+
+func (tj *TransferJobs) update(job *TransferJob, fn func()) {
+	tj.lock.Lock()
+	defer tj.lock.Unlock()
+	fn()
+}
+
+func (tj *TransferJobs) finish(job *TransferJob, err error) {
+	tj.update(job, func() {
+		job.Finished = time.Now().Unix()
+		if err != nil {
+			job.Status = "failed"
+			job.Err = err.Error()
+		} else {
+			job.Status = "done"
+		}
+	})
+}
+
+func (tj *TransferJobs) Get(id string) (TransferJob, bool) {
+	tj.lock.Lock()
+	defer tj.lock.Unlock()
+	job, ok := tj.jobs[id]
+	if !ok {
+		return TransferJob{}, false
+	}
+	ret := *job
+	ret.Report = append([]ImportMatch{}, job.Report...)
+	return ret, true
+}
+
+func (tj *TransferJobs) List() []TransferJob {
+	tj.lock.Lock()
+	defer tj.lock.Unlock()
+	ret := make([]TransferJob, 0)
+	for _, job := range tj.jobs {
+		/* Omit bulky fields from listings */
+		on := *job
+		on.Report = nil
+		on.Output = ""
+		ret = append(ret, on)
+	}
+	return ret
+}
+
+/* Parsing */
+func detectImportFormat(data string) string {
+	trimmed := strings.TrimSpace(data)
+	if strings.HasPrefix(trimmed, "[") {
+		return "trakt"
+	}
+	header := strings.SplitN(trimmed, "\n", 2)[0]
+	/* Letterboxd's own exports, or the import layout we export ourselves */
+	if strings.Contains(header, "Letterboxd URI") || strings.Contains(header, "imdbID") {
+		return "letterboxd"
+	}
+	if strings.Contains(header, "Const") {
+		return "imdb"
+	}
+	return ""
+}
+
+func readCsvRecords(data string) ([]map[string]string, error) {
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(data, "\ufeff")))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("Empty CSV file")
+	}
+
+	/* Key each row by its header */
+	header := records[0]
+	var ret []map[string]string
+	for _, record := range records[1:] {
+		row := make(map[string]string)
+		for i, v := range record {
+			if i < len(header) {
+				row[strings.TrimSpace(header[i])] = strings.TrimSpace(v)
+			}
+		}
+		ret = append(ret, row)
+	}
+	return ret, nil
+}
+
+func parseImportDate(s string) int64 {
+	for _, layout := range []string{"2006-01-02", time.RFC3339, "Mon Jan 2 15:04:05 2006"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Unix()
+		}
+	}
+	return 0
+}
+
+func parseLetterboxdCsv(data string) ([]ImportRow, error) {
+	records, err := readCsvRecords(data)
+	if err != nil {
+		return nil, err
+	}
+	var ret []ImportRow
+	for _, on := range records {
+		row := ImportRow{
+			Title: on["Name"],
+			ImdbID: on["imdbID"],
+			ItemType: "movie",
+		}
+		if len(row.Title) == 0 {
+			row.Title = on["Title"]
+		}
+		row.Year, _ = strconv.Atoi(on["Year"])
+
+		/* Diary exports carry the actual watch date separately from the log date */
+		if watched, ok := on["Watched Date"]; ok && len(watched) > 0 {
+			row.Timestamp = parseImportDate(watched)
+		} else if watched, ok := on["WatchedDate"]; ok && len(watched) > 0 {
+			row.Timestamp = parseImportDate(watched)
+		} else {
+			row.Timestamp = parseImportDate(on["Date"])
+		}
+
+		/* Letterboxd rates 0.5-5 stars; the import layout also takes 1-10 */
+		if rating, err := strconv.Atoi(on["Rating10"]); err == nil && rating > 0 {
+			row.Rating = rating
+		} else if rating, err := strconv.ParseFloat(on["Rating"], 64); err == nil && rating > 0 {
+			row.Rating = int(rating * 2 + 0.5)
+		}
+		ret = append(ret, row)
+	}
+	return ret, nil
+}
+
+func parseImdbCsv(data string) ([]ImportRow, error) {
+	records, err := readCsvRecords(data)
+	if err != nil {
+		return nil, err
+	}
+	var ret []ImportRow
+	for _, on := range records {
+		row := ImportRow{
+			Title: on["Title"],
+			ImdbID: on["Const"],
+			ItemType: "movie",
+		}
+		row.Year, _ = strconv.Atoi(on["Year"])
+		if strings.Contains(strings.ToLower(on["Title Type"]), "series") {
+			row.ItemType = "show"
+		}
+		if rated, ok := on["Date Rated"]; ok && len(rated) > 0 {
+			row.Timestamp = parseImportDate(rated)
+		} else {
+			row.Timestamp = parseImportDate(on["Created"])
+		}
+		row.Rating, _ = strconv.Atoi(on["Your Rating"])
+		ret = append(ret, row)
+	}
+	return ret, nil
+}
+
+func parseTraktJson(data string) ([]ImportRow, error) {
+	var records []map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &records); err != nil {
+		return nil, err
+	}
+	var ret []ImportRow
+	for _, on := range records {
+		item_type, _ := on["type"].(string)
+		if item_type == "episode" {
+			item_type = "show"
+		}
+		item, ok := on[item_type].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		row := ImportRow{
+			ItemType: item_type,
+		}
+		row.Title, _ = item["title"].(string)
+		if year, ok := item["year"].(float64); ok {
+			row.Year = int(year)
+		}
+		if ids := filterTraktIds([]map[string]interface{}{item}); len(ids) > 0 {
+			row.ImdbID = ids[0]
+		}
+		for _, key := range []string{"watched_at", "listed_at", "rated_at"} {
+			if ts := parseTraktTime(on[key]); ts > 0 {
+				row.Timestamp = ts
+				break
+			}
+		}
+		if rating, ok := on["rating"].(float64); ok {
+			row.Rating = int(rating)
+		}
+		ret = append(ret, row)
+	}
+	return ret, nil
+}
+
+/* Matching */
+func lookupImdbByTitle(title string, year int, item_type string) (string, string) {
+	/* Exact OMDb title lookup first */
+	if len(configuration.OmdbApiKeys) > 0 {
+		omdb_type := "movie"
+		if item_type == "show" {
+			omdb_type = "series"
+		}
+		params := url.Values{
+			"t": {title},
+			"type": {omdb_type},
+		}
+		if year > 0 {
+			params.Set("y", strconv.Itoa(year))
+		}
+		if got, err := omdbQuery(params); err == nil {
+			if id, ok := got["imdbID"].(string); ok && len(id) > 0 {
+				return id, "title"
+			}
+		}
+	}
+
+	/* Fall back to Trakt.tv search, preferring a matching year */
+	if item_type != "movie" || !traktSyncEnabled() {
+		return "", ""
+	}
+	results, err := searchTraktMovies(url.QueryEscape(title), "movie")
+	if err != nil {
+		return "", ""
+	}
+	for _, on := range results {
+		found_year, _ := on["year"].(float64)
+		if year > 0 && int(found_year) != year {
+			continue
+		}
+		if ids := filterTraktIds([]map[string]interface{}{on}); len(ids) > 0 {
+			return ids[0], "search"
+		}
+	}
+	return "", ""
+}
+
+func parseImportData(format string, data string) ([]ImportRow, error) {
+	switch format {
+		case "letterboxd":
+			return parseLetterboxdCsv(data)
+		case "imdb":
+			return parseImdbCsv(data)
+		case "trakt":
+			return parseTraktJson(data)
+	}
+	return nil, errors.New("Unknown import format")
+}
+
+func StartImport(format string, target string, data string) (*TransferJob, error) {
+	if len(format) == 0 {
+		format = detectImportFormat(data)
+	}
+	if target != "history" && target != "watchlist" && target != "ratings" {
+		return nil, errors.New("Unknown import target")
+	}
+	rows, err := parseImportData(format, data)
+	if err != nil {
+		return nil, err
+	}
+
+	job := transferJobs.create("import", format, target)
+	transferJobs.update(job, func() {
+		job.Total = len(rows)
+	})
+	go runImport(job, rows)
+	return job, nil
+}
+
+func runImport(job *TransferJob, rows []ImportRow) {
+	matches := make(map[string]string)
+	var ratings []ImportRow
+	report := make([]ImportMatch, 0, len(rows))
+	var watch_rows []ImportRow
+	var watch_matches []int
+	for idx, row := range rows {
+		/* Match row to an IMDb ID */
+		match := ImportMatch{
+			Row: idx + 1,
+			Title: row.Title,
+			Year: row.Year,
+			ImdbID: row.ImdbID,
+		}
+		if len(row.ImdbID) > 0 {
+			match.MatchedBy = "id"
+		} else {
+			key := fmt.Sprintf("%s|%d|%s", strings.ToLower(row.Title), row.Year, row.ItemType)
+			if _, ok := matches[key]; !ok {
+				id, by := lookupImdbByTitle(row.Title, row.Year, row.ItemType)
+				matches[key] = id + "|" + by
+			}
+			arr := strings.SplitN(matches[key], "|", 2)
+			match.ImdbID, match.MatchedBy = arr[0], arr[1]
+			row.ImdbID = match.ImdbID
+		}
+
+		/* Apply row */
+		if len(row.ImdbID) == 0 {
+			match.Status = "unmatched"
+		} else if job.Target == "ratings" {
+			if row.Rating > 0 {
+				ratings = append(ratings, row)
+				match.Status = "imported"
+			} else {
+				match.Status = "unmatched"
+			}
+		} else {
+			/* Applied together below, as one update of the store */
+			watch_rows = append(watch_rows, row)
+			watch_matches = append(watch_matches, len(report))
+		}
+		report = append(report, match)
+
+		transferJobs.update(job, func() {
+			job.Processed += 1
+		})
+	}
+
+	/* Record history and watchlist rows */
+	if len(watch_rows) > 0 {
+		for idx, imported := range watchStore.Import(job.Target, watch_rows) {
+			if imported {
+				report[watch_matches[idx]].Status = "imported"
+			} else {
+				report[watch_matches[idx]].Status = "duplicate"
+			}
+		}
+	}
+	transferJobs.update(job, func() {
+		for _, match := range report {
+			job.Summary[match.Status] += 1
+		}
+		job.Report = append(job.Report, report...)
+	})
+
+	/* Ratings only live on Trakt.tv, so submit them in batches */
+	var err error
+	if len(ratings) > 0 {
+		err = submitImportedRatings(ratings)
+	}
+
+	/* Replicate imported history and watchlist in bulk */
+	if err == nil && job.Target != "ratings" && traktSyncEnabled() {
+		go watchStore.SyncTrakt()
+	}
+	transferJobs.finish(job, err)
+}
+
+func submitImportedRatings(rows []ImportRow) (error) {
+	if !traktSyncEnabled() {
+		return errors.New("Ratings can only be imported with Trakt.tv sync enabled")
+	}
+	for start := 0; start < len(rows); start += IMPORT_RATINGS_BATCH_SIZE {
+		end := start + IMPORT_RATINGS_BATCH_SIZE
+		if end > len(rows) {
+			end = len(rows)
+		}
+		batch := make(map[string][]map[string]interface{})
+		for _, on := range rows[start:end] {
+			item := map[string]interface{}{
+				"ids": map[string]interface{}{"imdb": on.ImdbID},
+				"rating": on.Rating,
+			}
+			if on.Timestamp > 0 {
+				item["rated_at"] = formatTraktTime(on.Timestamp)
+			}
+			batch[on.ItemType + "s"] = append(batch[on.ItemType + "s"], item)
+		}
+		body := make(map[string]interface{})
+		for k, v := range batch {
+			body[k] = v
+		}
+		if _, err := traktOutbox.Submit("POST", RatingsAddUrl, body, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import records imported rows in the local store in a single update. The
+// result tells for each row whether it was new, false meaning an equivalent
+// entry already existed.
+func (ws *WatchStore) Import(target string, rows []ImportRow) []bool {
+	imported := make([]bool, len(rows))
+	ws.Update(func() {
+		now := time.Now().Unix()
+		if target == "watchlist" {
+			for idx, row := range rows {
+				if existing, ok := ws.Watchlist[row.ImdbID]; ok && !existing.Deleted {
+					continue
+				}
+				updated_at := row.Timestamp
+				if updated_at == 0 {
+					updated_at = now
+				}
+				ws.Watchlist[row.ImdbID] = &WatchlistEntry{
+					ImdbID: row.ImdbID,
+					ItemType: row.ItemType,
+					UpdatedAt: updated_at,
+				}
+				imported[idx] = true
+			}
+			return
+		}
+
+		/* History rows without a date can only be recorded once */
+		watched := make(map[string][]*WatchEvent)
+		for _, on := range ws.History {
+			if on.DeletedAt == 0 {
+				watched[on.ImdbID] = append(watched[on.ImdbID], on)
+			}
+		}
+		for idx, row := range rows {
+			duplicate := false
+			for _, on := range watched[row.ImdbID] {
+				if row.Timestamp == 0 || abs64(on.WatchedAt - row.Timestamp) <= WATCH_EVENT_MATCH_WINDOW {
+					duplicate = true
+					break
+				}
+			}
+			if duplicate {
+				continue
+			}
+			watched_at := row.Timestamp
+			if watched_at == 0 {
+				watched_at = now
+			}
+			event := &WatchEvent{
+				ImdbID: row.ImdbID,
+				ItemType: row.ItemType,
+				WatchedAt: watched_at,
+			}
+			ws.History = append(ws.History, event)
+			watched[row.ImdbID] = append(watched[row.ImdbID], event)
+			imported[idx] = true
+		}
+	})
+	return imported
+}
+
+/* Exporting */
+func (ws *WatchStore) exportRows(source string) []ImportRow {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	var ret []ImportRow
+	switch source {
+		case "history":
+			for _, on := range ws.History {
+				if on.DeletedAt == 0 {
+					ret = append(ret, ImportRow{ImdbID: on.ImdbID, ItemType: on.ItemType, Timestamp: on.WatchedAt})
+				}
+			}
+		case "watchlist":
+			for _, on := range ws.Watchlist {
+				if !on.Deleted {
+					ret = append(ret, ImportRow{ImdbID: on.ImdbID, ItemType: on.ItemType, Timestamp: on.UpdatedAt})
+				}
+			}
+	}
+	return ret
+}
+
+func exportSourceRows(source string) ([]ImportRow, error) {
+	switch source {
+		case "history", "watchlist":
+			return watchStore.exportRows(source), nil
+		case "library":
+			var ret []ImportRow
+			for _, id := range deDup(downloadPool.GetAssociatedDownloads()) {
+				ret = append(ret, ImportRow{ImdbID: id, ItemType: "movie"})
+			}
+			return ret, nil
+	}
+	return nil, errors.New("Unknown export source")
+}
+
+func StartExport(format string, source string) (*TransferJob, error) {
+	if format != "letterboxd" && format != "imdb" && format != "trakt" {
+		return nil, errors.New("Unknown export format")
+	}
+	rows, err := exportSourceRows(source)
+	if err != nil {
+		return nil, err
+	}
+
+	job := transferJobs.create("export", format, source)
+	transferJobs.update(job, func() {
+		job.Total = len(rows)
+	})
+	go runExport(job, rows)
+	return job, nil
+}
+
+func runExport(job *TransferJob, rows []ImportRow) {
+	/* Fill in titles and years from metadata */
+	movieWorker := movieData{}
+	for idx := range rows {
+		if resolved, err := movieWorker.ResolveImdb(rows[idx].ImdbID); err == nil {
+			year, _ := resolved["year"].(int)
+			title, _ := resolved["title"].(string)
+			rows[idx].Year = year
+			rows[idx].Title = strings.TrimSuffix(title, fmt.Sprintf(" (%d)", year))
+			if is_tv, _ := resolved["is_tv_show"].(bool); is_tv {
+				rows[idx].ItemType = "show"
+			}
+		}
+		transferJobs.update(job, func() {
+			job.Processed += 1
+		})
+	}
+
+	/* Ratings only live on Trakt.tv */
+	if job.Format == "letterboxd" && traktSyncEnabled() {
+		ratings := make(map[string]int)
+		for _, item_type := range []string{"movie", "show"} {
+			rated, err := movieWorker.GetRatings(item_type)
+			if err != nil {
+				fmt.Printf("Warning: could not export %s ratings: %s\n", item_type, err)
+				continue
+			}
+			for _, on := range rated {
+				imdb_id, _ := on["imdb_code"].(string)
+				rating, _ := on["rating"].(float64)
+				ratings[imdb_id] = int(rating)
+			}
+		}
+		for idx := range rows {
+			rows[idx].Rating = ratings[rows[idx].ImdbID]
+		}
+	}
+
+	var output string
+	var err error
+	switch job.Format {
+		case "letterboxd":
+			output, err = exportLetterboxdCsv(rows)
+		case "imdb":
+			output, err = exportImdbCsv(rows)
+		case "trakt":
+			output, err = exportTraktJson(job.Target, rows)
+	}
+	transferJobs.update(job, func() {
+		job.Output = output
+		job.Summary["exported"] = len(rows)
+	})
+	transferJobs.finish(job, err)
+}
+
+func formatExportDate(unix int64) string {
+	if unix == 0 {
+		return ""
+	}
+	return time.Unix(unix, 0).UTC().Format("2006-01-02")
+}
+
+func formatExportYear(year int) string {
+	if year == 0 {
+		return ""
+	}
+	return strconv.Itoa(year)
+}
+
+func exportLetterboxdCsv(rows []ImportRow) (string, error) {
+	/* Columns understood by the Letterboxd importer */
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write([]string{"imdbID", "Title", "Year", "WatchedDate", "Rating10"})
+	for _, on := range rows {
+		rating := ""
+		if on.Rating > 0 {
+			rating = strconv.Itoa(on.Rating)
+		}
+		writer.Write([]string{on.ImdbID, on.Title, formatExportYear(on.Year), formatExportDate(on.Timestamp), rating})
+	}
+	writer.Flush()
+	return buf.String(), writer.Error()
+}
+
+func exportImdbCsv(rows []ImportRow) (string, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write([]string{"Position", "Const", "Created", "Title", "URL", "Title Type", "Year"})
+	for idx, on := range rows {
+		title_type := "movie"
+		if on.ItemType == "show" {
+			title_type = "tvSeries"
+		}
+		writer.Write([]string{
+			strconv.Itoa(idx + 1),
+			on.ImdbID,
+			formatExportDate(on.Timestamp),
+			on.Title,
+			fmt.Sprintf("https://www.imdb.com/title/%s/", on.ImdbID),
+			title_type,
+			formatExportYear(on.Year),
+		})
+	}
+	writer.Flush()
+	return buf.String(), writer.Error()
+}
+
+func exportTraktJson(source string, rows []ImportRow) (string, error) {
+	time_key := "listed_at"
+	if source == "history" {
+		time_key = "watched_at"
+	}
+	out := make([]map[string]interface{}, 0)
+	for _, on := range rows {
+		item := map[string]interface{}{
+			"title": on.Title,
+			"ids": map[string]interface{}{"imdb": on.ImdbID},
+		}
+		if on.Year > 0 {
+			item["year"] = on.Year
+		}
+		entry := map[string]interface{}{
+			"type": on.ItemType,
+			on.ItemType: item,
+		}
+		if on.Timestamp > 0 {
+			entry[time_key] = formatTraktTime(on.Timestamp)
+		}
+		out = append(out, entry)
+	}
+	out_bytes, err := json.MarshalIndent(out, "", "  ")
+	return string(out_bytes), err
+}
+
+func exportDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := transferJobs.Get(r.URL.Query().Get("id"))
+	if !ok || job.Kind != "export" || job.Status != "done" {
+		http.Error(w, "No finished export with that id", http.StatusNotFound)
+		return
+	}
+	extension, content_type := "csv", "text/csv"
+	if job.Format == "trakt" {
+		extension, content_type = "json", "application/json"
+	}
+	w.Header().Set("Content-Type", content_type)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-%s.%s\"", job.Target, job.Format, extension))
+	fmt.Fprint(w, job.Output)
+}
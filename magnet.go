@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MagnetUri is a parsed magnet link. Parameters other than the exact topic,
+// display name and trackers are kept as they came.
+type MagnetUri struct {
+	InfoHash string // lowercase hex, or "btmh:" and the multihash for v2-only torrents
+	Name string
+	Trackers []string
+	Extra url.Values
+}
+
+/* Torrent download links often name the info hash in their path */
+var torrentUrlHash = regexp.MustCompile(`(?i)(?:^|[^0-9a-f])([0-9a-f]{40})(?:[^0-9a-f]|$)`)
+
+const NO_FILENAME = "(no filename available)"
+
+func ParseMagnet(uri string) (*MagnetUri, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(parsed.Scheme, "magnet") {
+		return nil, errors.New("Not a magnet URI")
+	}
+	params, err := url.ParseQuery(parsed.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	magnet := &MagnetUri{Extra: url.Values{}}
+	for key, values := range params {
+		switch key {
+			case "xt":
+				for _, topic := range values {
+					if hash, ok := parseExactTopic(topic); ok && (len(magnet.InfoHash) == 0 || strings.HasPrefix(magnet.InfoHash, "btmh:")) {
+						magnet.InfoHash = hash
+					}
+				}
+			case "dn":
+				magnet.Name = values[0]
+			case "tr":
+				magnet.AddTrackers(values...)
+			default:
+				magnet.Extra[key] = values
+		}
+	}
+	if len(magnet.InfoHash) == 0 {
+		return nil, errors.New("Magnet URI carries no BitTorrent info hash")
+	}
+	return magnet, nil
+}
+
+/* v1 hashes are 40 hex or 32 base32 characters; v1 wins over v2 in hybrids */
+func parseExactTopic(topic string) (string, bool) {
+	lower := strings.ToLower(topic)
+	switch {
+		case strings.HasPrefix(lower, "urn:btih:"):
+			hash := topic[len("urn:btih:"):]
+			if len(hash) == 32 {
+				decoded, err := base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+				if err != nil {
+					return "", false
+				}
+				hash = hex.EncodeToString(decoded)
+			}
+			if _, err := hex.DecodeString(hash); err != nil || len(hash) != 40 {
+				return "", false
+			}
+			return strings.ToLower(hash), true
+		case strings.HasPrefix(lower, "urn:btmh:"):
+			hash := lower[len("urn:btmh:"):]
+			if _, err := hex.DecodeString(hash); err != nil || len(hash) < 4 {
+				return "", false
+			}
+			return "btmh:" + hash, true
+	}
+	return "", false
+}
+
+// AddTrackers appends trackers the magnet does not list yet.
+func (magnet *MagnetUri) AddTrackers(trackers ...string) {
+	for _, tracker := range trackers {
+		tracker = strings.TrimSpace(tracker)
+		if len(tracker) == 0 {
+			continue
+		}
+		known := false
+		for _, on := range magnet.Trackers {
+			if on == tracker {
+				known = true
+				break
+			}
+		}
+		if !known {
+			magnet.Trackers = append(magnet.Trackers, tracker)
+		}
+	}
+}
+
+func (magnet *MagnetUri) String() string {
+	uri := "magnet:?xt=urn:btih:" + magnet.InfoHash
+	if strings.HasPrefix(magnet.InfoHash, "btmh:") {
+		uri = "magnet:?xt=urn:" + magnet.InfoHash
+	}
+	if len(magnet.Name) > 0 {
+		uri += "&dn=" + url.QueryEscape(magnet.Name)
+	}
+	for _, tracker := range magnet.Trackers {
+		uri += "&tr=" + url.QueryEscape(tracker)
+	}
+	if len(magnet.Extra) > 0 {
+		uri += "&" + magnet.Extra.Encode()
+	}
+	return uri
+}
+
+// InfoHashOf finds the info hash of a magnet link, or of a torrent download
+// link that names it. Returns "" if there is none.
+func InfoHashOf(uri string) string {
+	if magnet, err := ParseMagnet(uri); err == nil {
+		return magnet.InfoHash
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	if match := torrentUrlHash.FindStringSubmatch(parsed.Path + "?" + parsed.RawQuery); match != nil {
+		return strings.ToLower(match[1])
+	}
+	return ""
+}
+
+// ValidateSourceUri accepts magnet links with an info hash and absolute
+// http(s) links.
+func ValidateSourceUri(uri string) error {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(parsed.Scheme) {
+		case "magnet":
+			_, err = ParseMagnet(uri)
+			return err
+		case "http", "https":
+			if len(parsed.Host) == 0 {
+				return errors.New("Link has no host")
+			}
+			return nil
+	}
+	return errors.New(fmt.Sprintf("Unsupported link scheme \"%s\"", parsed.Scheme))
+}
+
+/* String list from config, where JSON arrays arrive as []interface{} */
+func configStrings(value interface{}) []string {
+	ret := make([]string, 0)
+	switch list := value.(type) {
+		case []string:
+			ret = append(ret, list...)
+		case []interface{}:
+			for _, elem := range list {
+				if str, ok := elem.(string); ok {
+					ret = append(ret, str)
+				}
+			}
+	}
+	return ret
+}
+
+// withTrackers appends trackers to a magnet link, leaving other links alone.
+func withTrackers(uri string, trackers []string) string {
+	if len(trackers) == 0 {
+		return uri
+	}
+	magnet, err := ParseMagnet(uri)
+	if err != nil {
+		return uri
+	}
+	magnet.AddTrackers(trackers...)
+	return magnet.String()
+}
+
+// prepareSources drops sources with unusable links, appends the configured
+// trackers and fills in info hashes and origins.
+func prepareSources(name string, sources []ItemSource, trackers []string) []ItemSource {
+	ret := make([]ItemSource, 0, len(sources))
+	now := time.Now().Unix()
+	for _, on := range sources {
+		on.FetchedAt = now
+		if err := ValidateSourceUri(on.Url); err != nil {
+			fmt.Printf("Warning: source %s: dropping %s: %s\n", name, on.Url, err)
+			continue
+		}
+		on.Url = withTrackers(on.Url, trackers)
+		identifySource(&on)
+		ret = append(ret, on)
+	}
+	return ret
+}
+
+func identifySource(on *ItemSource) {
+	if len(on.InfoHash) == 0 {
+		on.InfoHash = InfoHashOf(on.Url)
+	}
+	if len(on.Origins) == 0 && len(on.SourceHostname) > 0 {
+		on.Origins = []string{on.SourceHostname}
+	}
+}
+
+func sourceKey(on ItemSource) string {
+	if len(on.InfoHash) > 0 {
+		return "hash:" + on.InfoHash
+	}
+	return "url:" + on.Url
+}
+
+/* Fold another listing of the same torrent into on */
+func mergeSource(on *ItemSource, other ItemSource) {
+	if other.SourceCount > on.SourceCount {
+		on.SourceCount = other.SourceCount
+	}
+	if other.ClientCount > on.ClientCount {
+		on.ClientCount = other.ClientCount
+	}
+	if other.FetchedAt > on.FetchedAt {
+		on.FetchedAt = other.FetchedAt
+	}
+	for _, origin := range other.Origins {
+		if indexFold(on.Origins, origin) < 0 {
+			on.Origins = append(on.Origins, origin)
+		}
+	}
+
+	/* Magnets carry their trackers, so prefer them and pool the trackers */
+	mine, mine_err := ParseMagnet(on.Url)
+	theirs, theirs_err := ParseMagnet(other.Url)
+	if mine_err == nil && theirs_err == nil {
+		mine.AddTrackers(theirs.Trackers...)
+		on.Url = mine.String()
+	} else if mine_err != nil && theirs_err == nil {
+		on.Url = other.Url
+	}
+
+	/* Fill in whatever the first listing did not know */
+	if (len(on.Filename) == 0 || on.Filename == NO_FILENAME) && len(other.Filename) > 0 && other.Filename != NO_FILENAME {
+		on.Filename = other.Filename
+		on.Release = other.Release
+	}
+	if on.SizeBytes <= 0 && other.SizeBytes > 0 {
+		on.SizeBytes, on.Size = other.SizeBytes, other.Size
+	}
+	if other.UploadedAt > 0 && (on.UploadedAt == 0 || other.UploadedAt < on.UploadedAt) {
+		on.UploadedAt = other.UploadedAt
+	}
+	if on.TV == nil {
+		on.TV = other.TV
+	}
+}
+
+// MergeSources collapses listings of the same torrent from different sites
+// into one, keeping the highest counts and every site it was found on. The
+// order of first appearance is kept.
+func MergeSources(sources []ItemSource) []ItemSource {
+	ret := make([]ItemSource, 0, len(sources))
+	index := make(map[string]int)
+	for _, on := range sources {
+		identifySource(&on)
+		key := sourceKey(on)
+		if idx, ok := index[key]; ok {
+			mergeSource(&ret[idx], on)
+			continue
+		}
+		index[key] = len(ret)
+		ret = append(ret, on)
+	}
+	return ret
+}
@@ -35,6 +35,7 @@ func main() {
 	var (
 		listen = flag.String("listen", ":8080", "HTTP listen address")
 		proxy  = flag.String("proxy", "", "Optional comma-separated list of URLs to proxy movies requests")
+		traktLogin = flag.Bool("trakt-login", false, "Authorize Trakt.tv via device code before serving")
 	)
 	flag.Parse()
 
@@ -49,6 +50,12 @@ func main() {
 		fmt.Println(configuration)
 	}*/
 
+	/* Instantiate configured sources */
+	if err := LoadSources(); err != nil {
+		fmt.Println("Error loading sources:", err)
+		panic("Could not load sources")
+	}
+
 	/* Initialize client */
 	netClient.Timeout = time.Duration(configuration.ClientTimeoutSeconds) * time.Second
 	netClient.MaxRetries = configuration.ClientMaxRetries
@@ -64,18 +71,51 @@ func main() {
 		refresh_token_url: configuration.RefreshTokenUrl,
 		api_url: configuration.ApiUrl,
 	}
-	traktClient = trakt.NewClientWith(
-		configuration.TraktBaseUrl,
-		"Trakt Golang Client",
-		configuration.TraktClientId,
-		trakt.TokenAuth{AccessToken: configuration.TraktAccessToken},
-		nil,
-	)
+
+	/* Initialize Trakt.tv authorization */
+	traktAuth.ReadFromDisk()
+	if *traktLogin {
+		info, err := traktAuth.StartDeviceLogin()
+		if err != nil {
+			fmt.Println("Error starting Trakt login:", err)
+			panic("Could not start Trakt login")
+		}
+		fmt.Printf("Go to %s and enter code %s to authorize Trakt.tv\n", info["verification_url"], info["user_code"])
+		if err = traktAuth.WaitForDeviceLogin(); err != nil {
+			fmt.Println("Error completing Trakt login:", err)
+			panic("Could not complete Trakt login")
+		}
+		fmt.Println("Trakt.tv authorized")
+	}
+	go traktAuth.MonitorExpiry()
+	traktOutbox.ReadFromDisk()
+	go traktOutbox.Run()
+
+	/* Initialize local watch history */
+	watchStore.ReadFromDisk()
+	go watchStore.RunSync()
+
+	/* Initialize cast and crew credits */
+	creditsStore.ReadFromDisk()
+	go creditsStore.RunEnrichment()
+
+	/* Initialize poster cache */
+	posterCache.ReadFromDisk()
 
 	/* Initialize downloads */
 	downloadPool.queue = make(chan interface{}, 100)
 	downloadPool.lock = &sync.Mutex{}
 	downloadPool.ReadFromDisk()
+	go creditsStore.IndexCatalog()
+
+	/* Initialize source cache */
+	sourceCache.ReadFromDisk()
+
+	/* Initialize upcoming release tracking */
+	releaseTracker.ReadFromDisk()
+	go releaseTracker.Run()
+	feedWatcher.ReadFromDisk()
+	go feedWatcher.Run()
 
 	/* Initialize microservices */
 	logger = log.NewLogfmtLogger(os.Stderr)
@@ -123,6 +163,12 @@ func main() {
 	http.Handle("/static/", http.StripPrefix("/static/", maxAgeHandler(0, http.FileServer(http.Dir("static")))))
 	http.Handle("/movies", moviesHandler)
 	http.Handle("/count", countHandler)
+	http.HandleFunc("/export", exportDownloadHandler)
+	http.HandleFunc("/poster", posterHandler)
+	http.HandleFunc("/subtitles", subtitlesHandler)
+	http.HandleFunc("/calendar.ics", calendarHandler)
+	http.HandleFunc("/health/sources", sourceHealthHandler)
+	http.HandleFunc("/search/stream", searchStreamHandler)
 	http.Handle("/metrics", promhttp.Handler())
 	logger.Log("msg", "HTTP", "addr", *listen)
 	logger.Log("err", http.ListenAndServe(*listen, nil))
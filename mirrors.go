@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MIRROR_REQUEST_TIMEOUT_SECONDS = 20
+
+// Mirrored lets a source spread its requests over mirrors of its site and
+// over proxies. Sources embed it and fetch through Get; the mirrors and
+// proxies are read from the same config entry as the rest of the source.
+type Mirrored struct {
+	Mirrors []string `mapstructure:"mirrors"` // base URLs serving the same site
+	Proxies []string `mapstructure:"proxies"` // http://, https:// or socks5:// proxies
+	Race bool `mapstructure:"race"` // query every route at once instead of failing over in turn
+
+	lock sync.Mutex
+	routes map[string]*mirrorRoute // by base and proxy, shared by every primary
+	route_list []*mirrorRoute // in the order they were set up
+	route_sets map[string][]*mirrorRoute // by primary
+	preferred map[string]*mirrorRoute // by primary, the route that worked last
+}
+
+type mirrorRoute struct {
+	Base string `json:"base"`
+	Proxy string `json:"proxy,omitempty"`
+	Healthy bool `json:"healthy"`
+	Preferred bool `json:"preferred"`
+	Failures int `json:"failures"` // consecutive
+	LastOk int64 `json:"last_ok,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+	LastLatencyMs int64 `json:"last_latency_ms,omitempty"`
+	client *http.Client
+}
+
+/* Every mirror through every proxy, or directly if there are none. Sources */
+/* may fetch from several hosts, so each primary gets its own set of routes */
+func (m *Mirrored) routesFor(primary string) []*mirrorRoute {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if set, ok := m.route_sets[primary]; ok {
+		return set
+	}
+	if m.route_sets == nil {
+		m.routes = make(map[string]*mirrorRoute)
+		m.route_sets = make(map[string][]*mirrorRoute)
+		m.preferred = make(map[string]*mirrorRoute)
+	}
+
+	bases := append([]string{primary}, m.Mirrors...)
+	proxies := m.Proxies
+	if len(proxies) == 0 {
+		proxies = []string{""}
+	}
+	set := make([]*mirrorRoute, 0)
+	seen := make(map[string]bool)
+	for _, base := range bases {
+		base = strings.TrimSuffix(base, "/")
+		if len(base) == 0 || seen[base] {
+			continue
+		}
+		seen[base] = true
+		for _, proxy := range proxies {
+			key := base + " " + proxy
+			if route, ok := m.routes[key]; ok {
+				set = append(set, route)
+				continue
+			}
+			route := &mirrorRoute{Base: base, Proxy: proxy, Healthy: true}
+			if len(proxy) > 0 {
+				proxy_url, err := url.Parse(proxy)
+				if err != nil {
+					fmt.Printf("Warning: ignoring proxy %s: %s\n", proxy, err)
+					continue
+				}
+				route.client = &http.Client{
+					Transport: &http.Transport{Proxy: http.ProxyURL(proxy_url)},
+					Timeout: MIRROR_REQUEST_TIMEOUT_SECONDS * time.Second,
+				}
+			}
+			m.routes[key] = route
+			m.route_list = append(m.route_list, route)
+			set = append(set, route)
+		}
+	}
+	m.route_sets[primary] = set
+	return set
+}
+
+func (m *Mirrored) fetchRoute(ctx context.Context, route *mirrorRoute, target string, validate func([]byte) error) ([]byte, error) {
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	var resp *http.Response
+	if route.client != nil {
+		resp, err = route.client.Do(req)
+	} else {
+		resp, err = netClient.Do(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("%s returned %s", route.Base, resp.Status))
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if validate != nil {
+		if err = validate(body); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+func (m *Mirrored) record(primary string, route *mirrorRoute, begin time.Time, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	route.LastLatencyMs = time.Since(begin).Nanoseconds() / int64(time.Millisecond)
+	if err != nil {
+		route.Failures += 1
+		route.LastError = err.Error()
+		route.Healthy = false
+		return
+	}
+	route.Failures = 0
+	route.LastOk = time.Now().Unix()
+	route.Healthy = true
+	m.preferred[primary] = route
+}
+
+// Get fetches target, a URL under primary, through the mirrors and proxies
+// until one of them returns a body that validate accepts. Without mirrors
+// or proxies this is a plain request.
+func (m *Mirrored) Get(primary string, target string, validate func([]byte) error) ([]byte, error) {
+	primary = strings.TrimSuffix(primary, "/")
+	routes := m.routesFor(primary)
+	if len(routes) == 0 {
+		return m.fetchRoute(context.Background(), &mirrorRoute{Base: primary}, target, validate)
+	}
+	rewrite := func(route *mirrorRoute) string {
+		if len(primary) > 0 && strings.HasPrefix(target, primary) {
+			return route.Base + strings.TrimPrefix(target, primary)
+		}
+		return target
+	}
+
+	/* Healthy routes first, starting with the one that worked last */
+	m.lock.Lock()
+	order := make([]*mirrorRoute, 0, len(routes))
+	if preferred, ok := m.preferred[primary]; ok {
+		order = append(order, preferred)
+	}
+	for _, healthy := range []bool{true, false} {
+		for _, route := range routes {
+			if route.Healthy == healthy && route != m.preferred[primary] {
+				order = append(order, route)
+			}
+		}
+	}
+	m.lock.Unlock()
+
+	if !m.Race || len(order) == 1 {
+		var last_err error
+		for _, route := range order {
+			begin := time.Now()
+			body, err := m.fetchRoute(context.Background(), route, rewrite(route), validate)
+			m.record(primary, route, begin, err)
+			if err == nil {
+				return body, nil
+			}
+			last_err = err
+		}
+		return nil, last_err
+	}
+
+	/* Race every route, keep the first good answer and cancel the rest */
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type raced struct {
+		body []byte
+		err error
+	}
+	done := make(chan raced, len(order))
+	for _, route := range order {
+		go func(route *mirrorRoute) {
+			begin := time.Now()
+			body, err := m.fetchRoute(ctx, route, rewrite(route), validate)
+			if ctx.Err() == nil || err == nil {
+				m.record(primary, route, begin, err)
+			}
+			done <- raced{body, err}
+		}(route)
+	}
+	var last_err error
+	for range order {
+		on := <-done
+		if on.err == nil {
+			return on.body, nil
+		}
+		last_err = on.err
+	}
+	return nil, last_err
+}
+
+// MirrorStatus reports how each mirror and proxy route has been doing.
+func (m *Mirrored) MirrorStatus() []mirrorRoute {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := make([]mirrorRoute, 0, len(m.route_list))
+	for _, route := range m.route_list {
+		status := *route
+		for _, preferred := range m.preferred {
+			status.Preferred = status.Preferred || preferred == route
+		}
+		ret = append(ret, status)
+	}
+	return ret
+}
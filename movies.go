@@ -17,6 +17,7 @@ import (
 	"math/rand"
 	"runtime"
 	"os"
+	"net/url"
 
 	"github.com/coocood/freecache"
 	"github.com/42minutes/go-trakt"
@@ -35,10 +36,24 @@ type MovieData interface {
 	AddToWatchlist(item_type string, item_id string) (map[string]interface{}, error)
 	AddWatchHistory(item_type string, item_id string) (map[string]interface{}, error)
 	GetWatchHistory(load_balancer_addr string) ([]map[string]interface{}, error)
+	RemoveFromWatchlist(item_type string, item_id string) (map[string]interface{}, error)
+	RemoveWatchHistory(item_type string, item_id string) (map[string]interface{}, error)
+	RateItem(item_type string, item_id string, rating int) (map[string]interface{}, error)
+	UnrateItem(item_type string, item_id string) (map[string]interface{}, error)
+	GetRatings(item_type string) ([]map[string]interface{}, error)
+
+	/* Trakt.tv custom lists */
+	GetLists() ([]map[string]interface{}, error)
+	CreateList(opts map[string]interface{}) (map[string]interface{}, error)
+	UpdateList(list_id string, opts map[string]interface{}) (map[string]interface{}, error)
+	DeleteList(list_id string) (map[string]interface{}, error)
+	GetListItems(list_id string) ([]string, error)
+	AddToList(list_id string, item_type string, item_id string) (map[string]interface{}, error)
+	RemoveFromList(list_id string, item_type string, item_id string) (map[string]interface{}, error)
 
 	/* Media sources */
 	SearchForItem(opts map[string]interface{}, load_balancer_addr string) ([]map[string]interface{}, error)
-	GetItem(id string, load_balancer_addr string) (map[string]interface{}, error)
+	GetItem(id string, refresh bool, load_balancer_addr string) (map[string]interface{}, error)
 }
 
 type movieData struct{}
@@ -105,7 +120,7 @@ func identifyPanic() string {
 /* Interface functions */
 const (
 	IMDB_KEY_ID = "imdbKeyId-"
-	ITEM_KEY_ID = "itemKeyId-"
+	TITLE_KEY_ID = "titleKeyId-"
 )
 
 var cache *freecache.Cache = freecache.NewCache(20 * 1024 * 1024)
@@ -251,6 +266,7 @@ func (movieData) ResolveImdb(id string) (parsed map[string]interface{}, err erro
     	if v != nil {
     		panic(v)
     	}
+    	parsed["people"] = creditsStore.People(id)
     	return parsed, err
     }
 
@@ -364,10 +380,79 @@ func (movieData) ResolveImdb(id string) (parsed map[string]interface{}, err erro
 	parsed_bytes, ok := GetBytes(parsed)
 	cache.Set([]byte(IMDB_KEY_ID + id), parsed_bytes, /*24 hours=*/24 * 60 * 60)
 
+	// Structured cast and crew, kept outside the cache since it is enriched later
+	creditsStore.RecordOmdb(id, title, body_json)
+	parsed["people"] = creditsStore.People(id)
+
 	// Return gathered data
 	return parsed, err
 }
 
+// omdbQuery performs a raw OMDb API request with a random configured key.
+func omdbQuery(params url.Values) (map[string]interface{}, error) {
+	if len(configuration.OmdbApiKeys) == 0 {
+		return nil, errors.New("No OMDb API keys configured")
+	}
+	params.Set("apikey", configuration.OmdbApiKeys[rand.Intn(len(configuration.OmdbApiKeys))])
+	res, err := netClient.Get("http://www.omdbapi.com/?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var ret map[string]interface{}
+	if err = json.NewDecoder(res.Body).Decode(&ret); err != nil {
+		return nil, err
+	}
+	if ret["Response"] == "False" {
+		err_msg, _ := ret["Error"].(string)
+		return nil, errors.New("OMDb: " + err_msg)
+	}
+	return ret, nil
+}
+
+// lookupViaBalancer resolves a single IMDb id through the load-balancer so
+// the work is spread across instances, returning nil if it cannot be resolved.
+func lookupViaBalancer(imdb_id string, load_balancer_addr string) map[string]interface{} {
+	to_send := new(bytes.Buffer)
+	json.NewEncoder(to_send).Encode(map[string]interface{}{
+		"q": map[string]interface{}{
+			"type": "imdbIdLookup",
+			"data": map[string]interface{}{
+				"id": imdb_id,
+			},
+		},
+	})
+	body := to_send.Bytes()
+	posting_url := fmt.Sprintf("http://%s/movies", load_balancer_addr)
+	var res (*http.Response)
+	var ok error
+	for ct := 1; ; ct += 1 {
+		res, ok = netClient.Post(
+			posting_url,
+			"application/json; charset=utf-8",
+			bytes.NewReader(body),
+		)
+		if ok != nil {
+			fmt.Println("Error:", ok)
+			if ct > 5 {
+				return nil
+			}
+			fmt.Println("retrying - attempt #" + strconv.Itoa(ct))
+			time.Sleep(200 * time.Millisecond)
+			continue
+		}
+		break
+	}
+	defer res.Body.Close()
+	var got moviesResponse
+	json.NewDecoder(res.Body).Decode(&got)
+	if got.V == nil {
+		return nil
+	}
+	got.V["sources"] = []ItemSource{}
+	return got.V
+}
+
 func (movieData) ResolveParallel(ids []string, load_balancer_addr string) (ret []map[string]interface{}, err error) {
 	defer func() {
         if r := recover(); r != nil {
@@ -380,48 +465,7 @@ func (movieData) ResolveParallel(ids []string, load_balancer_addr string) (ret [
     // Resolve ID's in parallel via the load-balancer
     for _, imdb_id := range ids {
     	go func(imdb_id string) {
-    		to_send := new(bytes.Buffer)
-    		json.NewEncoder(to_send).Encode(map[string]interface{}{
-    			"q": map[string]interface{}{
-    				"type": "imdbIdLookup",
-    				"data": map[string]interface{}{
-    					"id": imdb_id,
-    				},
-    			},
-    		})
-    		posting_url := fmt.Sprintf("http://%s/movies", load_balancer_addr)
-    		//fmt.Println(to_send)
-    		var res (*http.Response)
-    		var ok error
-    		ct := 0
-    		for ;; {
-    			ct += 1
-				res, ok = netClient.Post(
-					posting_url,
-					"application/json; charset=utf-8",
-					to_send,
-				)
-				if ok != nil {
-					fmt.Println("Error:", ok)
-					if ct > 5 {
-						parsed <- nil
-						return
-					}
-					fmt.Println("retrying - attempt #" + strconv.Itoa(ct))
-					time.Sleep(200 * time.Millisecond)
-					continue
-				}
-				defer res.Body.Close()
-				break
-    		}
-    		var got moviesResponse
-    		json.NewDecoder(res.Body).Decode(&got)
-    		if got.V == nil {
-    			parsed <- nil
-    			return
-    		}
-    		got.V["sources"] = []ItemSource{}
-    		parsed <- got.V
+    		parsed <- lookupViaBalancer(imdb_id, load_balancer_addr)
     	} (imdb_id)
     }
 
@@ -470,8 +514,14 @@ const (
 	MovieSearchTextUrl = "/search/movie"
 	MovieWatchlistGetUrl = "/sync/watchlist/movie"
 	WatchlistAddUrl = "/sync/watchlist"
+	WatchlistRemoveUrl = "/sync/watchlist/remove"
 	HistoryGetUrl = "/sync/history"
 	HistoryAddUrl = "/sync/history"
+	HistoryRemoveUrl = "/sync/history/remove"
+	RatingsGetUrl = "/sync/ratings"
+	RatingsAddUrl = "/sync/ratings"
+	RatingsRemoveUrl = "/sync/ratings/remove"
+	ListsUrl = "/users/me/lists"
 	PlaybackGetUrl = "/sync/playback/movies"
 	ScrobbleStartUrl = "/scrobble/start"
 	ScrobblePauseUrl = "/scrobble/pause"
@@ -479,7 +529,9 @@ const (
 )
 
 func newTraktRequest(uri string) (*trakt.Request, error) {
-	req, err := traktClient.NewRequest(uri)
+	traktAuth.EnsureFresh()
+	traktLimiter.Wait("GET")
+	req, err := traktAuth.Client().NewRequest(uri)
 	if err != nil {
 		return nil, err
 	}
@@ -491,26 +543,27 @@ func traktPaginateUrl(url string, page, limit int) string {
 	return (url + "?page=" + strconv.Itoa(page) + "&limit=" + strconv.Itoa(limit))
 }
 
-func traktRequestGet(path string) (interface{}, error) {
-	url := configuration.TraktBaseUrl + path
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer " + configuration.TraktAccessToken)
-	req.Header.Set("trakt-api-version", "2")
-	req.Header.Set("trakt-api-key", configuration.TraktClientId)
-	res, err := netClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	res_bytes, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
+func traktItemObj(item_type string, item_id string) (map[string]interface{}, error) {
+	var key string
+	if item_type == "movie" {
+		key = "movies"
+	} else if item_type == "show" {
+		key = "shows"
+	} else {
+		return nil, errors.New("Unknown item type")
 	}
-	defer res.Body.Close()
+	return map[string]interface{}{
+		key: []map[string]interface{}{
+			{"ids": map[string]interface{}{
+				"imdb": item_id,
+			}},
+		},
+	}, nil
+}
 
-	var ret interface{}
-	json.Unmarshal(res_bytes, &ret)
-	return ret, nil
+func traktPostItem(base_url string, video_obj map[string]interface{}) (map[string]interface{}, error) {
+	/* Route all writes through the outbox so they survive Trakt outages */
+	return traktOutbox.Submit("POST", base_url, video_obj, "")
 }
 
 func mapToField(obj []map[string]interface{}, field string) ([]map[string]interface{}) {
@@ -667,61 +720,13 @@ func searchTraktMovies(keyword string, item_type string) ([]map[string]interface
 	return mapToField(tmp, "movie"), err
 }
 
-func getTraktWatchlist(item_type string) ([]map[string]interface{}, error) {
-	var tmp []map[string]interface{}
-
-	/* Execute Trakt.tv watchlist retrieval */
-	var base_url string
-	if item_type == "movie" {
-		base_url = MovieWatchlistGetUrl
-	} else {
-		return nil, errors.New("Unknown item type")
-	}
-	req, err := newTraktRequest(traktPaginateUrl(base_url, 1, 50000))
-	req.Get(&tmp)
-
-	return mapToField(tmp, "movie"), err
-}
-
+// cacheSources stores the results of searching every source for items.
 func cacheSources(sources map[string][]ItemSource) {
 	for imdb_id, sourceArr := range sources {
 		if sourceArr == nil {
 			continue;
 		}
-
-		/* Retrieve existing cached values, if applicable */
-		var existing []ItemSource
-		cached, ok := cache.Get([]byte(ITEM_KEY_ID + imdb_id))
-		if ok == nil && cached != nil {
-			buf := bytes.NewBuffer(cached)
-			dec := gob.NewDecoder(buf)
-			v := dec.Decode(&existing)
-			if v != nil {
-				panic(v)
-			}
-		}
-
-		/* Gracefully merge current and cached item sources */
-		merged := make(map[string]ItemSource)
-		for _, elem := range sourceArr {
-			merged[elem.Url] = elem
-		}
-		for _, elem := range existing {
-			if _, ok := merged[elem.Url]; ok {
-				continue;
-			}
-			merged[elem.Url] = elem
-		}
-
-		sourceArr = nil
-		for _, v := range merged {
-			sourceArr = append(sourceArr, v)
-		}
-		merged = nil
-
-		/* Save merged array to cache */
-		source_bytes, ok := GetBytes(sourceArr)
-		cache.Set([]byte(ITEM_KEY_ID + imdb_id), source_bytes, /*1 hour=*/1 * 60 * 60)
+		sourceCache.Store(imdb_id, sourceArr, true)
 	}
 }
 
@@ -774,6 +779,8 @@ func (movieData) SearchForItem(opts map[string]interface{}, load_balancer_addr s
 	for idx := 0; idx < len(output); idx += 1 {
 		cur_imdb_code, _ := output[idx]["imdb_code"].(string)
 		if have, ok := sources[cur_imdb_code]; ok {
+			have = SortAndFilterSources(have, opts)
+			annotateBitrates(output[idx], have)
 			output[idx]["sources"] = have
 		}
 	}
@@ -783,125 +790,302 @@ func (movieData) SearchForItem(opts map[string]interface{}, load_balancer_addr s
 }
 
 func (movieData) GetWatchlist(load_balancer_addr string) ([]string, error) {
-	var tmp []map[string]interface{}
-	var imdb_ids []string
-	var err error
+	/* Retrieve watchlist from local store */
+	watchStore.EnsureSynced()
+	return watchStore.GetWatchlist(), nil
+}
 
-	/* Retrieve movie watchlist */
-	for ct := 0;; ct += 1 {
-		tmp, err = getTraktWatchlist("movie")
-		if err != nil {
-			if ct > 5 {
-				return nil, err
-			}
-			fmt.Println("Retrying - error:", err)
-			continue
-		}
+func localWriteResult() map[string]interface{} {
+	return map[string]interface{}{
+		"result": true,
+		"local_only": true,
+	}
+}
+
+func (movieData) AddToWatchlist(item_type string, item_id string) (map[string]interface{}, error) {
+	video_obj, err := traktItemObj(item_type, item_id)
+	if err != nil {
+		return nil, err
+	}
 
-		/* Filter IMDB id's from result */
-		imdb_ids = filterTraktIds(tmp)
+	/* Record locally first */
+	entry, err := watchStore.AddToWatchlist(item_type, item_id)
+	if err != nil {
+		return nil, err
+	}
+	if !traktSyncEnabled() {
+		return localWriteResult(), nil
+	}
 
-		/* Resolve matches */
-		imdb_ids = deDup(imdb_ids)
+	/* Replicate Trakt.tv watchlist insertion */
+	res, err := traktPostItem(WatchlistAddUrl, video_obj)
+	if err == nil && outboxDelivered(res) {
+		watchStore.Update(func() {
+			entry.Synced = true
+		})
+	}
+	return res, err
+}
 
-		if len(imdb_ids) == 0 {
-			if ct > 5 {
-				return nil, errors.New("Gave up on Trakt watchlist retrieval")
-			}
-		} else {
-			break
+func (movieData) RemoveFromWatchlist(item_type string, item_id string) (map[string]interface{}, error) {
+	video_obj, err := traktItemObj(item_type, item_id)
+	if err != nil {
+		return nil, err
+	}
+
+	/* Record locally first */
+	entry, err := watchStore.RemoveFromWatchlist(item_type, item_id)
+	if err != nil {
+		return nil, err
+	}
+	if !traktSyncEnabled() {
+		return localWriteResult(), nil
+	}
+
+	/* Replicate Trakt.tv watchlist removal */
+	res, err := traktPostItem(WatchlistRemoveUrl, video_obj)
+	if err == nil && outboxDelivered(res) {
+		watchStore.Update(func() {
+			entry.Synced = true
+		})
+	}
+	return res, err
+}
+
+func (movieData) GetWatchHistory(load_balancer_addr string) ([]string, error) {
+	/* Retrieve history from local store */
+	watchStore.EnsureSynced()
+	ids := watchStore.GetHistory()
+	if ids == nil {
+		ids = make([]string, 0)
+	}
+	return ids, nil
+}
+
+func (movieData) AddWatchHistory(item_type string, item_id string) (map[string]interface{}, error) {
+	video_obj, err := traktItemObj(item_type, item_id)
+	if err != nil {
+		return nil, err
+	}
+
+	/* Record locally first */
+	event, err := watchStore.AddWatchEvent(item_type, item_id, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	if !traktSyncEnabled() {
+		return localWriteResult(), nil
+	}
+
+	/* Replicate Trakt.tv history insertion, stamped with the local watch time */
+	for _, arr := range video_obj {
+		for _, on := range arr.([]map[string]interface{}) {
+			on["watched_at"] = formatTraktTime(event.WatchedAt)
 		}
 	}
+	res, err := traktOutbox.Submit("POST", HistoryAddUrl, video_obj, historyWriteKey(event))
+	if err == nil && outboxDelivered(res) {
+		watchStore.Update(func() {
+			event.Synced = true
+		})
+	}
+	return res, err
+}
 
-	/* Return matches */
-	return imdb_ids, nil
+func (movieData) RemoveWatchHistory(item_type string, item_id string) (map[string]interface{}, error) {
+	video_obj, err := traktItemObj(item_type, item_id)
+	if err != nil {
+		return nil, err
+	}
+
+	/* Record locally first */
+	removed, err := watchStore.RemoveWatchEvents(item_id)
+	if err != nil {
+		return nil, err
+	}
+	if !traktSyncEnabled() {
+		return localWriteResult(), nil
+	}
+
+	/* Replicate Trakt.tv history removal (removes all plays of the item) */
+	res, err := traktPostItem(HistoryRemoveUrl, video_obj)
+	if err == nil && outboxDelivered(res) {
+		watchStore.Update(func() {
+			for _, on := range removed {
+				on.Synced = true
+			}
+		})
+	}
+	return res, err
 }
 
-func (movieData) AddToWatchlist(item_type string, item_id string) (map[string]interface{}, error) {
-	var tmp map[string]interface{}
-	var video_obj map[string]interface{}
+func (movieData) RateItem(item_type string, item_id string, rating int) (map[string]interface{}, error) {
+	if rating < 1 || rating > 10 {
+		return nil, errors.New("Rating must be between 1 and 10")
+	}
 
-	/* Execute Trakt.tv watchlist insertion */
-	base_url := WatchlistAddUrl
-	if item_type == "movie" {
-		video_obj = map[string]interface{}{
-			"movies": []map[string]interface{}{
-				{"ids": map[string]interface{}{
-					"imdb": item_id,
-				}},
-			},
+	/* Attach rating to item and execute Trakt.tv rating insertion */
+	video_obj, err := traktItemObj(item_type, item_id)
+	if err != nil {
+		return nil, err
+	}
+	for _, arr := range video_obj {
+		for _, on := range arr.([]map[string]interface{}) {
+			on["rating"] = rating
+			on["rated_at"] = time.Now().UTC().Format(time.RFC3339)
 		}
-	} else {
-		return nil, errors.New("Unknown item type")
 	}
-	req, err := newTraktRequest(base_url)
-	req.Post(video_obj, &tmp)
+	return traktPostItem(RatingsAddUrl, video_obj)
+}
 
-	return tmp, err
+func (movieData) UnrateItem(item_type string, item_id string) (map[string]interface{}, error) {
+	/* Execute Trakt.tv rating removal */
+	video_obj, err := traktItemObj(item_type, item_id)
+	if err != nil {
+		return nil, err
+	}
+	return traktPostItem(RatingsRemoveUrl, video_obj)
 }
 
-func (movieData) GetWatchHistory(load_balancer_addr string) ([]string, error) {
-	var tmp []map[string]interface{}
-	var imdb_ids []string
-	var ids []string
+func (movieData) GetRatings(item_type string) ([]map[string]interface{}, error) {
+	ret := make([]map[string]interface{}, 0)
 
-	/* Execute Trakt.tv history retrieval */
-	for ct := 0;; ct += 1 {
-		req, err := newTraktRequest(traktPaginateUrl(HistoryGetUrl, 1, 50000))
-		if err != nil {
-			if ct > 5 {
-				return nil, err
-			}
+	/* Execute Trakt.tv ratings retrieval */
+	if item_type != "movie" && item_type != "show" {
+		return nil, errors.New("Unknown item type")
+	}
+	res_arr, err := traktGetAll(RatingsGetUrl + "/" + item_type + "s")
+	if err != nil {
+		return nil, err
+	}
+
+	/* Flatten to IMDB id and rating */
+	for _, on := range res_arr {
+		item, ok := on[item_type].(map[string]interface{})
+		if !ok {
 			continue
 		}
-		req.Get(&tmp)
+		ids := filterTraktIds([]map[string]interface{}{item})
+		if len(ids) == 0 {
+			continue
+		}
+		ret = append(ret, map[string]interface{}{
+			"imdb_code": ids[0],
+			"rating": on["rating"],
+			"rated_at": on["rated_at"],
+		})
+	}
+	return ret, nil
+}
 
-		/* Filter for IMDB id's */
-		imdb_ids = append(imdb_ids, filterTraktIds(mapToField(tmp, "movie"))...)
-		imdb_ids = append(imdb_ids, filterTraktIds(mapToField(tmp, "show"))...)
+func traktListUrl(list_id string) string {
+	return ListsUrl + "/" + url.PathEscape(list_id)
+}
 
-		ids = deDup(imdb_ids)
+func (movieData) GetLists() ([]map[string]interface{}, error) {
+	ret := make([]map[string]interface{}, 0)
 
-		if len(ids) > 0 {
-			break
+	/* Execute Trakt.tv custom list retrieval */
+	res_arr, err := traktGetAll(ListsUrl)
+	if err != nil {
+		return nil, err
+	}
+	for _, on := range res_arr {
+		list_id := ""
+		if ids, ok := on["ids"].(map[string]interface{}); ok {
+			list_id, _ = ids["slug"].(string)
 		}
-		if ct > 5 {
-			return nil, errors.New("Gave up for Trakt history retrieval")
+		ret = append(ret, map[string]interface{}{
+			"id": list_id,
+			"name": on["name"],
+			"description": on["description"],
+			"privacy": on["privacy"],
+			"item_count": on["item_count"],
+			"updated_at": on["updated_at"],
+		})
+	}
+	return ret, nil
+}
+
+func traktListObj(opts map[string]interface{}) (map[string]interface{}) {
+	/* Only pass through fields Trakt.tv accepts for lists */
+	list_obj := make(map[string]interface{})
+	for _, key := range []string{"name", "description", "privacy", "display_numbers", "allow_comments", "sort_by", "sort_how"} {
+		if v, ok := opts[key]; ok {
+			list_obj[key] = v
 		}
 	}
+	return list_obj
+}
 
-	return ids, nil
+func (movieData) CreateList(opts map[string]interface{}) (map[string]interface{}, error) {
+	if name, ok := opts["name"].(string); !ok || len(name) == 0 {
+		return nil, errors.New("Parameter `name` is required")
+	}
+
+	/* Execute Trakt.tv custom list creation */
+	return traktOutbox.Submit("POST", ListsUrl, traktListObj(opts), "")
 }
 
-func (movieData) AddWatchHistory(item_type string, item_id string) (map[string]interface{}, error) {
-	var tmp map[string]interface{}
-	var video_obj map[string]interface{}
+func (movieData) UpdateList(list_id string, opts map[string]interface{}) (map[string]interface{}, error) {
+	/* Execute Trakt.tv custom list update; a pending update of the list is folded into it */
+	return traktOutbox.Submit("PUT", traktListUrl(list_id), traktListObj(opts), "list:" + list_id)
+}
 
-	/* Execute Trakt.tv history insertion */
-	var base_url string
-	if item_type == "movie" {
-		base_url = HistoryAddUrl
-		video_obj = map[string]interface{}{
-			"movies": []map[string]interface{}{
-				{"ids": map[string]interface{}{
-					"imdb": item_id,
-				}},
-			},
+func (movieData) DeleteList(list_id string) (map[string]interface{}, error) {
+	/* Execute Trakt.tv custom list deletion, dropping pending updates of the list */
+	res, err := traktOutbox.Submit("DELETE", traktListUrl(list_id), nil, "list:" + list_id)
+	if err != nil {
+		return nil, err
+	}
+	res["result"] = true
+	return res, nil
+}
+
+func (movieData) GetListItems(list_id string) ([]string, error) {
+	var imdb_ids []string
+
+	/* Execute Trakt.tv custom list item retrieval */
+	tmp, err := traktGetAll(traktListUrl(list_id) + "/items")
+	if err != nil {
+		return nil, err
+	}
+
+	/* Filter for IMDB id's */
+	for _, field := range []string{"movie", "show"} {
+		var items []map[string]interface{}
+		for _, on := range tmp {
+			if item, ok := on[field].(map[string]interface{}); ok {
+				items = append(items, item)
+			}
 		}
-	} else {
-		return nil, errors.New("Unknown item type")
+		imdb_ids = append(imdb_ids, filterTraktIds(items)...)
 	}
-	req, err := newTraktRequest(base_url)
-	req.Post(video_obj, &tmp)
+	return deDup(imdb_ids), nil
+}
 
-	return tmp, err
+func (movieData) AddToList(list_id string, item_type string, item_id string) (map[string]interface{}, error) {
+	/* Execute Trakt.tv custom list item insertion */
+	video_obj, err := traktItemObj(item_type, item_id)
+	if err != nil {
+		return nil, err
+	}
+	return traktPostItem(traktListUrl(list_id) + "/items", video_obj)
+}
+
+func (movieData) RemoveFromList(list_id string, item_type string, item_id string) (map[string]interface{}, error) {
+	/* Execute Trakt.tv custom list item removal */
+	video_obj, err := traktItemObj(item_type, item_id)
+	if err != nil {
+		return nil, err
+	}
+	return traktPostItem(traktListUrl(list_id) + "/items/remove", video_obj)
 }
 
 func (movieData) UpdateScrobbleStatus(imdb_code string, progress float64, state string) (map[string]interface{}, error) {
-	var tmp map[string]interface{}
 	var video_obj map[string]interface{}
 
-	/* Execute Trakt.tv history insertion */
+	/* Execute Trakt.tv scrobble update */
 	var base_url string
 	if state == "started" {
 		base_url = ScrobbleStartUrl
@@ -909,6 +1093,8 @@ func (movieData) UpdateScrobbleStatus(imdb_code string, progress float64, state
 		base_url = ScrobblePauseUrl
 	} else if state == "stopped" {
 		base_url = ScrobbleStopUrl
+	} else {
+		return nil, errors.New("Unknown scrobble state")
 	}
 	video_obj = map[string]interface{}{
 		"movie": map[string]interface{}{
@@ -918,19 +1104,47 @@ func (movieData) UpdateScrobbleStatus(imdb_code string, progress float64, state
 		},
 		"progress": progress,
 	}
-	for ct := 0;; ct += 1 {
-		req, err := newTraktRequest(base_url)
-		if err != nil {
-			return nil, err
-		}
-		req.Post(video_obj, &tmp)
-		if tmp != nil {
-			break
+
+	/* Record locally first; a finishing stop counts as a watch, as on Trakt.tv */
+	finished := state == "stopped" && progress >= 80
+	var err error
+	var event *WatchEvent
+	var position *PlaybackPosition
+	if finished {
+		event, err = watchStore.AddWatchEvent("movie", imdb_code, time.Now().Unix())
+	} else {
+		position, err = watchStore.SetPlayback("movie", imdb_code, progress)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !traktSyncEnabled() {
+		return localWriteResult(), nil
+	}
+
+	/* Pending scrobbles for the same item are superseded by newer ones, */
+	/* except a finishing stop, which records a watch and must be kept */
+	collapse_key := "scrobble:" + imdb_code
+	if finished {
+		collapse_key = historyWriteKey(event)
+	}
+	tmp, err := traktOutbox.Submit("POST", base_url, video_obj, collapse_key)
+	if err != nil {
+		return nil, err
+	}
+
+	/* Queued writes stay unsynced, so the next sync pushes them if they fail */
+	if !outboxDelivered(tmp) {
+		return tmp, nil
+	}
+	watchStore.Update(func() {
+		if event != nil {
+			event.Synced = true
 		}
-		if ct > 5 {
-			return nil, errors.New("Gave up for Trakt scrobble update")
+		if position != nil {
+			position.Synced = true
 		}
-	}
+	})
 	enc := json.NewEncoder(os.Stdout)
 	enc.Encode(tmp)
 
@@ -938,61 +1152,35 @@ func (movieData) UpdateScrobbleStatus(imdb_code string, progress float64, state
 }
 
 func (movieData) GetPlaybackScrobbles(load_balancer_addr string) ([]map[string]interface{}, error) {
-	tmp := make([]map[string]interface{}, 0)
-
-	/* Execute Trakt.tv history retrieval */
-	for ct := 0;; ct += 1 {
-		req, err := traktRequestGet(PlaybackGetUrl)
-		if err != nil {
-			if ct > 5 {
-				return nil, err
-			} else {
-				continue
-			}
-		}
-		tmp_arr := req.([]interface{})
-		for _, on := range tmp_arr {
-			tmp = append(tmp, on.(map[string]interface{}))
-		}
-
-		// enc := json.NewEncoder(os.Stdout)
-		// enc.Encode(tmp_arr)
-		break
-	}
-
-	return tmp, nil
+	/* Retrieve playback progress from local store */
+	watchStore.EnsureSynced()
+	return watchStore.GetPlayback(), nil
 }
 
-func (md movieData) GetItem(id string, load_balancer_addr string) (map[string]interface{}, error) {
+func (md movieData) GetItem(id string, refresh bool, load_balancer_addr string) (map[string]interface{}, error) {
 	// Look up by ID, fill in sources from cache, return
-	// If not cached, silently call SearchForItem and return item of specified ID
-	existing := make([]ItemSource, 0)
-	item_key := []byte(ITEM_KEY_ID + id)
-
-	/* Check if cached */
-	cached, ok := cache.Get(item_key)
-	if ok != nil || cached == nil {
-		/* If not cached, search for sources and return the item and its sources */
+	// If not cached or asked to refresh, call SearchForItem and return item of specified ID
+	// If cached but stale, return the cached sources and refresh them in the background
+	cached, stale, ok := sourceCache.Get(id)
+	if !ok || refresh {
 		outp, err := md.SearchForItem(map[string]interface{}{
 			"id": id,
 		}, load_balancer_addr)
 		if err != nil {
 			return nil, err
 		}
+		cached, stale, _ = sourceCache.Get(id)
 
 		for _, elem := range outp {
 			if elem["imdb_code"].(string) == id {
+				elem["sources_searched_at"] = cached.SearchedAt
+				elem["sources_stale"] = false
+				elem["sources_refreshing"] = false
 				return elem, nil
 			}
 		}
-	} else {
-		/* If cached, parse cache */
-		buf := bytes.NewBuffer(cached)
-		dec := gob.NewDecoder(buf)
-		v := dec.Decode(&existing)
-		if v != nil {
-			panic(v)
-		}
+	} else if stale {
+		sourceCache.Revalidate(id)
 	}
 
 	/* Resolve item */
@@ -1004,8 +1192,12 @@ func (md movieData) GetItem(id string, load_balancer_addr string) (map[string]in
 		return nil, errors.New(fmt.Sprintf("Expected 1 resolved, got %d", len(output)))
 	}
 
-	/* Fill in sources and return requested item */
-	output[0]["sources"] = existing
+	/* Fill in sources and how fresh they are, and return requested item */
+	annotateBitrates(output[0], cached.Sources)
+	output[0]["sources"] = cached.Sources
+	output[0]["sources_searched_at"] = cached.SearchedAt
+	output[0]["sources_stale"] = stale
+	output[0]["sources_refreshing"] = sourceCache.Refreshing(id)
 	return output[0], nil
 }
 
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CREDITS_FILENAME = "credits.json"
+	CREDITS_QUEUE_SIZE = 1000
+	CREDITS_SAVE_DELAY = 5 * time.Second /* batches the saves of items resolved together */
+)
+
+const (
+	ItemPeopleUrl = "/%s/%s/people" /* "movies" or "shows", then IMDB id */
+	PersonUrl = "/people/%s?extended=full"
+	PersonMoviesUrl = "/people/%s/movies"
+	PersonShowsUrl = "/people/%s/shows"
+	PersonSearchUrl = "/search/person?query=%s"
+)
+
+/* Trakt.tv crew departments mapped to the role we report */
+var crewDepartmentRoles = map[string]string{
+	"directing": "director",
+	"writing": "writer",
+	"production": "producer",
+	"sound": "composer",
+	"camera": "cinematographer",
+	"editing": "editor",
+}
+
+type PersonIds struct {
+	Trakt int64 `json:"trakt,omitempty"`
+	Slug string `json:"slug,omitempty"`
+	Imdb string `json:"imdb,omitempty"`
+	Tmdb int64 `json:"tmdb,omitempty"`
+}
+
+type Person struct {
+	Name string `json:"name"`
+	Role string `json:"role"` /* "actor", "director", "writer", etc. */
+	Character string `json:"character,omitempty"`
+	Job string `json:"job,omitempty"`
+	Ids PersonIds `json:"ids"`
+}
+
+type ItemCredits struct {
+	ImdbID string `json:"imdb_id"`
+	Title string `json:"title"`
+	ItemType string `json:"item_type"`
+	People []Person `json:"people"`
+	Source string `json:"source"` /* "omdb" until enriched from "trakt" */
+	Fetched int64 `json:"fetched"` /* unix timestamp in seconds */
+}
+
+type CreditsStore struct {
+	lock *sync.Mutex
+	items map[string]*ItemCredits
+	queue chan string
+	save_pending bool
+}
+
+var creditsStore = CreditsStore{
+	lock: &sync.Mutex{},
+	items: make(map[string]*ItemCredits),
+	queue: make(chan string, CREDITS_QUEUE_SIZE),
+}
+
+func (cs *CreditsStore) ReadFromDisk() {
+	content, err := ioutil.ReadFile(CREDITS_FILENAME)
+	if err != nil {
+		return
+	}
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if err = json.Unmarshal(content, &cs.items); err != nil {
+		fmt.Println("Could not parse credits:", err)
+	}
+	if cs.items == nil {
+		cs.items = make(map[string]*ItemCredits)
+	}
+}
+
+func (cs *CreditsStore) saveToDisk() (error) {
+	credits_json, err := json.Marshal(cs.items)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(CREDITS_FILENAME, credits_json)
+}
+
+func (cs *CreditsStore) store(credits *ItemCredits) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.items[credits.ImdbID] = credits
+
+	/* Items are often resolved in bulk, so save them together shortly after */
+	if cs.save_pending {
+		return
+	}
+	cs.save_pending = true
+	time.AfterFunc(CREDITS_SAVE_DELAY, func() {
+		cs.lock.Lock()
+		defer cs.lock.Unlock()
+		cs.save_pending = false
+		if err := cs.saveToDisk(); err != nil {
+			fmt.Println("Warning: could not save credits:", err)
+		}
+	})
+}
+
+func (cs *CreditsStore) Get(imdb_id string) (ItemCredits, bool) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	credits, ok := cs.items[imdb_id]
+	if !ok {
+		return ItemCredits{}, false
+	}
+	return *credits, true
+}
+
+func (cs *CreditsStore) People(imdb_id string) []Person {
+	credits, ok := cs.Get(imdb_id)
+	if !ok {
+		return []Person{}
+	}
+	return credits.People
+}
+
+var omdbCreditNoteRegex = regexp.MustCompile(`^(.*?)\s*\((.*)\)$`)
+
+func parseOmdbPeople(field string, role string) []Person {
+	ret := make([]Person, 0)
+	if len(field) == 0 || field == "N/A" {
+		return ret
+	}
+	for _, name := range strings.Split(field, ", ") {
+		/* Writers carry their credit in parentheses, e.g. "Jane Doe (screenplay)" */
+		person := Person{Name: strings.TrimSpace(name), Role: role}
+		if m := omdbCreditNoteRegex.FindStringSubmatch(person.Name); m != nil {
+			person.Name, person.Job = m[1], m[2]
+		}
+		ret = append(ret, person)
+	}
+	return ret
+}
+
+// RecordOmdb stores the people listed in an OMDb response, unless richer
+// Trakt.tv credits are already known, and queues the item for enrichment.
+// Nothing is done if the same people are already stored.
+func (cs *CreditsStore) RecordOmdb(imdb_id string, title string, body_json map[string]interface{}) {
+	existing, known := cs.Get(imdb_id)
+	if known && existing.Source == "trakt" {
+		return
+	}
+	director, _ := body_json["Director"].(string)
+	writer, _ := body_json["Writer"].(string)
+	actors, _ := body_json["Actors"].(string)
+	item_type := "movie"
+	if media_type, _ := body_json["Type"].(string); media_type == "series" {
+		item_type = "show"
+	}
+	people := parseOmdbPeople(director, "director")
+	people = append(people, parseOmdbPeople(writer, "writer")...)
+	people = append(people, parseOmdbPeople(actors, "actor")...)
+	if known && existing.Title == title && existing.ItemType == item_type && reflect.DeepEqual(existing.People, people) {
+		return
+	}
+	cs.store(&ItemCredits{
+		ImdbID: imdb_id,
+		Title: title,
+		ItemType: item_type,
+		People: people,
+		Source: "omdb",
+		Fetched: time.Now().Unix(),
+	})
+	cs.Enqueue(imdb_id)
+}
+
+func (cs *CreditsStore) Enqueue(imdb_id string) {
+	if len(configuration.TraktClientId) == 0 {
+		return
+	}
+	select {
+		case cs.queue <- imdb_id:
+		default:
+			/* Queue full, the item is picked up again the next time it resolves */
+	}
+}
+
+func parseTraktPersonIds(person map[string]interface{}) PersonIds {
+	ids, _ := person["ids"].(map[string]interface{})
+	trakt_id, _ := ids["trakt"].(float64)
+	tmdb_id, _ := ids["tmdb"].(float64)
+	slug, _ := ids["slug"].(string)
+	imdb, _ := ids["imdb"].(string)
+	return PersonIds{
+		Trakt: int64(trakt_id),
+		Slug: slug,
+		Imdb: imdb,
+		Tmdb: int64(tmdb_id),
+	}
+}
+
+func traktCharacter(on map[string]interface{}) string {
+	characters, _ := on["characters"].([]interface{})
+	var names []string
+	for _, c := range characters {
+		if name, ok := c.(string); ok && len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		return strings.Join(names, " / ")
+	}
+	character, _ := on["character"].(string)
+	return character
+}
+
+func traktJob(on map[string]interface{}) string {
+	jobs, _ := on["jobs"].([]interface{})
+	var names []string
+	for _, j := range jobs {
+		if name, ok := j.(string); ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		return strings.Join(names, ", ")
+	}
+	job, _ := on["job"].(string)
+	return job
+}
+
+func crewRole(department string) string {
+	if role, ok := crewDepartmentRoles[department]; ok {
+		return role
+	}
+	return department
+}
+
+func parseTraktPeople(res map[string]interface{}) []Person {
+	ret := make([]Person, 0)
+	cast, _ := res["cast"].([]interface{})
+	for _, on_v := range cast {
+		on, _ := on_v.(map[string]interface{})
+		person, _ := on["person"].(map[string]interface{})
+		name, _ := person["name"].(string)
+		ret = append(ret, Person{
+			Name: name,
+			Role: "actor",
+			Character: traktCharacter(on),
+			Ids: parseTraktPersonIds(person),
+		})
+	}
+
+	/* Keep department order stable so directors and writers come first */
+	crew, _ := res["crew"].(map[string]interface{})
+	var departments []string
+	for department := range crew {
+		departments = append(departments, department)
+	}
+	sort.Slice(departments, func(i, j int) bool {
+		_, known_i := crewDepartmentRoles[departments[i]]
+		_, known_j := crewDepartmentRoles[departments[j]]
+		if known_i != known_j {
+			return known_i
+		}
+		return departments[i] < departments[j]
+	})
+	var crew_people []Person
+	for _, department := range departments {
+		members, _ := crew[department].([]interface{})
+		for _, on_v := range members {
+			on, _ := on_v.(map[string]interface{})
+			person, _ := on["person"].(map[string]interface{})
+			name, _ := person["name"].(string)
+			crew_people = append(crew_people, Person{
+				Name: name,
+				Role: crewRole(department),
+				Job: traktJob(on),
+				Ids: parseTraktPersonIds(person),
+			})
+		}
+	}
+	return append(crew_people, ret...)
+}
+
+func (cs *CreditsStore) enrich(imdb_id string) (error) {
+	existing, ok := cs.Get(imdb_id)
+	if ok && existing.Source == "trakt" {
+		return nil
+	}
+	item_type := "movie"
+	if ok {
+		item_type = existing.ItemType
+	}
+	res, err := traktRequestGet(fmt.Sprintf(ItemPeopleUrl, item_type + "s", imdb_id))
+	if err != nil {
+		return err
+	}
+	res_map, ok := res.(map[string]interface{})
+	if !ok {
+		return errors.New("Unexpected Trakt people response")
+	}
+	cs.store(&ItemCredits{
+		ImdbID: imdb_id,
+		Title: existing.Title,
+		ItemType: item_type,
+		People: parseTraktPeople(res_map),
+		Source: "trakt",
+		Fetched: time.Now().Unix(),
+	})
+	return nil
+}
+
+func (cs *CreditsStore) RunEnrichment() {
+	for imdb_id := range cs.queue {
+		if err := cs.enrich(imdb_id); err != nil {
+			fmt.Println("Warning: could not fetch credits for", imdb_id, err)
+		}
+	}
+}
+
+// IndexCatalog makes sure every item in the library, watchlist and history
+// has credits, so that people can be searched across all of them.
+func (cs *CreditsStore) IndexCatalog() {
+	movieWorker := movieData{}
+	for _, imdb_id := range catalogIds() {
+		if _, ok := cs.Get(imdb_id); ok {
+			continue
+		}
+		if _, err := movieWorker.ResolveImdb(imdb_id); err != nil {
+			fmt.Println("Warning: could not index credits for", imdb_id, err)
+		}
+	}
+}
+
+func catalogIds() []string {
+	var ids []string
+	ids = append(ids, downloadPool.GetAssociatedDownloads()...)
+	ids = append(ids, watchStore.GetWatchlist()...)
+	ids = append(ids, watchStore.GetHistory()...)
+	return deDup(ids)
+}
+
+func idSet(ids []string) map[string]bool {
+	ret := make(map[string]bool)
+	for _, id := range ids {
+		ret[id] = true
+	}
+	return ret
+}
+
+func personMatches(person Person, query string) bool {
+	if len(query) == 0 {
+		return false
+	}
+	if query == person.Ids.Slug || query == person.Ids.Imdb || query == strconv.FormatInt(person.Ids.Trakt, 10) {
+		return true
+	}
+	return strings.Contains(strings.ToLower(person.Name), strings.ToLower(query))
+}
+
+// SearchByPerson finds catalog items crediting a person (matched by name or
+// any id), optionally limited to a role and to the library or watchlist.
+func (cs *CreditsStore) SearchByPerson(query string, role string, scope string) []map[string]interface{} {
+	library := idSet(downloadPool.GetAssociatedDownloads())
+	watchlist := idSet(watchStore.GetWatchlist())
+	watched := idSet(watchStore.GetHistory())
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	ret := make([]map[string]interface{}, 0)
+	for imdb_id, credits := range cs.items {
+		if (scope == "library" && !library[imdb_id]) || (scope == "watchlist" && !watchlist[imdb_id]) {
+			continue
+		}
+		var credited []Person
+		for _, person := range credits.People {
+			if (len(role) == 0 || person.Role == role) && personMatches(person, query) {
+				credited = append(credited, person)
+			}
+		}
+		if len(credited) == 0 {
+			continue
+		}
+		ret = append(ret, map[string]interface{}{
+			"imdb_id": imdb_id,
+			"title": credits.Title,
+			"item_type": credits.ItemType,
+			"credits": credited,
+			"in_library": library[imdb_id],
+			"on_watchlist": watchlist[imdb_id],
+			"watched": watched[imdb_id],
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i]["title"].(string) < ret[j]["title"].(string)
+	})
+	return ret
+}
+
+func findTraktPerson(name string) (string, error) {
+	res, err := traktRequestGet(fmt.Sprintf(PersonSearchUrl, url.QueryEscape(name)))
+	if err != nil {
+		return "", err
+	}
+	results, _ := res.([]interface{})
+	for _, on_v := range results {
+		on, _ := on_v.(map[string]interface{})
+		person, _ := on["person"].(map[string]interface{})
+		if ids := parseTraktPersonIds(person); len(ids.Slug) > 0 {
+			return ids.Slug, nil
+		}
+	}
+	return "", errors.New("No person found with that name")
+}
+
+func appendFilmography(ret []map[string]interface{}, credits map[string]interface{}, field string, library, watchlist, watched map[string]bool) []map[string]interface{} {
+	add := func(on map[string]interface{}, role string, character string, job string) {
+		item, _ := on[field].(map[string]interface{})
+		ids := filterTraktIds([]map[string]interface{}{item})
+		if len(ids) == 0 {
+			return
+		}
+		title, _ := item["title"].(string)
+		year, _ := item["year"].(float64)
+		ret = append(ret, map[string]interface{}{
+			"imdb_id": ids[0],
+			"title": title,
+			"year": int(year),
+			"item_type": field,
+			"role": role,
+			"character": character,
+			"job": job,
+			"in_library": library[ids[0]],
+			"on_watchlist": watchlist[ids[0]],
+			"watched": watched[ids[0]],
+		})
+	}
+	cast, _ := credits["cast"].([]interface{})
+	for _, on_v := range cast {
+		on, _ := on_v.(map[string]interface{})
+		add(on, "actor", traktCharacter(on), "")
+	}
+	crew, _ := credits["crew"].(map[string]interface{})
+	for department, members_v := range crew {
+		members, _ := members_v.([]interface{})
+		for _, on_v := range members {
+			on, _ := on_v.(map[string]interface{})
+			add(on, crewRole(department), "", traktJob(on))
+		}
+	}
+	return ret
+}
+
+// LookupPerson returns a person's details and filmography, with each credit
+// flagged by whether it is in the library, on the watchlist or watched.
+func LookupPerson(person_id string, name string) (map[string]interface{}, error) {
+	if len(person_id) == 0 {
+		if len(name) == 0 {
+			return nil, errors.New("Parameter `id` or `name` is required")
+		}
+		var err error
+		if person_id, err = findTraktPerson(name); err != nil {
+			return nil, err
+		}
+	}
+
+	person, err := traktRequestGet(fmt.Sprintf(PersonUrl, url.PathEscape(person_id)))
+	if err != nil {
+		return nil, err
+	}
+	library := idSet(downloadPool.GetAssociatedDownloads())
+	watchlist := idSet(watchStore.GetWatchlist())
+	watched := idSet(watchStore.GetHistory())
+	filmography := make([]map[string]interface{}, 0)
+	for field, path := range map[string]string{"movie": PersonMoviesUrl, "show": PersonShowsUrl} {
+		credits, err := traktRequestGet(fmt.Sprintf(path, url.PathEscape(person_id)))
+		if err != nil {
+			return nil, err
+		}
+		credits_map, _ := credits.(map[string]interface{})
+		filmography = appendFilmography(filmography, credits_map, field, library, watchlist, watched)
+	}
+
+	/* Newest first, and collect the intersections for convenience */
+	sort.SliceStable(filmography, func(i, j int) bool {
+		return filmography[i]["year"].(int) > filmography[j]["year"].(int)
+	})
+	var in_library, on_watchlist []string
+	for _, on := range filmography {
+		if on["in_library"].(bool) {
+			in_library = append(in_library, on["imdb_id"].(string))
+		}
+		if on["on_watchlist"].(bool) {
+			on_watchlist = append(on_watchlist, on["imdb_id"].(string))
+		}
+	}
+	return map[string]interface{}{
+		"person": person,
+		"filmography": filmography,
+		"in_library": deDup(in_library),
+		"on_watchlist": deDup(on_watchlist),
+	}, nil
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	POSTER_CACHE_DIR = "posters"
+	POSTER_INDEX_FILENAME = "index.json"
+	POSTER_MAX_AGE = 30 * 24 * 60 * 60 /* seconds browsers may reuse a poster */
+	POSTER_JPEG_QUALITY = 85
+	MAX_POSTER_BYTES = 10 * 1024 * 1024
+)
+
+/* Widths of resized variants; "full" serves the original bytes */
+var posterSizes = map[string]int{
+	"thumb": 92,
+	"grid": 300,
+	"full": 0,
+}
+
+type PosterEntry struct {
+	SourceUrl string `json:"source_url"`
+	Hash string `json:"hash,omitempty"` /* sha256 of the original image, empty until fetched */
+	ContentType string `json:"content_type,omitempty"`
+	Fetched int64 `json:"fetched,omitempty"` /* unix timestamp in seconds */
+}
+
+type PosterCache struct {
+	lock *sync.Mutex
+	entries map[string]*PosterEntry /* keyed by IMDB id */
+	fetching map[string]*sync.WaitGroup
+}
+
+var posterCache = PosterCache{
+	lock: &sync.Mutex{},
+	entries: make(map[string]*PosterEntry),
+	fetching: make(map[string]*sync.WaitGroup),
+}
+
+func posterCacheDir() string {
+	if len(configuration.PosterCacheDir) > 0 {
+		return configuration.PosterCacheDir
+	}
+	return POSTER_CACHE_DIR
+}
+
+func (pc *PosterCache) ReadFromDisk() {
+	if err := os.MkdirAll(posterCacheDir(), 0755); err != nil {
+		fmt.Println("Could not create poster cache directory:", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(posterCacheDir(), POSTER_INDEX_FILENAME))
+	if err != nil {
+		return
+	}
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if err = json.Unmarshal(content, &pc.entries); err != nil {
+		fmt.Println("Could not parse poster index:", err)
+	}
+	if pc.entries == nil {
+		pc.entries = make(map[string]*PosterEntry)
+	}
+}
+
+func (pc *PosterCache) saveToDisk() (error) {
+	index_json, err := json.Marshal(pc.entries)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(posterCacheDir(), POSTER_INDEX_FILENAME), index_json)
+}
+
+func writeFileAtomic(path string, data []byte) (error) {
+	/* Write beside the target and rename so readers never see partial files; */
+	/* each writer gets its own temporary file so concurrent writes cannot mix */
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "." + filepath.Base(path) + ".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if close_err := tmp.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func isPosterUrl(source_url string) bool {
+	return strings.HasPrefix(source_url, "http://") || strings.HasPrefix(source_url, "https://")
+}
+
+// Register records where the poster for an item comes from, forgetting any
+// stored image if the upstream URL has changed.
+func (pc *PosterCache) Register(imdb_id string, source_url string) {
+	if !isPosterUrl(source_url) {
+		return
+	}
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if entry, ok := pc.entries[imdb_id]; ok && entry.SourceUrl == source_url {
+		return
+	}
+	pc.entries[imdb_id] = &PosterEntry{SourceUrl: source_url}
+	if err := pc.saveToDisk(); err != nil {
+		fmt.Println("Warning: could not save poster index:", err)
+	}
+}
+
+func (pc *PosterCache) entry(imdb_id string) (PosterEntry, bool) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	entry, ok := pc.entries[imdb_id]
+	if !ok {
+		return PosterEntry{}, false
+	}
+	return *entry, true
+}
+
+func posterOriginalPath(hash string) string {
+	return filepath.Join(posterCacheDir(), hash)
+}
+
+func posterVariantPath(hash string, size string) string {
+	return filepath.Join(posterCacheDir(), hash + "-" + size + ".jpg")
+}
+
+func (pc *PosterCache) fetch(imdb_id string, source_url string) (error) {
+	/* Only one download per item at a time; others wait for its result */
+	pc.lock.Lock()
+	if wg, ok := pc.fetching[imdb_id]; ok {
+		pc.lock.Unlock()
+		wg.Wait()
+		return nil
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	pc.fetching[imdb_id] = wg
+	pc.lock.Unlock()
+	defer func() {
+		pc.lock.Lock()
+		delete(pc.fetching, imdb_id)
+		pc.lock.Unlock()
+		wg.Done()
+	}()
+
+	/* Download original */
+	resp, err := netClient.Get(source_url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return errors.New(fmt.Sprintf("Poster download failed with status %d", resp.StatusCode))
+	}
+	img_bytes, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_POSTER_BYTES + 1))
+	if err != nil {
+		return err
+	}
+	if len(img_bytes) > MAX_POSTER_BYTES {
+		return errors.New(fmt.Sprintf("Poster is larger than %s", BytesToSize(MAX_POSTER_BYTES)))
+	}
+	content_type := http.DetectContentType(img_bytes)
+	if !strings.HasPrefix(content_type, "image/") {
+		return errors.New("Poster URL did not return an image")
+	}
+
+	/* Store content-addressed, so identical art is only kept once */
+	sum := sha256.Sum256(img_bytes)
+	hash := hex.EncodeToString(sum[:])
+	if _, err = os.Stat(posterOriginalPath(hash)); os.IsNotExist(err) {
+		if err = writeFileAtomic(posterOriginalPath(hash), img_bytes); err != nil {
+			return err
+		}
+	}
+
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	pc.entries[imdb_id] = &PosterEntry{
+		SourceUrl: source_url,
+		Hash: hash,
+		ContentType: content_type,
+		Fetched: time.Now().Unix(),
+	}
+	return pc.saveToDisk()
+}
+
+// Lookup returns the stored poster for an item, resolving and downloading it
+// on first use.
+func (pc *PosterCache) Lookup(imdb_id string) (PosterEntry, error) {
+	entry, ok := pc.entry(imdb_id)
+	if !ok {
+		/* First request for this item, so find its upstream poster */
+		resolved, err := movieData{}.ResolveImdb(imdb_id)
+		if err != nil {
+			return PosterEntry{}, err
+		}
+		source_url, _ := resolved["cover_image"].(string)
+		pc.Register(imdb_id, source_url)
+		if entry, ok = pc.entry(imdb_id); !ok {
+			return PosterEntry{}, errors.New("No poster available")
+		}
+	}
+	if len(entry.Hash) > 0 {
+		if _, err := os.Stat(posterOriginalPath(entry.Hash)); err == nil {
+			return entry, nil
+		}
+	}
+	if err := pc.fetch(imdb_id, entry.SourceUrl); err != nil {
+		return PosterEntry{}, err
+	}
+	if entry, ok = pc.entry(imdb_id); !ok || len(entry.Hash) == 0 {
+		return PosterEntry{}, errors.New("No poster available")
+	}
+	return entry, nil
+}
+
+// resizeImage downscales to the given width by averaging each source pixel
+// block, which looks far better than nearest-neighbour for poster art.
+func resizeImage(src image.Image, width int) image.Image {
+	bounds := src.Bounds()
+	src_w, src_h := bounds.Dx(), bounds.Dy()
+	if width <= 0 || width >= src_w {
+		return src
+	}
+	height := src_h * width / src_w
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y * src_h / height
+		y1 := bounds.Min.Y + (y + 1) * src_h / height
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x * src_w / width
+			x1 := bounds.Min.X + (x + 1) * src_w / width
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r + uint64(cr), g + uint64(cg), b + uint64(cb), a + uint64(ca)
+					count += 1
+				}
+			}
+			if count == 0 {
+				continue
+			}
+			off := dst.PixOffset(x, y)
+			dst.Pix[off + 0] = uint8(r / count >> 8)
+			dst.Pix[off + 1] = uint8(g / count >> 8)
+			dst.Pix[off + 2] = uint8(b / count >> 8)
+			dst.Pix[off + 3] = uint8(a / count >> 8)
+		}
+	}
+	return dst
+}
+
+func (pc *PosterCache) variant(entry PosterEntry, size string) ([]byte, string, error) {
+	width := posterSizes[size]
+	if width == 0 {
+		img_bytes, err := ioutil.ReadFile(posterOriginalPath(entry.Hash))
+		return img_bytes, entry.ContentType, err
+	}
+
+	/* Variants are derived from the hash, so a stored one is always current */
+	variant_path := posterVariantPath(entry.Hash, size)
+	if img_bytes, err := ioutil.ReadFile(variant_path); err == nil {
+		return img_bytes, "image/jpeg", nil
+	}
+	original, err := os.Open(posterOriginalPath(entry.Hash))
+	if err != nil {
+		return nil, "", err
+	}
+	defer original.Close()
+	src, _, err := image.Decode(original)
+	if err != nil {
+		return nil, "", err
+	}
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, resizeImage(src, width), &jpeg.Options{Quality: POSTER_JPEG_QUALITY}); err != nil {
+		return nil, "", err
+	}
+	if err = writeFileAtomic(variant_path, buf.Bytes()); err != nil {
+		fmt.Println("Warning: could not store poster variant:", err)
+	}
+	return buf.Bytes(), "image/jpeg", nil
+}
+
+func posterUrl(imdb_id string, size string) string {
+	return fmt.Sprintf("/poster?id=%s&size=%s", url.QueryEscape(imdb_id), size)
+}
+
+// rewriteCoverImage points an item's poster fields at the local image
+// endpoint, keeping the upstream URL in `cover_image_source`.
+func rewriteCoverImage(imdb_id string, item map[string]interface{}) {
+	source_url, _ := item["cover_image"].(string)
+	if !isPosterUrl(source_url) {
+		return
+	}
+	posterCache.Register(imdb_id, source_url)
+	item["cover_image_source"] = source_url
+	item["cover_image"] = posterUrl(imdb_id, "grid")
+	item["cover_images"] = map[string]interface{}{
+		"thumb": posterUrl(imdb_id, "thumb"),
+		"grid": posterUrl(imdb_id, "grid"),
+		"full": posterUrl(imdb_id, "full"),
+	}
+}
+
+func posterHandler(w http.ResponseWriter, r *http.Request) {
+	imdb_id := r.URL.Query().Get("id")
+	size := r.URL.Query().Get("size")
+	if len(size) == 0 {
+		size = "grid"
+	}
+	if _, ok := posterSizes[size]; !ok || len(imdb_id) == 0 {
+		http.Error(w, "Parameters `id` and a valid `size` are required", http.StatusBadRequest)
+		return
+	}
+
+	entry, err := posterCache.Lookup(imdb_id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	/* The content hash identifies the bytes, so it makes a strong validator */
+	etag := fmt.Sprintf("\"%s-%s\"", entry.Hash[:16], size)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, public", POSTER_MAX_AGE))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	img_bytes, content_type, err := posterCache.variant(entry, size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", content_type)
+	w.Write(img_bytes)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// QualityProfile describes which sources are acceptable for an item and
+// which of them to prefer, as configured under "quality_profiles".
+type QualityProfile struct {
+	Name string `json:"name"`
+	Preferred []string `json:"preferred"` // qualities, best first
+	Allowed []string `json:"allowed"` // accepted qualities, any when empty
+	MinGBPerHour float64 `json:"min_gb_per_hour"` // size bounds per hour of runtime, 0 for none
+	MaxGBPerHour float64 `json:"max_gb_per_hour"`
+	MinSeeds int `json:"min_seeds"` // minimum SourceCount
+	PreferredGroups []string `json:"preferred_groups"`
+	BlockedGroups []string `json:"blocked_groups"`
+	PreferredCodecs []string `json:"preferred_codecs"` // best first
+}
+
+/* Used when no profiles are configured */
+var defaultQualityProfile = QualityProfile{
+	Name: "default",
+	Preferred: []string{"1080p", "2160p", "720p", "HD"},
+	MinSeeds: 1,
+	PreferredCodecs: []string{"x264", "x265"},
+}
+
+type ScoredSource struct {
+	Source ItemSource `json:"source"`
+	Score float64 `json:"score"`
+	Reasons []string `json:"reasons"` // how the score was reached
+	Rejected string `json:"rejected,omitempty"` // why the profile rules it out, if it does
+}
+
+type SourceSelection struct {
+	Profile string `json:"profile"`
+	Best *ScoredSource `json:"best"` // nil if nothing is acceptable
+	Candidates []ScoredSource `json:"candidates"` // best first, rejected last
+}
+
+func GetQualityProfiles() []QualityProfile {
+	if len(configuration.QualityProfiles) == 0 {
+		return []QualityProfile{defaultQualityProfile}
+	}
+	return configuration.QualityProfiles
+}
+
+// FindQualityProfile looks up a profile by name, or the configured default
+// profile when the name is empty.
+func FindQualityProfile(name string) (QualityProfile, error) {
+	if len(name) == 0 {
+		name = configuration.DefaultQualityProfile
+	}
+	profiles := GetQualityProfiles()
+	if len(name) == 0 {
+		return profiles[0], nil
+	}
+	for _, profile := range profiles {
+		if profile.Name == name {
+			return profile, nil
+		}
+	}
+	return QualityProfile{}, errors.New(fmt.Sprintf("No quality profile named \"%s\"", name))
+}
+
+func indexFold(list []string, value string) int {
+	for idx, elem := range list {
+		if len(value) > 0 && strings.EqualFold(elem, value) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// Score rates a single source against the profile. runtime_minutes is used
+// for the size bounds and may be 0 if unknown.
+func (profile QualityProfile) Score(on ItemSource, runtime_minutes int) ScoredSource {
+	scored := ScoredSource{Source: on, Reasons: make([]string, 0)}
+	reject := func(reason string) ScoredSource {
+		scored.Rejected = reason
+		return scored
+	}
+
+	/* Hard requirements */
+	if annotateInspection(&on); on.Blocked {
+		scored.Source = on
+		return reject(fmt.Sprintf("inspection found %s", strings.Join(on.Flags, ", ")))
+	}
+	if len(profile.Allowed) > 0 && indexFold(profile.Allowed, on.Quality) < 0 && indexFold(profile.Preferred, on.Quality) < 0 {
+		return reject(fmt.Sprintf("quality %s is not allowed", on.Quality))
+	}
+	if on.SourceCount < profile.MinSeeds {
+		return reject(fmt.Sprintf("%d seeds is below the minimum of %d", on.SourceCount, profile.MinSeeds))
+	}
+	if indexFold(profile.BlockedGroups, on.Release.Group) >= 0 {
+		return reject(fmt.Sprintf("group %s is blocked", on.Release.Group))
+	}
+	if runtime_minutes > 0 && on.SizeBytes > 0 {
+		gb_per_hour := float64(on.SizeBytes) / 1e9 / (float64(runtime_minutes) / 60.0)
+		if profile.MinGBPerHour > 0 && gb_per_hour < profile.MinGBPerHour {
+			return reject(fmt.Sprintf("%.2f GB per hour is below %.2f", gb_per_hour, profile.MinGBPerHour))
+		}
+		if profile.MaxGBPerHour > 0 && gb_per_hour > profile.MaxGBPerHour {
+			return reject(fmt.Sprintf("%.2f GB per hour is above %.2f", gb_per_hour, profile.MaxGBPerHour))
+		}
+	}
+
+	/* Preferences; quality outweighs everything else */
+	add := func(points float64, reason string) {
+		scored.Score += points
+		scored.Reasons = append(scored.Reasons, fmt.Sprintf("%s (%+.0f)", reason, points))
+	}
+	if idx := indexFold(profile.Preferred, on.Quality); idx >= 0 {
+		add(float64(len(profile.Preferred) - idx) * 100, fmt.Sprintf("%s is preferred quality #%d", on.Quality, idx + 1))
+	}
+	if idx := indexFold(profile.PreferredCodecs, on.Release.Codec); idx >= 0 {
+		add(float64(len(profile.PreferredCodecs) - idx) * 10, fmt.Sprintf("codec %s is preferred #%d", on.Release.Codec, idx + 1))
+	}
+	if indexFold(profile.PreferredGroups, on.Release.Group) >= 0 {
+		add(50, fmt.Sprintf("group %s is preferred", on.Release.Group))
+	}
+	if on.SourceCount > 0 {
+		add(math.Round(20 * math.Log10(float64(on.SourceCount + 1))), fmt.Sprintf("%d seeds", on.SourceCount))
+	}
+	return scored
+}
+
+// SelectBestSource scores every source against the profile and picks the
+// best acceptable one, keeping the reasoning for each candidate.
+func SelectBestSource(sources []ItemSource, runtime_minutes int, profile QualityProfile) SourceSelection {
+	selection := SourceSelection{Profile: profile.Name, Candidates: make([]ScoredSource, 0, len(sources))}
+	for _, on := range sources {
+		selection.Candidates = append(selection.Candidates, profile.Score(on, runtime_minutes))
+	}
+	sort.SliceStable(selection.Candidates, func(i, j int) bool {
+		a, b := selection.Candidates[i], selection.Candidates[j]
+		if (a.Rejected == "") != (b.Rejected == "") {
+			return a.Rejected == ""
+		}
+		return a.Score > b.Score
+	})
+	if len(selection.Candidates) > 0 && selection.Candidates[0].Rejected == "" {
+		selection.Best = &selection.Candidates[0]
+	}
+	return selection
+}
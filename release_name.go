@@ -0,0 +1,259 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/* Episode number used for whole-season releases, as SourceA reports them; anything at or above 10000 is shown as a season */
+const FULL_SEASON_EPISODE = 1000000
+
+// ReleaseInfo is everything a scene-style release name says about a file.
+type ReleaseInfo struct {
+	Title string `json:"title,omitempty"` // name before the first tag
+	Year int `json:"year,omitempty"`
+	Resolution string `json:"resolution,omitempty"` // 2160p, 1080p, 720p, 480p
+	Source string `json:"source,omitempty"` // BluRay, Remux, WEB-DL, WEBRip, HDTV, DVD, CAM, ...
+	Codec string `json:"codec,omitempty"` // x264, x265, XviD, AV1, ...
+	HDR string `json:"hdr,omitempty"` // HDR10, HDR10+, Dolby Vision, HLG
+	Audio string `json:"audio,omitempty"` // AAC, DD, DD+, DTS, DTS-HD, TrueHD, Atmos, ...
+	AudioChannels string `json:"audio_channels,omitempty"` // 2.0, 5.1, 7.1
+	Group string `json:"group,omitempty"` // release group
+	Edition string `json:"edition,omitempty"` // Extended, Director's Cut, IMAX, ...
+	ThreeD bool `json:"3d,omitempty"`
+	TV *ItemSourceTV `json:"tv,omitempty"`
+}
+
+type releaseRule struct {
+	pattern *regexp.Regexp
+	value string
+}
+
+/* Tags have to stand alone, except audio codecs which are often glued to their channel count (DD5.1) */
+func releaseRules(suffix string, rules [][2]string) []releaseRule {
+	ret := make([]releaseRule, 0, len(rules))
+	for _, rule := range rules {
+		ret = append(ret, releaseRule{
+			pattern: regexp.MustCompile(`(?i)(?:^|[^a-z0-9])(?:` + rule[0] + `)` + suffix),
+			value: rule[1],
+		})
+	}
+	return ret
+}
+
+/* Rules are tried in order and the first match wins, so more specific tags come first */
+var (
+	releaseResolutions = releaseRules(`(?:$|[^a-z0-9])`, [][2]string{
+		{`2160p?|4k|uhd`, "2160p"},
+		{`1080[pi]?`, "1080p"},
+		{`720p?`, "720p"},
+		{`576p|480p|360p`, "480p"},
+	})
+	releaseSources = releaseRules(`(?:$|[^a-z0-9])`, [][2]string{
+		{`bd-?remux|remux`, "Remux"},
+		{`blu-?ray|bdrip|brrip|bd25|bd50`, "BluRay"},
+		{`web-?dl|webdl`, "WEB-DL"},
+		{`web-?rip`, "WEBRip"},
+		{`web`, "WEB"},
+		{`hdrip`, "HDRip"},
+		{`hdtv|pdtv|tvrip`, "HDTV"},
+		{`dvd-?scr|screener|scr`, "Screener"},
+		{`dvd-?rip|dvd-?r|dvd[59]?`, "DVD"},
+		{`hd-?cam|cam-?rip|cam`, "CAM"},
+		{`hd-?ts|telesync|ts`, "TS"},
+		{`telecine|hd-?tc|tc`, "TC"},
+	})
+	releaseCodecs = releaseRules(`(?:$|[^a-z0-9])`, [][2]string{
+		{`[xh]\.?265|hevc`, "x265"},
+		{`[xh]\.?264|avc`, "x264"},
+		{`xvid`, "XviD"},
+		{`divx`, "DivX"},
+		{`av1`, "AV1"},
+		{`vp9`, "VP9"},
+		{`mpeg-?2`, "MPEG-2"},
+	})
+	releaseHdrFormats = releaseRules(`(?:$|[^a-z0-9])`, [][2]string{
+		{`dolby[ .]?vision|dovi|dv`, "Dolby Vision"},
+		{`hdr10\+|hdr10plus`, "HDR10+"},
+		{`hdr10`, "HDR10"},
+		{`hdr`, "HDR"},
+		{`hlg`, "HLG"},
+	})
+	releaseAudio = releaseRules(`(?:$|[^a-z])`, [][2]string{
+		{`atmos`, "Atmos"},
+		{`true-?hd`, "TrueHD"},
+		{`dts-?hd(?:[ .-]?ma)?|dts-?ma`, "DTS-HD"},
+		{`dts-?x`, "DTS:X"},
+		{`dts`, "DTS"},
+		{`ddp|dd\+|e-?ac-?3`, "DD+"},
+		{`dd|ac-?3`, "DD"},
+		{`aac`, "AAC"},
+		{`flac`, "FLAC"},
+		{`opus`, "Opus"},
+		{`mp3`, "MP3"},
+	})
+	releaseEditions = releaseRules(`(?:$|[^a-z0-9])`, [][2]string{
+		{`director'?s[ .]?cut`, "Director's Cut"},
+		{`final[ .]cut`, "Final Cut"},
+		{`extended(?:[ .](?:cut|edition))?`, "Extended"},
+		{`unrated`, "Unrated"},
+		{`uncut`, "Uncut"},
+		{`theatrical(?:[ .]cut)?`, "Theatrical"},
+		{`imax`, "IMAX"},
+		{`criterion`, "Criterion"},
+		{`remastered`, "Remastered"},
+		{`special[ .]edition`, "Special Edition"},
+		{`ultimate[ .]edition`, "Ultimate Edition"},
+		{`open[ .]matte`, "Open Matte"},
+	})
+	release3D = releaseRules(`(?:$|[^a-z0-9])`, [][2]string{
+		{`3d|h-?sbs|h-?ou|half-?sbs`, "3D"},
+	})
+
+	releaseChannelsPattern = regexp.MustCompile(`(?i)(?:^|[^0-9])([12567])[. ]([01])(?:ch)?(?:$|[^0-9])`)
+	releaseChannelCountPattern = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])([268])ch(?:$|[^a-z0-9])`)
+	releaseEpisodePattern = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])s(\d{1,2})[ .]?e(\d{1,3})(?:$|[^0-9])`)
+	releaseCrossEpisodePattern = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])(\d{1,2})x(\d{2,3})(?:$|[^a-z0-9])`)
+	releaseSeasonPattern = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])(?:s|season[ .]?)(\d{1,2})(?:$|[^a-z0-9])`)
+	releaseYearPattern = regexp.MustCompile(`(?:^|[^0-9])((?:19|20)\d\d)(?:$|[^0-9])`)
+	releaseGroupPattern = regexp.MustCompile(`-([A-Za-z0-9]+)$`)
+	releaseLeadingGroupPattern = regexp.MustCompile(`^\[([^\]]+)\]`)
+	releaseTrailingTagPattern = regexp.MustCompile(`\s*[\[(][^\])]*[\])]$`)
+	releaseVideoExtensions = map[string]bool{
+		".mkv": true, ".mp4": true, ".avi": true, ".m4v": true, ".mov": true, ".wmv": true, ".ts": true, ".torrent": true,
+	}
+)
+
+func matchReleaseRule(name string, rules []releaseRule) (string, int) {
+	for _, rule := range rules {
+		if loc := rule.pattern.FindStringIndex(name); loc != nil {
+			return rule.value, loc[0]
+		}
+	}
+	return "", -1
+}
+
+// ParseReleaseName extracts structured release details from a file or
+// torrent name such as "Movie.Title.2019.2160p.WEB-DL.DDP5.1.HDR.x265-GROUP".
+func ParseReleaseName(name string) ReleaseInfo {
+	info := ReleaseInfo{}
+	name = strings.TrimSpace(name)
+	if releaseVideoExtensions[strings.ToLower(path.Ext(name))] {
+		name = strings.TrimSuffix(name, path.Ext(name))
+	}
+
+	/* The title runs up to the last year, or else up to the first tag; tags are only looked for after it */
+	title_end, tags := len(name), name
+	years := releaseYearPattern.FindAllStringSubmatchIndex(name, -1)
+	if len(years) > 0 && years[len(years) - 1][2] > 0 {
+		loc := years[len(years) - 1]
+		info.Year, _ = strconv.Atoi(name[loc[2]:loc[3]])
+		title_end, tags = loc[2], name[loc[3]:]
+	}
+	has_year := info.Year > 0
+	note := func(value string, at int) string {
+		if !has_year && at >= 0 && at < title_end {
+			title_end = at
+		}
+		return value
+	}
+
+	info.Resolution = note(matchReleaseRule(tags, releaseResolutions))
+	info.Source = note(matchReleaseRule(tags, releaseSources))
+	info.Codec = note(matchReleaseRule(tags, releaseCodecs))
+	info.HDR = note(matchReleaseRule(tags, releaseHdrFormats))
+	info.Audio = note(matchReleaseRule(tags, releaseAudio))
+	info.Edition = note(matchReleaseRule(tags, releaseEditions))
+	three_d, at := matchReleaseRule(tags, release3D)
+	info.ThreeD = note(three_d, at) != ""
+
+	if m := releaseChannelsPattern.FindStringSubmatch(tags); m != nil {
+		info.AudioChannels = m[1] + "." + m[2]
+	} else if m := releaseChannelCountPattern.FindStringSubmatch(tags); m != nil {
+		info.AudioChannels = map[string]string{"2": "2.0", "6": "5.1", "8": "7.1"}[m[1]]
+	}
+
+	/* Episodes, then whole seasons */
+	if loc := releaseEpisodePattern.FindStringSubmatchIndex(tags); loc != nil {
+		note("", loc[0])
+		season, _ := strconv.Atoi(tags[loc[2]:loc[3]])
+		episode, _ := strconv.Atoi(tags[loc[4]:loc[5]])
+		info.TV = &ItemSourceTV{Season: season, Episode: episode}
+	} else if loc := releaseCrossEpisodePattern.FindStringSubmatchIndex(tags); loc != nil {
+		note("", loc[0])
+		season, _ := strconv.Atoi(tags[loc[2]:loc[3]])
+		episode, _ := strconv.Atoi(tags[loc[4]:loc[5]])
+		info.TV = &ItemSourceTV{Season: season, Episode: episode}
+	} else if loc := releaseSeasonPattern.FindStringSubmatchIndex(tags); loc != nil {
+		note("", loc[0])
+		season, _ := strconv.Atoi(tags[loc[2]:loc[3]])
+		info.TV = &ItemSourceTV{Season: season, Episode: FULL_SEASON_EPISODE}
+	}
+
+	/* Release group: "-GROUP" at the end, or "[Group]" in front */
+	stripped := name
+	for releaseTrailingTagPattern.MatchString(stripped) {
+		stripped = releaseTrailingTagPattern.ReplaceAllString(stripped, "")
+	}
+	if m := releaseGroupPattern.FindStringSubmatch(stripped); m != nil && !isReleaseTag(m[1]) {
+		info.Group = m[1]
+	} else if m := releaseLeadingGroupPattern.FindStringSubmatch(name); m != nil {
+		info.Group = m[1]
+	}
+
+	title := name[:title_end]
+	title = releaseLeadingGroupPattern.ReplaceAllString(title, "")
+	title = strings.Map(func(r rune) rune {
+		if r == '.' || r == '_' {
+			return ' '
+		}
+		return r
+	}, title)
+	info.Title = strings.Trim(strings.Join(strings.Fields(title), " "), " -([")
+	return info
+}
+
+/* Whether a candidate group name is really a tag, as in "Title.WEB-DL" */
+func isReleaseTag(candidate string) bool {
+	if len(candidate) <= 2 {
+		return true
+	}
+	for _, rules := range [][]releaseRule{releaseResolutions, releaseSources, releaseCodecs, releaseHdrFormats, releaseAudio} {
+		if value, _ := matchReleaseRule(candidate, rules); value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Quality summarizes the release the way sources are grouped in the UI:
+// 3D, 2160p, 1080p, 720p, HD or SD, or "" when nothing gives it away.
+func (info ReleaseInfo) Quality() string {
+	switch {
+		case info.ThreeD:
+			return "3D"
+		case info.Resolution == "480p":
+			return "SD"
+		case len(info.Resolution) > 0:
+			return info.Resolution
+		case info.Source == "CAM" || info.Source == "TS" || info.Source == "TC" || info.Source == "DVD":
+			return "SD"
+	}
+	return ""
+}
+
+// detectQuality returns the quality of a release name, falling back to the
+// configured HD keywords and then to "SD".
+func detectQuality(name string, info ReleaseInfo) string {
+	if quality := info.Quality(); len(quality) > 0 {
+		return quality
+	}
+	for _, keyword := range append([]string{"TV HD"}, configuration.TitleQualityHDKeywords...) {
+		if strings.Contains(name, keyword) {
+			return "HD"
+		}
+	}
+	return "SD"
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseReleaseName(t *testing.T) {
+	cases := []struct {
+		name string
+		want ReleaseInfo
+	}{
+		{"The.Matrix.1999.1080p.BluRay.x264.DTS-HD.MA.5.1-FGT", ReleaseInfo{
+			Title: "The Matrix", Year: 1999, Resolution: "1080p", Source: "BluRay", Codec: "x264",
+			Audio: "DTS-HD", AudioChannels: "5.1", Group: "FGT",
+		}},
+		{"Dune.Part.Two.2024.2160p.UHD.BluRay.REMUX.HDR.HEVC.TrueHD.Atmos.7.1-FraMeSToR", ReleaseInfo{
+			Title: "Dune Part Two", Year: 2024, Resolution: "2160p", Source: "Remux", Codec: "x265",
+			HDR: "HDR", Audio: "Atmos", AudioChannels: "7.1", Group: "FraMeSToR",
+		}},
+		{"Movie.Title.2019.2160p.WEB-DL.DDP5.1.HDR.x265-GROUP", ReleaseInfo{
+			Title: "Movie Title", Year: 2019, Resolution: "2160p", Source: "WEB-DL", Codec: "x265",
+			HDR: "HDR", Audio: "DD+", AudioChannels: "5.1", Group: "GROUP",
+		}},
+		{"Blade Runner 2049 (2017) 1080p BluRay x264 AAC2.0 [YTS]", ReleaseInfo{
+			Title: "Blade Runner 2049", Year: 2017, Resolution: "1080p", Source: "BluRay", Codec: "x264",
+			Audio: "AAC", AudioChannels: "2.0",
+		}},
+		{"Some.Show.S02E05.720p.HDTV.x264-KILLERS.mkv", ReleaseInfo{
+			Title: "Some Show", Resolution: "720p", Source: "HDTV", Codec: "x264", Group: "KILLERS",
+			TV: &ItemSourceTV{Season: 2, Episode: 5},
+		}},
+		{"Some.Show.S03.1080p.WEBRip.x265-GRP", ReleaseInfo{
+			Title: "Some Show", Resolution: "1080p", Source: "WEBRip", Codec: "x265", Group: "GRP",
+			TV: &ItemSourceTV{Season: 3, Episode: FULL_SEASON_EPISODE},
+		}},
+		{"Avatar.2009.Extended.3D.1080p.BluRay.Half-SBS.x264.DTS-HD.MA.7.1-RARBG", ReleaseInfo{
+			Title: "Avatar", Year: 2009, Resolution: "1080p", Source: "BluRay", Codec: "x264",
+			Audio: "DTS-HD", AudioChannels: "7.1", Edition: "Extended", ThreeD: true, Group: "RARBG",
+		}},
+		/* Resolutions and years must not be read as channel counts */
+		{"Film.2015.1080p.WEB.h264-GRP", ReleaseInfo{
+			Title: "Film", Year: 2015, Resolution: "1080p", Source: "WEB", Codec: "x264", Group: "GRP",
+		}},
+		{"Old.Movie.1962.720p.BluRay.6ch.x264", ReleaseInfo{
+			Title: "Old Movie", Year: 1962, Resolution: "720p", Source: "BluRay", Codec: "x264", AudioChannels: "5.1",
+		}},
+	}
+	for _, c := range cases {
+		if got := ParseReleaseName(c.name); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ParseReleaseName(%q)\n got  %+v\n want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestReleaseQuality(t *testing.T) {
+	cases := map[string]string{
+		"Movie.2019.2160p.WEB-DL.x265-GRP": "2160p",
+		"Movie.2019.1080p.BluRay.x264-GRP": "1080p",
+		"Movie.2019.3D.1080p.BluRay.x264-GRP": "3D",
+		"Movie.2019.480p.DVDRip.x264-GRP": "SD",
+		"Movie.2019.DVDRip.XviD-GRP": "SD",
+	}
+	for name, want := range cases {
+		if got := ParseReleaseName(name).Quality(); got != want {
+			t.Errorf("Quality of %q is %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RELEASES_FILENAME = "releases.json"
+	DEFAULT_RELEASE_CHECK_HOURS = 6
+	RELEASE_NEWLY_AVAILABLE_DAYS = 30
+	MovieReleasesUrl = "/movies/%s/releases/%s"
+)
+
+type TrackedRelease struct {
+	ImdbID string `json:"imdb_id"`
+	Title string `json:"title"`
+	ItemType string `json:"item_type"`
+	Theatrical int64 `json:"theatrical,omitempty"` /* unix timestamps in seconds, 0 if unknown */
+	Digital int64 `json:"digital,omitempty"`
+	Physical int64 `json:"physical,omitempty"`
+	HasRating bool `json:"has_rating"`
+	SourceCount int `json:"source_count"`
+	Released bool `json:"released"`
+	ReleasedAt int64 `json:"released_at,omitempty"` /* when the tracker noticed it became available */
+	BestSource *ScoredSource `json:"best_source,omitempty"` /* pick of the default quality profile once sources show up */
+	LastChecked int64 `json:"last_checked"`
+}
+
+type ReleaseTracker struct {
+	lock *sync.Mutex
+	check_lock *sync.Mutex
+	Items map[string]*TrackedRelease `json:"items"`
+	LastCheck int64 `json:"last_check"`
+	wake chan bool
+}
+
+var releaseTracker = ReleaseTracker{
+	lock: &sync.Mutex{},
+	check_lock: &sync.Mutex{},
+	Items: make(map[string]*TrackedRelease),
+	wake: make(chan bool, 1),
+}
+
+func (rt *ReleaseTracker) ReadFromDisk() {
+	content, err := ioutil.ReadFile(RELEASES_FILENAME)
+	if err != nil {
+		return
+	}
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	if err = json.Unmarshal(content, rt); err != nil {
+		fmt.Println("Could not parse release tracker:", err)
+	}
+	if rt.Items == nil {
+		rt.Items = make(map[string]*TrackedRelease)
+	}
+}
+
+func (rt *ReleaseTracker) saveToDisk() (error) {
+	releases_json, err := json.Marshal(rt)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(RELEASES_FILENAME, releases_json, 0644)
+}
+
+func parseOmdbDate(s string) int64 {
+	t, err := time.Parse("02 Jan 2006", s)
+	if err != nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+func releaseCountry() string {
+	if len(configuration.ReleaseCountry) > 0 {
+		return strings.ToLower(configuration.ReleaseCountry)
+	}
+	return "us"
+}
+
+// fetchReleaseDates fills in release dates, preferring Trakt.tv's per-type
+// release list over OMDb's single theatrical and DVD dates.
+func fetchReleaseDates(tracked *TrackedRelease) {
+	omdb, err := omdbQuery(url.Values{"i": {tracked.ImdbID}})
+	if err == nil {
+		if title, ok := omdb["Title"].(string); ok {
+			tracked.Title = title
+		}
+		if media_type, _ := omdb["Type"].(string); media_type == "series" {
+			tracked.ItemType = "show"
+		}
+		released, _ := omdb["Released"].(string)
+		dvd, _ := omdb["DVD"].(string)
+		tracked.Theatrical = parseOmdbDate(released)
+		tracked.Physical = parseOmdbDate(dvd)
+		rating, _ := omdb["imdbRating"].(string)
+		tracked.HasRating = len(rating) > 0 && rating != "N/A"
+	}
+
+	if tracked.ItemType != "movie" || len(configuration.TraktClientId) == 0 {
+		return
+	}
+	res, err := traktRequestGet(fmt.Sprintf(MovieReleasesUrl, tracked.ImdbID, releaseCountry()))
+	if err != nil {
+		return
+	}
+	releases, _ := res.([]interface{})
+	for _, on_v := range releases {
+		on, _ := on_v.(map[string]interface{})
+		date_str, _ := on["release_date"].(string)
+		date, err := time.Parse("2006-01-02", date_str)
+		if err != nil {
+			continue
+		}
+		release_type, _ := on["release_type"].(string)
+		var field *int64
+		switch release_type {
+			case "theatrical", "premiere", "limited":
+				field = &tracked.Theatrical
+			case "digital", "tv":
+				field = &tracked.Digital
+			case "physical":
+				field = &tracked.Physical
+			default:
+				continue
+		}
+		/* Keep the earliest date of each kind */
+		if *field == 0 || date.Unix() < *field {
+			*field = date.Unix()
+		}
+	}
+}
+
+func (tr TrackedRelease) earliestHomeRelease() int64 {
+	var earliest int64
+	for _, date := range []int64{tr.Digital, tr.Physical} {
+		if date > 0 && (earliest == 0 || date < earliest) {
+			earliest = date
+		}
+	}
+	return earliest
+}
+
+// worthSearchingSources avoids hitting sources for titles that are clearly
+// still far from release.
+func (tr TrackedRelease) worthSearchingSources(now int64) bool {
+	if tr.HasRating {
+		return true
+	}
+	if home := tr.earliestHomeRelease(); home > 0 {
+		return home <= now
+	}
+	return tr.Theatrical == 0 || tr.Theatrical <= now
+}
+
+// Check refreshes every unreleased watchlist item, flipping those that now
+// have a rating or available sources to released.
+func (rt *ReleaseTracker) Check() (map[string]int) {
+	rt.check_lock.Lock()
+	defer rt.check_lock.Unlock()
+	stats := map[string]int{"tracked": 0, "released": 0, "untracked": 0}
+	movieWorker := movieData{}
+	watchlist := idSet(watchStore.GetWatchlist())
+	now := time.Now().Unix()
+
+	/* Start tracking watchlist items that do not resolve as released yet */
+	for imdb_id := range watchlist {
+		rt.lock.Lock()
+		_, tracked := rt.Items[imdb_id]
+		rt.lock.Unlock()
+		if tracked {
+			continue
+		}
+		resolved, err := movieWorker.ResolveImdb(imdb_id)
+		if err != nil && resolved == nil {
+			continue
+		}
+		if unreleased, _ := resolved["unreleased"].(bool); !unreleased {
+			continue
+		}
+		item_type := "movie"
+		if is_tv, _ := resolved["is_tv_show"].(bool); is_tv {
+			item_type = "show"
+		}
+		rt.lock.Lock()
+		rt.Items[imdb_id] = &TrackedRelease{ImdbID: imdb_id, ItemType: item_type}
+		rt.lock.Unlock()
+	}
+
+	/* Refresh pending items */
+	rt.lock.Lock()
+	var pending []TrackedRelease
+	for imdb_id, on := range rt.Items {
+		if !watchlist[imdb_id] && !on.Released {
+			/* Removed from watchlist before release */
+			delete(rt.Items, imdb_id)
+			stats["untracked"] += 1
+			continue
+		}
+		if !on.Released {
+			pending = append(pending, *on)
+		}
+	}
+	rt.lock.Unlock()
+	for _, on := range pending {
+		fetchReleaseDates(&on)
+		if on.worthSearchingSources(now) {
+			if found, err := SearchSourcesParallel(map[string]interface{}{"id": on.ImdbID}); err == nil {
+				on.SourceCount = len(found)
+				if profile, err := FindQualityProfile(""); err == nil {
+					movieWorker := movieData{}
+					resolved, _ := movieWorker.ResolveImdb(on.ImdbID)
+					on.BestSource = SelectBestSource(found, runtimeMinutes(resolved), profile).Best
+				}
+			}
+		}
+		on.LastChecked = now
+		if on.HasRating || on.SourceCount > 0 {
+			on.Released = true
+			on.ReleasedAt = now
+			stats["released"] += 1
+
+			/* Drop the stale "unreleased" resolution so it is fetched afresh */
+			cache.Del([]byte(IMDB_KEY_ID + on.ImdbID))
+		}
+		updated := on
+		rt.lock.Lock()
+		rt.Items[on.ImdbID] = &updated
+		rt.lock.Unlock()
+	}
+
+	/* Forget items once they are no longer newly available */
+	rt.lock.Lock()
+	for imdb_id, on := range rt.Items {
+		if on.Released && now - on.ReleasedAt > RELEASE_NEWLY_AVAILABLE_DAYS * 24 * 60 * 60 {
+			delete(rt.Items, imdb_id)
+		}
+		if !on.Released {
+			stats["tracked"] += 1
+		}
+	}
+	rt.LastCheck = now
+	if err := rt.saveToDisk(); err != nil {
+		fmt.Println("Warning: could not save release tracker:", err)
+	}
+	rt.lock.Unlock()
+	return stats
+}
+
+func (rt *ReleaseTracker) Trigger() {
+	select {
+		case rt.wake <- true:
+		default:
+	}
+}
+
+func (rt *ReleaseTracker) Run() {
+	interval := time.Duration(configuration.ReleaseCheckIntervalHours) * time.Hour
+	if interval <= 0 {
+		interval = DEFAULT_RELEASE_CHECK_HOURS * time.Hour
+	}
+	for {
+		stats := rt.Check()
+		fmt.Println("Checked upcoming releases:", stats)
+		select {
+			case <-rt.wake:
+			case <-time.After(interval):
+		}
+	}
+}
+
+func (rt *ReleaseTracker) snapshot(released bool) []TrackedRelease {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	ret := make([]TrackedRelease, 0)
+	for _, on := range rt.Items {
+		if on.Released == released {
+			ret = append(ret, *on)
+		}
+	}
+	return ret
+}
+
+// Upcoming lists tracked unreleased items, soonest known release first.
+func (rt *ReleaseTracker) Upcoming() []TrackedRelease {
+	ret := rt.snapshot(false)
+	next := func(tr TrackedRelease) int64 {
+		if home := tr.earliestHomeRelease(); home > 0 {
+			return home
+		}
+		if tr.Theatrical > 0 {
+			return tr.Theatrical
+		}
+		return 1 << 62
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return next(ret[i]) < next(ret[j])
+	})
+	return ret
+}
+
+// NewlyAvailable lists items that became available within the last days.
+func (rt *ReleaseTracker) NewlyAvailable(days int) []TrackedRelease {
+	if days <= 0 {
+		days = RELEASE_NEWLY_AVAILABLE_DAYS
+	}
+	cutoff := time.Now().Add(-time.Duration(days) * 24 * time.Hour).Unix()
+	ret := make([]TrackedRelease, 0)
+	for _, on := range rt.snapshot(true) {
+		if on.ReleasedAt >= cutoff {
+			ret = append(ret, on)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ReleasedAt > ret[j].ReleasedAt
+	})
+	return ret
+}
+
+/* iCalendar feed */
+
+func icsEscape(s string) string {
+	return strings.NewReplacer("\\", "\\\\", ";", "\\;", ",", "\\,", "\n", "\\n").Replace(s)
+}
+
+func icsFold(line string) string {
+	/* Lines longer than 75 octets continue on the next line after a space */
+	var out bytes.Buffer
+	for len(line) > 75 {
+		cut := 75
+		for cut > 0 && (line[cut] & 0xC0) == 0x80 {
+			cut -= 1
+		}
+		out.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+	}
+	out.WriteString(line + "\r\n")
+	return out.String()
+}
+
+func (rt *ReleaseTracker) Calendar() string {
+	var out bytes.Buffer
+	write := func(line string) {
+		out.WriteString(icsFold(line))
+	}
+	write("BEGIN:VCALENDAR")
+	write("VERSION:2.0")
+	write("PRODID:-//gomovies//Upcoming Releases//EN")
+	write("CALSCALE:GREGORIAN")
+	write("X-WR-CALNAME:Watchlist Releases")
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	items := append(rt.Upcoming(), rt.NewlyAvailable(0)...)
+	for _, on := range items {
+		title := on.Title
+		if len(title) == 0 {
+			title = on.ImdbID
+		}
+		for kind, date := range map[string]int64{"theatrical": on.Theatrical, "digital": on.Digital, "physical": on.Physical} {
+			if date == 0 {
+				continue
+			}
+			day := time.Unix(date, 0).UTC()
+			write("BEGIN:VEVENT")
+			write(fmt.Sprintf("UID:%s-%s@gomovies", on.ImdbID, kind))
+			write("DTSTAMP:" + stamp)
+			write("DTSTART;VALUE=DATE:" + day.Format("20060102"))
+			write("DTEND;VALUE=DATE:" + day.AddDate(0, 0, 1).Format("20060102"))
+			write("SUMMARY:" + icsEscape(fmt.Sprintf("%s (%s release)", title, strings.Title(kind))))
+			write("URL:" + icsEscape("https://www.imdb.com/title/" + on.ImdbID + "/"))
+			write("TRANSP:TRANSPARENT")
+			write("END:VEVENT")
+		}
+	}
+	write("END:VCALENDAR")
+	return out.String()
+}
+
+func calendarHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", "inline; filename=\"releases.ics\"")
+	fmt.Fprint(w, releaseTracker.Calendar())
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// ScrapeField says where one value of a result row comes from: a CSS
+// selector (and attribute) for HTML rows, or a path for JSON rows, narrowed
+// down by an optional regex whose first group is kept.
+type ScrapeField struct {
+	Selector string `mapstructure:"selector"` // relative to the row, the row itself when empty
+	Attr string `mapstructure:"attr"` // attribute to read instead of the text
+	Path string `mapstructure:"path"` // dotted JSON path, looked up in the release and then the row
+	Regex string `mapstructure:"regex"`
+	Value string `mapstructure:"value"` // constant value
+}
+
+type ScrapeQualityRule struct {
+	Pattern string `mapstructure:"pattern"` // regex matched against the title
+	Quality string `mapstructure:"quality"`
+}
+
+// ScrapeSource is a source described entirely in config.json, for sites that
+// can be handled by pulling fields out of an HTML page or a JSON response.
+type ScrapeSource struct {
+	Hostname string `mapstructure:"hostname"`
+	SearchUrl string `mapstructure:"search_url"` // with {{keyword}}
+	ImdbUrl string `mapstructure:"imdb_url"` // with {{imdb}} or {{imdb_number}}
+	Format string `mapstructure:"format"` // "html" (default) or "json"
+	Rows string `mapstructure:"rows"` // CSS selector or JSON path of the result rows
+	RowRegex string `mapstructure:"row_regex"` // HTML only, instead of rows: one row per match, named groups become fields
+	Releases string `mapstructure:"releases"` // JSON only: path of each row's list of releases
+	Fields map[string]ScrapeField `mapstructure:"fields"` // title, url, size, seeds, peers, imdb, quality, uploaded, season, episode, ...
+	UrlTemplate string `mapstructure:"url_template"` // builds the url from other fields, e.g. "magnet:?xt=urn:btih:{{hash}}"
+	SizeUnit string `mapstructure:"size_unit"` // unit of plain numeric sizes, "b" by default
+	QualityRules []ScrapeQualityRule `mapstructure:"quality_rules"`
+	TV bool `mapstructure:"tv"`
+	Mirrored `mapstructure:",squash"` // mirrors replace the scheme and host of the urls above
+
+	compile_once sync.Once
+	compiled map[string]*regexp.Regexp
+	compile_err error
+}
+
+var (
+	scrapePlaceholderPattern = regexp.MustCompile(`\{\{([a-z_]+)\}\}`)
+	scrapeImdbPattern = regexp.MustCompile(`tt[0-9]{7,}`)
+	scrapeNumberPattern = regexp.MustCompile(`[0-9][0-9,]*(?:\.[0-9]+)?`)
+)
+
+func (src *ScrapeSource) Capabilities() SourceCapabilities {
+	return SourceCapabilities{Keyword: len(src.SearchUrl) > 0, Imdb: len(src.ImdbUrl) > 0, TV: src.TV}
+}
+
+/* Compiles every configured regex once, so a typo fails the first search loudly */
+func (src *ScrapeSource) regex(pattern string) *regexp.Regexp {
+	src.compile_once.Do(func() {
+		src.compiled = make(map[string]*regexp.Regexp)
+		patterns := []string{src.RowRegex}
+		for _, field := range src.Fields {
+			patterns = append(patterns, field.Regex)
+		}
+		for _, rule := range src.QualityRules {
+			patterns = append(patterns, "(?i)" + rule.Pattern)
+		}
+		for _, on := range patterns {
+			if len(on) == 0 {
+				continue
+			}
+			re, err := regexp.Compile(on)
+			if err != nil {
+				src.compile_err = errors.New(fmt.Sprintf("Invalid regex \"%s\": %s", on, err))
+				return
+			}
+			src.compiled[on] = re
+		}
+	})
+	return src.compiled[pattern]
+}
+
+func expandScrapeTemplate(template string, values map[string]string, escape bool) string {
+	return scrapePlaceholderPattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		value := values[scrapePlaceholderPattern.FindStringSubmatch(placeholder)[1]]
+		if escape {
+			return url.QueryEscape(value)
+		}
+		return value
+	})
+}
+
+/* Dotted path lookup in decoded JSON, with numeric parts indexing arrays */
+func jsonPath(doc interface{}, path string) interface{} {
+	if len(path) == 0 {
+		return doc
+	}
+	for _, part := range strings.Split(path, ".") {
+		switch cur := doc.(type) {
+			case map[string]interface{}:
+				doc = cur[part]
+			case []interface{}:
+				idx, err := strconv.Atoi(part)
+				if err != nil || idx < 0 || idx >= len(cur) {
+					return nil
+				}
+				doc = cur[idx]
+			default:
+				return nil
+		}
+	}
+	return doc
+}
+
+func jsonString(value interface{}) string {
+	switch v := value.(type) {
+		case nil:
+			return ""
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			return strconv.FormatBool(v)
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+func (src *ScrapeSource) refine(field ScrapeField, value string) string {
+	value = strings.TrimSpace(value)
+	if re := src.regex(field.Regex); re != nil {
+		m := re.FindStringSubmatch(value)
+		switch {
+			case m == nil:
+				return ""
+			case len(m) > 1:
+				return strings.TrimSpace(m[1])
+			default:
+				return strings.TrimSpace(m[0])
+		}
+	}
+	return value
+}
+
+func (src *ScrapeSource) Search(opts map[string]interface{}) (ret []ItemSource, err error) {
+	ret = make([]ItemSource, 0)
+	src.regex("")
+	if src.compile_err != nil {
+		return nil, src.compile_err
+	}
+
+	/* Generate url */
+	values := make(map[string]string)
+	template := src.SearchUrl
+	imdb_id, by_id := opts["id"].(string)
+	if by_id {
+		template = src.ImdbUrl
+		values["imdb"] = imdb_id
+		values["imdb_number"] = strings.TrimPrefix(imdb_id, "tt")
+	} else if keyword, ok := opts["keyword"].(string); ok {
+		values["keyword"] = keyword
+	}
+	if len(template) == 0 {
+		return nil, errors.New("This kind of search is not configured for this source")
+	}
+	form_url := expandScrapeTemplate(template, values, true)
+
+	/* Download page, from a mirror if the site has them */
+	primary := ""
+	if parsed, err := url.Parse(form_url); err == nil {
+		primary = parsed.Scheme + "://" + parsed.Host
+	}
+	body, err := src.Get(primary, form_url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	/* Pull every row apart into named field values */
+	var rows []map[string]string
+	if src.Format == "json" {
+		rows, err = src.jsonRows(body)
+	} else {
+		rows, err = src.htmlRows(string(body))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	base, _ := url.Parse(form_url)
+	for _, fields := range rows {
+		on, ok := src.itemSource(fields, base)
+		if !ok {
+			continue
+		}
+		if len(on.ImdbCode) == 0 {
+			if by_id {
+				on.ImdbCode = imdb_id
+			} else if on.ImdbCode = matchReleaseImdb(on.Release); len(on.ImdbCode) == 0 {
+				continue
+			}
+		}
+		if by_id && on.ImdbCode != imdb_id {
+			continue
+		}
+		ret = append(ret, on)
+	}
+	return ret, nil
+}
+
+func (src *ScrapeSource) htmlRows(body string) ([]map[string]string, error) {
+	ret := make([]map[string]string, 0)
+
+	/* Regex rows: named groups are fields, and field regexes run over the whole match */
+	if re := src.regex(src.RowRegex); re != nil {
+		for _, m := range re.FindAllStringSubmatch(body, -1) {
+			fields := make(map[string]string)
+			for idx, name := range re.SubexpNames() {
+				if len(name) > 0 {
+					fields[name] = strings.TrimSpace(m[idx])
+				}
+			}
+			for name, field := range src.Fields {
+				if len(field.Value) > 0 {
+					fields[name] = field.Value
+				} else if len(field.Regex) > 0 {
+					fields[name] = src.refine(field, m[0])
+				}
+			}
+			ret = append(ret, fields)
+		}
+		return ret, nil
+	}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	doc.Find(src.Rows).Each(func(_ int, row *goquery.Selection) {
+		fields := make(map[string]string)
+		for name, field := range src.Fields {
+			if len(field.Value) > 0 {
+				fields[name] = field.Value
+				continue
+			}
+			found := row
+			if len(field.Selector) > 0 {
+				found = row.Find(field.Selector).First()
+			}
+			value := found.Text()
+			if len(field.Attr) > 0 {
+				value, _ = found.Attr(field.Attr)
+			}
+			fields[name] = src.refine(field, value)
+		}
+		ret = append(ret, fields)
+	})
+	return ret, nil
+}
+
+func (src *ScrapeSource) jsonRows(body []byte) ([]map[string]string, error) {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	ret := make([]map[string]string, 0)
+	found, _ := jsonPath(doc, src.Rows).([]interface{})
+	for _, row := range found {
+		/* Each row may list several releases, which see the row's fields too */
+		releases := []interface{}{row}
+		if len(src.Releases) > 0 {
+			releases, _ = jsonPath(row, src.Releases).([]interface{})
+		}
+		for _, release := range releases {
+			fields := make(map[string]string)
+			for name, field := range src.Fields {
+				if len(field.Value) > 0 {
+					fields[name] = field.Value
+					continue
+				}
+				value := jsonPath(release, field.Path)
+				if value == nil {
+					value = jsonPath(row, field.Path)
+				}
+				fields[name] = src.refine(field, jsonString(value))
+			}
+			ret = append(ret, fields)
+		}
+	}
+	return ret, nil
+}
+
+/* Size in bytes from either a plain number in size_unit or a humanized size */
+func (src *ScrapeSource) parseSize(size string) int64 {
+	if plain, err := strconv.ParseFloat(strings.Replace(size, ",", "", -1), 64); err == nil {
+		unit := sizeUnits[strings.ToLower(src.SizeUnit)]
+		if unit == 0 {
+			unit = 1
+		}
+		return int64(plain * unit)
+	}
+	size_bytes, _ := ParseSize(size)
+	return size_bytes
+}
+
+func scrapeInt(value string) int {
+	found, _ := strconv.Atoi(strings.Replace(scrapeNumberPattern.FindString(value), ",", "", -1))
+	return found
+}
+
+func scrapeTime(value string) int64 {
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return unix
+	}
+	for _, layout := range []string{time.RFC3339, time.RFC1123Z, time.RFC1123, "2006-01-02 15:04:05 -0700", "2006-01-02 15:04:05", "2006-01-02"} {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed.Unix()
+		}
+	}
+	return parseUploadDate(value)
+}
+
+func (src *ScrapeSource) itemSource(fields map[string]string, base *url.URL) (ItemSource, bool) {
+	title := fields["title"]
+	link := fields["url"]
+	if len(src.UrlTemplate) > 0 {
+		link = expandScrapeTemplate(src.UrlTemplate, fields, true)
+	}
+	if len(link) == 0 {
+		return ItemSource{}, false
+	}
+	if parsed, err := url.Parse(link); err == nil && base != nil && !parsed.IsAbs() {
+		link = base.ResolveReference(parsed).String()
+	}
+
+	release := ParseReleaseName(title)
+	on := ItemSource{
+		ImdbCode: scrapeImdbPattern.FindString(fields["imdb"]),
+		Filename: title,
+		Url: link,
+		SourceCount: scrapeInt(fields["seeds"]),
+		ClientCount: scrapeInt(fields["peers"]),
+		SourceHostname: src.Hostname,
+		UploadedAt: scrapeTime(fields["uploaded"]),
+		TV: release.TV,
+		Release: release,
+	}
+	if len(fields["season"]) > 0 {
+		on.TV = &ItemSourceTV{Season: scrapeInt(fields["season"]), Episode: FULL_SEASON_EPISODE}
+		if len(fields["episode"]) > 0 {
+			on.TV.Episode = scrapeInt(fields["episode"])
+		}
+	}
+
+	on.SizeBytes = src.parseSize(fields["size"])
+	on.Size = fields["size"]
+	if on.SizeBytes > 0 {
+		on.Size = BytesToSize(float64(on.SizeBytes))
+	}
+
+	/* Quality from the rules, then the site's own field, then the release name */
+	for _, rule := range src.QualityRules {
+		if re := src.regex("(?i)" + rule.Pattern); re != nil && re.MatchString(title + " " + fields["quality"]) {
+			on.Quality = rule.Quality
+			break
+		}
+	}
+	if len(on.Quality) == 0 && len(fields["quality"]) > 0 {
+		on.Quality = detectQuality(fields["quality"], ParseReleaseName(fields["quality"]))
+	}
+	if len(on.Quality) == 0 {
+		on.Quality = detectQuality(title, release)
+	}
+	return on, true
+}
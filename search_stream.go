@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// StreamSearch runs the same search as SearchForItem but reports progress as
+// it happens: a "sources" event as each source finishes, an "item" event as
+// each match is resolved and a final "done" event naming the sources that
+// failed. The channel is closed after "done", or early once stop is closed.
+func (movieData) StreamSearch(opts map[string]interface{}, load_balancer_addr string, stop <-chan struct{}) <-chan map[string]interface{} {
+	events := make(chan map[string]interface{}, 16)
+	send := func(event map[string]interface{}) {
+		select {
+			case events <- event:
+			case <-stop:
+		}
+	}
+
+	/* Guards everything below; held while sending so items and batches stay consistent */
+	var lock sync.Mutex
+	found := make(map[string][]ItemSource)
+	resolving := make(map[string]bool)
+	failed := make(map[string]string)
+	items, source_count := 0, 0
+	var pending sync.WaitGroup
+
+	resolve := func(imdb_id string) {
+		lock.Lock()
+		defer lock.Unlock()
+		if len(imdb_id) == 0 || resolving[imdb_id] {
+			return
+		}
+		resolving[imdb_id] = true
+		pending.Add(1)
+		go func() {
+			defer pending.Done()
+			item := lookupViaBalancer(imdb_id, load_balancer_addr)
+			if item == nil {
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			have := SortAndFilterSources(found[imdb_id], opts)
+			annotateBitrates(item, have)
+			item["sources"] = have
+			items += 1
+			send(map[string]interface{}{
+				"event": "item",
+				"item": item,
+			})
+		}()
+	}
+
+	/* Sources, in the order they finish */
+	pending.Add(1)
+	go func() {
+		defer pending.Done()
+		SearchSourcesEach(opts, func(si *SourceInstance, res []ItemSource, err error) {
+			lock.Lock()
+			if err != nil {
+				failed[si.Name] = err.Error()
+			}
+			for _, elem := range res {
+				found[elem.ImdbCode] = append(found[elem.ImdbCode], elem)
+			}
+			source_count += len(res)
+			event := map[string]interface{}{
+				"event": "sources",
+				"source": si.Name,
+				"sources": SortAndFilterSources(res, opts),
+			}
+			if err != nil {
+				event["error"] = err.Error()
+			}
+			send(event)
+			lock.Unlock()
+
+			for _, elem := range res {
+				resolve(elem.ImdbCode)
+			}
+		})
+	}()
+
+	/* Matching titles from Trakt.tv when searching by keyword */
+	imdb_id, by_id := opts["id"].(string)
+	if keyword, ok := opts["keyword"].(string); ok && !by_id {
+		pending.Add(1)
+		go func() {
+			defer pending.Done()
+			tmp, err := searchTraktMovies(keyword, "movie")
+			if err != nil {
+				lock.Lock()
+				failed["trakt"] = err.Error()
+				lock.Unlock()
+				return
+			}
+			for _, id := range deDup(filterTraktIds(tmp)) {
+				resolve(id)
+			}
+		}()
+	} else if by_id {
+		resolve(imdb_id)
+	}
+
+	go func() {
+		pending.Wait()
+
+		/* Cache sources only if searching for an item directly */
+		if by_id {
+			cacheSources(map[string][]ItemSource{imdb_id: found[imdb_id]})
+		}
+		send(map[string]interface{}{
+			"event": "done",
+			"items": items,
+			"sources": source_count,
+			"failed": failed,
+		})
+		close(events)
+	}()
+	return events
+}
+
+// searchStreamHandler serves StreamSearch as newline-delimited JSON, or as
+// server-sent events when asked for with format=sse or the Accept header.
+func searchStreamHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := make(map[string]interface{})
+	if id := query.Get("id"); len(id) > 0 {
+		opts["id"] = id
+	} else if keyword := query.Get("keyword"); len(keyword) > 0 {
+		opts["keyword"] = keyword
+	} else {
+		http.Error(w, "Parameter `id` or `keyword` is required", http.StatusBadRequest)
+		return
+	}
+	if query.Get("tv") == "true" {
+		opts["tv"] = true
+	}
+	for _, key := range []string{"sort", "order", "min_size", "max_size", "min_seeds", "quality", "max_age_days"} {
+		if value := query.Get(key); len(value) > 0 {
+			opts[key] = value
+		}
+	}
+
+	sse := query.Get("format") == "sse" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+
+	/* Stop producing once the client goes away */
+	stop := make(chan struct{})
+	defer close(stop)
+	movieWorker := movieData{}
+	events := movieWorker.StreamSearch(opts, r.Host, stop)
+	for {
+		select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				encoded, err := json.Marshal(event)
+				if err != nil {
+					fmt.Println("Could not encode search event:", err)
+					continue
+				}
+				if sse {
+					_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event["event"], encoded)
+				} else {
+					_, err = fmt.Fprintf(w, "%s\n", encoded)
+				}
+				if err != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+		}
+	}
+}
@@ -55,6 +55,9 @@ func (movieService) Movies(s map[string]interface{}, ctx context.Context) (err_r
 				return nil, errors.New("Invalid IMDB id")
 			}
 			data, err := movieWorker.ResolveImdb(imdb_id)
+			if err == nil {
+				rewriteCoverImage(imdb_id, data)
+			}
 			return data, err
 		case "resolveParallel":
 			// Takes {"ids": [...]}
@@ -110,6 +113,17 @@ func (movieService) Movies(s map[string]interface{}, ctx context.Context) (err_r
 			}
 			_, autoclear_enabled := req_data["autoclear_enabled"]
 
+			/* Refuse sources whose contents look wrong, unless told to go ahead */
+			if force, _ := req_data["force"].(bool); !force {
+				if inspection := InspectSource(fmt.Sprint(uri)); inspection.Blocked {
+					return map[string]interface{}{
+						"result": "blocked",
+						"blocked": true,
+						"inspection": inspection,
+					}, nil
+				}
+			}
+
 			/* Execute request */
 			payload := map[string]interface{}{
 				configuration.DownloadUriOauthParam: uri,
@@ -336,6 +350,8 @@ func (movieService) Movies(s map[string]interface{}, ctx context.Context) (err_r
 		case "searchForItem":
 			// Can take {"id": <imdb_id>}
 			// Can take {"keyword": <keyword>}
+			// Sources can be filtered and sorted with {"sort": "size"|"seeds"|"quality"|"age", "order": "asc"|"desc",
+			// "min_size": <bytes>, "max_size": <bytes>, "min_seeds": <n>, "quality": [...], "max_age_days": <n>}
 			data, err := movieWorker.SearchForItem(req_data, lb_ip.(string))
 			if err == nil {
 				outp := map[string]interface{}{
@@ -344,6 +360,88 @@ func (movieService) Movies(s map[string]interface{}, ctx context.Context) (err_r
 				return outp, err
 			}
 			return nil, err
+		case "getSources":
+			return map[string]interface{}{
+				"sources": GetSources(),
+			}, nil
+		case "getQualityProfiles":
+			return map[string]interface{}{
+				"profiles": GetQualityProfiles(),
+				"default": configuration.DefaultQualityProfile,
+			}, nil
+		case "selectBestSource":
+			// Takes {"id": <imdb_id>, "profile": <name, optional>}
+			imdb_id, ok := req_data["id"].(string)
+			if !ok {
+				return nil, errors.New("Parameter `id` is required")
+			}
+			profile_name, _ := req_data["profile"].(string)
+			profile, err := FindQualityProfile(profile_name)
+			if err != nil {
+				return map[string]interface{}{"result": false, "err": err.Error()}, nil
+			}
+			item, err := movieWorker.GetItem(imdb_id, false, lb_ip.(string))
+			if err != nil {
+				return nil, err
+			}
+			sources, _ := item["sources"].([]ItemSource)
+			return map[string]interface{}{
+				"result": true,
+				"selection": SelectBestSource(sources, runtimeMinutes(item), profile),
+			}, nil
+		case "inspectSource":
+			// Takes {"uri": <magnet or torrent link>}
+			uri, ok := req_data["uri"].(string)
+			if !ok {
+				return nil, errors.New("Parameter `uri` is required")
+			}
+			inspection := InspectSource(uri)
+			return map[string]interface{}{
+				"result": len(inspection.Error) == 0,
+				"err": inspection.Error,
+				"inspection": inspection,
+			}, nil
+		case "getFeedMatches":
+			// Can take {"days": <n>}
+			days := 0
+			if days_f, ok := req_data["days"].(float64); ok {
+				days = int(days_f)
+			}
+			return map[string]interface{}{
+				"matches": feedWatcher.RecentMatches(days),
+			}, nil
+		case "pollFeeds":
+			feedWatcher.Trigger()
+			return map[string]interface{}{"result": true}, nil
+		case "getWanted":
+			return map[string]interface{}{
+				"wanted": feedWatcher.GetWanted(),
+			}, nil
+		case "addWanted":
+			// Takes {"id": <imdb_id>, "profile": <quality profile, optional>}
+			imdb_id, ok := req_data["id"].(string)
+			if !ok {
+				return nil, errors.New("Parameter `id` is required")
+			}
+			profile, _ := req_data["profile"].(string)
+			if err := feedWatcher.AddWanted(imdb_id, profile); err != nil {
+				return map[string]interface{}{"result": false, "err": err.Error()}, nil
+			}
+			return map[string]interface{}{"result": true}, nil
+		case "removeWanted":
+			// Takes {"id": <imdb_id>}
+			imdb_id, ok := req_data["id"].(string)
+			if !ok {
+				return nil, errors.New("Parameter `id` is required")
+			}
+			if err := feedWatcher.RemoveWanted(imdb_id); err != nil {
+				return map[string]interface{}{"result": false, "err": err.Error()}, nil
+			}
+			return map[string]interface{}{"result": true}, nil
+		case "getSourceHealth":
+			return map[string]interface{}{
+				"sources": GetSourceHealth(),
+			}, nil
 		case "getWatchlist":
 			data, err := movieWorker.GetWatchlist(lb_ip.(string))
 			if err == nil {
@@ -377,6 +475,111 @@ func (movieService) Movies(s map[string]interface{}, ctx context.Context) (err_r
 			}
 			data, err := movieWorker.AddToWatchlist(item_type.(string), item_id.(string))
 			return data, err
+		case "removeFromWatchlist":
+			// Takes {"item_type": <...>, "item_id": <...>}
+			item_type, item_id, err := itemParams(req_data)
+			if err != nil {
+				return nil, err
+			}
+			data, err := movieWorker.RemoveFromWatchlist(item_type, item_id)
+			return data, err
+		case "removeHistory":
+			// Takes {"item_type": <...>, "item_id": <...>}
+			item_type, item_id, err := itemParams(req_data)
+			if err != nil {
+				return nil, err
+			}
+			data, err := movieWorker.RemoveWatchHistory(item_type, item_id)
+			return data, err
+		case "rateItem":
+			// Takes {"item_type": <...>, "item_id": <...>, "rating": <1-10>}
+			item_type, item_id, err := itemParams(req_data)
+			if err != nil {
+				return nil, err
+			}
+			rating, ok := req_data["rating"].(float64)
+			if !ok {
+				return nil, errors.New("Parameter `rating` is required")
+			}
+			data, err := movieWorker.RateItem(item_type, item_id, int(rating))
+			return data, err
+		case "unrateItem":
+			// Takes {"item_type": <...>, "item_id": <...>}
+			item_type, item_id, err := itemParams(req_data)
+			if err != nil {
+				return nil, err
+			}
+			data, err := movieWorker.UnrateItem(item_type, item_id)
+			return data, err
+		case "getRatings":
+			// Takes {"item_type": <...>}
+			item_type, ok := req_data["item_type"].(string)
+			if !ok {
+				item_type = "movie"
+			}
+			data, err := movieWorker.GetRatings(item_type)
+			if err == nil {
+				outp := map[string]interface{}{
+					"ratings": data,
+				}
+				return outp, err
+			}
+			return nil, err
+		case "getLists":
+			data, err := movieWorker.GetLists()
+			if err == nil {
+				outp := map[string]interface{}{
+					"lists": data,
+				}
+				return outp, err
+			}
+			return nil, err
+		case "createList":
+			// Takes {"name": <...>, "description": <...>, "privacy": <...>}
+			data, err := movieWorker.CreateList(req_data)
+			return data, err
+		case "updateList":
+			// Takes {"list_id": <...>, ...fields to update}
+			list_id, ok := req_data["list_id"].(string)
+			if !ok {
+				return nil, errors.New("Parameter `list_id` is required")
+			}
+			data, err := movieWorker.UpdateList(list_id, req_data)
+			return data, err
+		case "deleteList":
+			list_id, ok := req_data["list_id"].(string)
+			if !ok {
+				return nil, errors.New("Parameter `list_id` is required")
+			}
+			data, err := movieWorker.DeleteList(list_id)
+			return data, err
+		case "getListItems":
+			list_id, ok := req_data["list_id"].(string)
+			if !ok {
+				return nil, errors.New("Parameter `list_id` is required")
+			}
+			data, err := movieWorker.GetListItems(list_id)
+			if err == nil {
+				outp := map[string]interface{}{
+					"items": data,
+				}
+				return outp, err
+			}
+			return nil, err
+		case "addToList", "removeFromList":
+			// Takes {"list_id": <...>, "item_type": <...>, "item_id": <...>}
+			list_id, ok := req_data["list_id"].(string)
+			if !ok {
+				return nil, errors.New("Parameter `list_id` is required")
+			}
+			item_type, item_id, err := itemParams(req_data)
+			if err != nil {
+				return nil, err
+			}
+			if req_type == "addToList" {
+				return movieWorker.AddToList(list_id, item_type, item_id)
+			}
+			return movieWorker.RemoveFromList(list_id, item_type, item_id)
 		case "getHistory":
 			data, err := movieWorker.GetWatchHistory(lb_ip.(string))
 			if err == nil {
@@ -401,6 +604,166 @@ func (movieService) Movies(s map[string]interface{}, ctx context.Context) (err_r
 			}
 			data, err := movieWorker.UpdateScrobbleStatus(imdb_code.(string), progress.(float64), state.(string))
 			return data, err
+		case "syncTrakt":
+			outp, err := watchStore.SyncTrakt()
+			return outp, err
+		case "getSyncStatus":
+			return watchStore.SyncStatus(), nil
+		case "getTraktOutbox":
+			return traktOutbox.Entries(), nil
+		case "retryTraktOutbox":
+			// Takes {"id": <...>}, or {} to retry all failed entries
+			outbox_id, _ := req_data["id"].(string)
+			return map[string]interface{}{
+				"result": traktOutbox.Retry(outbox_id),
+			}, nil
+		case "discardTraktOutbox":
+			outbox_id, ok := req_data["id"].(string)
+			if !ok {
+				return nil, errors.New("Parameter `id` is required")
+			}
+			return map[string]interface{}{
+				"result": traktOutbox.Discard(outbox_id),
+			}, nil
+		case "getPerson":
+			// Takes {"id": <Trakt slug or id, or IMDb nm id>} or {"name": <...>}
+			person_id, _ := req_data["id"].(string)
+			name, _ := req_data["name"].(string)
+			return LookupPerson(person_id, name)
+		case "getItemPeople":
+			imdb_id, ok := req_data["id"].(string)
+			if !ok {
+				return nil, errors.New("Parameter `id` is required")
+			}
+			return map[string]interface{}{
+				"people": creditsStore.People(imdb_id),
+			}, nil
+		case "searchByPerson":
+			// Takes {"query": <name or person id>, "role": <"actor", "director", ... optional>, "scope": <"library", "watchlist", optional>}
+			query, ok := req_data["query"].(string)
+			if !ok {
+				return nil, errors.New("Parameter `query` is required")
+			}
+			role, _ := req_data["role"].(string)
+			scope, _ := req_data["scope"].(string)
+			return map[string]interface{}{
+				"results": creditsStore.SearchByPerson(query, role, scope),
+			}, nil
+		case "getUpcoming":
+			return map[string]interface{}{
+				"upcoming": releaseTracker.Upcoming(),
+				"calendar_url": "/calendar.ics",
+			}, nil
+		case "getNewlyAvailable":
+			// Takes {"days": <number of days, optional>}
+			days, _ := req_data["days"].(float64)
+			return map[string]interface{}{
+				"available": releaseTracker.NewlyAvailable(int(days)),
+			}, nil
+		case "checkReleases":
+			releaseTracker.Trigger()
+			return map[string]interface{}{
+				"result": true,
+			}, nil
+		case "getSubtitles":
+			// Takes {"imdb_id": <...>, "id": <cloud id, optional>}
+			imdb_id, _ := req_data["imdb_id"].(string)
+			cloud_id, _ := req_data["id"].(string)
+			if len(imdb_id) == 0 && len(cloud_id) == 0 {
+				return map[string]interface{}{
+					"subtitles": []SubtitleTrack{},
+				}, nil
+			}
+			return map[string]interface{}{
+				"subtitles": subtitleLibrary.TracksForItem(imdb_id, cloud_id),
+			}, nil
+		case "searchSubtitles":
+			// Takes {"imdb_id": <...>, "language": <ISO 639-1 code, optional>}
+			imdb_id, ok := req_data["imdb_id"].(string)
+			if !ok {
+				return nil, errors.New("Parameter `imdb_id` is required")
+			}
+			language, _ := req_data["language"].(string)
+			results, err := SearchSubtitles(imdb_id, language)
+			if err != nil {
+				return map[string]interface{}{
+					"result": false,
+					"err": err.Error(),
+				}, nil
+			}
+			return map[string]interface{}{
+				"result": true,
+				"results": results,
+			}, nil
+		case "downloadSubtitle":
+			// Takes a result from `searchSubtitles`
+			var result SubtitleResult
+			result.Provider, _ = req_data["provider"].(string)
+			result.ID, _ = req_data["id"].(string)
+			result.ImdbID, _ = req_data["imdb_id"].(string)
+			result.Language, _ = req_data["language"].(string)
+			result.Format, _ = req_data["format"].(string)
+			track, err := DownloadSubtitle(result)
+			if err != nil {
+				return map[string]interface{}{
+					"result": false,
+					"err": err.Error(),
+				}, nil
+			}
+			return map[string]interface{}{
+				"result": true,
+				"subtitle": track,
+			}, nil
+		case "startImport":
+			// Takes {"format": "letterboxd"|"imdb"|"trakt"|"", "target": "history"|"watchlist"|"ratings", "data": <file contents>}
+			format, _ := req_data["format"].(string)
+			target, _ := req_data["target"].(string)
+			data, ok := req_data["data"].(string)
+			if !ok {
+				return nil, errors.New("Parameter `data` is required")
+			}
+			job, err := StartImport(format, target, data)
+			if err != nil {
+				return map[string]interface{}{
+					"result": false,
+					"err": err.Error(),
+				}, nil
+			}
+			return map[string]interface{}{
+				"result": true,
+				"job_id": job.ID,
+			}, nil
+		case "startExport":
+			// Takes {"format": "letterboxd"|"imdb"|"trakt", "source": "history"|"watchlist"|"library"}
+			format, _ := req_data["format"].(string)
+			source, _ := req_data["source"].(string)
+			job, err := StartExport(format, source)
+			if err != nil {
+				return map[string]interface{}{
+					"result": false,
+					"err": err.Error(),
+				}, nil
+			}
+			return map[string]interface{}{
+				"result": true,
+				"job_id": job.ID,
+			}, nil
+		case "getJob":
+			job_id, ok := req_data["id"].(string)
+			if !ok {
+				return nil, errors.New("Parameter `id` is required")
+			}
+			job, ok := transferJobs.Get(job_id)
+			if !ok {
+				return nil, errors.New("No job with that id")
+			}
+			return map[string]interface{}{
+				"job": job,
+			}, nil
+		case "getJobs":
+			return map[string]interface{}{
+				"jobs": transferJobs.List(),
+			}, nil
 		case "getScrobbles":
 			data, err := movieWorker.GetPlaybackScrobbles(lb_ip.(string))
 			if err == nil {
@@ -410,12 +773,23 @@ func (movieService) Movies(s map[string]interface{}, ctx context.Context) (err_r
 				return outp, err
 			}
 			return nil, err
+		case "traktLoginStart":
+			outp, err := traktAuth.StartDeviceLogin()
+			return outp, err
+		case "traktLoginStatus":
+			return traktAuth.LoginStatus(), nil
 		case "itemLookup":
 			id, ok := req_data["id"]
 			if !ok {
 				return nil, errors.New("Parameter `id` is required")
 			}
-			outp, err := movieWorker.GetItem(id.(string), lb_ip.(string))
+			// Can take {"refresh": true} to search sources again instead of using the cache
+			refresh, _ := req_data["refresh"].(bool)
+			outp, err := movieWorker.GetItem(id.(string), refresh, lb_ip.(string))
+			if sources, ok := outp["sources"].([]ItemSource); ok {
+				// Takes the same source options as `searchForItem`
+				outp["sources"] = SortAndFilterSources(sources, req_data)
+			}
 			return outp, err
 		case "startAirplayPlayback":
 			url, ok := req_data["url"]
@@ -451,6 +825,18 @@ func (movieService) Movies(s map[string]interface{}, ctx context.Context) (err_r
 	panic("should never get here")
 }
 
+func itemParams(req_data map[string]interface{}) (string, string, error) {
+	item_type, ok := req_data["item_type"].(string)
+	if !ok {
+		return "", "", errors.New("Parameter `item_type` is required")
+	}
+	item_id, ok := req_data["item_id"].(string)
+	if !ok {
+		return "", "", errors.New("Parameter `item_id` is required")
+	}
+	return item_type, item_id, nil
+}
+
 func (movieService) Count(s string) int {
 	return len(s)
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+const (
+	SOURCE_CACHE_FILENAME = "sources.json"
+	DEFAULT_SOURCE_CACHE_MINUTES = 60
+	SOURCE_CACHE_KEEP_DAYS = 14 /* entries not searched for this long are dropped */
+)
+
+type CachedSources struct {
+	Sources []ItemSource `json:"sources"`
+	SearchedAt int64 `json:"searched_at,omitempty"` // last search of every source, 0 if never
+	UpdatedAt int64 `json:"updated_at"` // last change from any search or feed
+}
+
+// SourceCache keeps the sources found for each item across restarts. Stale
+// entries are still served while a search refreshes them in the background.
+type SourceCache struct {
+	lock *sync.Mutex
+	Items map[string]*CachedSources `json:"items"`
+	refreshing map[string]bool
+}
+
+var sourceCache = SourceCache{
+	lock: &sync.Mutex{},
+	Items: make(map[string]*CachedSources),
+	refreshing: make(map[string]bool),
+}
+
+func (sc *SourceCache) ReadFromDisk() {
+	content, err := ioutil.ReadFile(SOURCE_CACHE_FILENAME)
+	if err != nil {
+		return
+	}
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if err = json.Unmarshal(content, sc); err != nil {
+		fmt.Println("Could not parse source cache:", err)
+	}
+	if sc.Items == nil {
+		sc.Items = make(map[string]*CachedSources)
+	}
+	sc.prune()
+}
+
+func (sc *SourceCache) saveToDisk() (error) {
+	cache_json, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(SOURCE_CACHE_FILENAME, cache_json)
+}
+
+func (sc *SourceCache) prune() {
+	cutoff := time.Now().AddDate(0, 0, -SOURCE_CACHE_KEEP_DAYS).Unix()
+	for imdb_id, entry := range sc.Items {
+		if entry.UpdatedAt < cutoff {
+			delete(sc.Items, imdb_id)
+		}
+	}
+}
+
+func sourceCacheMaxAge() time.Duration {
+	if configuration.SourceCacheMinutes > 0 {
+		return time.Duration(configuration.SourceCacheMinutes) * time.Minute
+	}
+	return DEFAULT_SOURCE_CACHE_MINUTES * time.Minute
+}
+
+// Get returns a copy of the cached sources of an item, and whether it is
+// time to search for them again.
+func (sc *SourceCache) Get(imdb_id string) (cached CachedSources, stale bool, ok bool) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	entry, ok := sc.Items[imdb_id]
+	if !ok {
+		return CachedSources{Sources: make([]ItemSource, 0)}, true, false
+	}
+	cached = *entry
+	cached.Sources = append([]ItemSource{}, entry.Sources...)
+	stale = time.Since(time.Unix(cached.SearchedAt, 0)) > sourceCacheMaxAge()
+	return cached, stale, true
+}
+
+// Store merges newly found sources into an item's entry. The listings just
+// found replace cached listings of the same file; others are kept along
+// with the time they were last fetched. searched says whether every source
+// was asked, which makes the entry fresh again and drops listings no search
+// has returned within the cache lifetime, as their torrents are likely gone.
+func (sc *SourceCache) Store(imdb_id string, sources []ItemSource, searched bool) {
+	now := time.Now().Unix()
+	sources = MergeSources(sources)
+	current := make(map[string]bool)
+	for idx := range sources {
+		if sources[idx].FetchedAt == 0 {
+			sources[idx].FetchedAt = now
+		}
+		current[sourceKey(sources[idx])] = true
+	}
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	entry, ok := sc.Items[imdb_id]
+	if !ok {
+		entry = &CachedSources{}
+		sc.Items[imdb_id] = entry
+	}
+	expired := now - int64(sourceCacheMaxAge().Seconds())
+	for _, elem := range entry.Sources {
+		identifySource(&elem)
+		if current[sourceKey(elem)] || (searched && elem.FetchedAt < expired) {
+			continue
+		}
+		sources = append(sources, elem)
+	}
+	entry.Sources = sources
+	entry.UpdatedAt = now
+	if searched {
+		entry.SearchedAt = now
+	}
+	sc.prune()
+	if err := sc.saveToDisk(); err != nil {
+		fmt.Println("Could not save source cache:", err)
+	}
+}
+
+// Refreshing tells whether a background search for the item is running.
+func (sc *SourceCache) Refreshing(imdb_id string) bool {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	return sc.refreshing[imdb_id]
+}
+
+// Revalidate searches every source for the item in the background, unless
+// such a search is already running.
+func (sc *SourceCache) Revalidate(imdb_id string) {
+	sc.lock.Lock()
+	if sc.refreshing[imdb_id] {
+		sc.lock.Unlock()
+		return
+	}
+	sc.refreshing[imdb_id] = true
+	sc.lock.Unlock()
+
+	go func() {
+		defer func() {
+			sc.lock.Lock()
+			delete(sc.refreshing, imdb_id)
+			sc.lock.Unlock()
+		}()
+		found, err := SearchSourcesParallel(map[string]interface{}{"id": imdb_id})
+		if err != nil {
+			fmt.Printf("Warning: could not refresh sources of %s: %s\n", imdb_id, err)
+			return
+		}
+		sc.Store(imdb_id, found, true)
+	}()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sony/gobreaker"
+
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DEFAULT_SOURCE_TIMEOUT_SECONDS = 15
+	SOURCE_BREAKER_OPEN_SECONDS = 60
+	SOURCE_LATENCY_SMOOTHING = 0.2 /* weight of the newest sample in the moving average */
+)
+
+var ErrSourceTimeout = errors.New("Source timed out")
+
+var (
+	sourceRequestCount = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: "my_group",
+		Subsystem: "sources",
+		Name:      "request_count",
+		Help:      "Number of source searches by outcome.",
+	}, []string{"source", "result"})
+	sourceRequestLatency = kitprometheus.NewSummaryFrom(stdprometheus.SummaryOpts{
+		Namespace: "my_group",
+		Subsystem: "sources",
+		Name:      "request_latency_seconds",
+		Help:      "Duration of source searches in seconds.",
+	}, []string{"source"})
+)
+
+type SourceHealth struct {
+	lock *sync.Mutex
+	Requests int `json:"requests"`
+	Successes int `json:"successes"`
+	Failures int `json:"failures"`
+	Timeouts int `json:"timeouts"`
+	Rejected int `json:"rejected"` /* skipped while the breaker was open */
+	LastLatencyMs int64 `json:"last_latency_ms"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	LastSuccess int64 `json:"last_success,omitempty"` /* unix timestamp in seconds */
+	LastFailure int64 `json:"last_failure,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+func newSourceBreaker(name string) *gobreaker.CircuitBreaker {
+	return gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name: name,
+		Timeout: SOURCE_BREAKER_OPEN_SECONDS * time.Second,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			failureRatio := float64(counts.TotalFailures) / float64(counts.Requests)
+			return counts.ConsecutiveFailures >= 3 || (counts.Requests >= 5 && failureRatio >= 0.6)
+		},
+		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+			fmt.Printf("Source %s breaker changed from %s to %s\n", name, from, to)
+		},
+	})
+}
+
+func sourceTimeout(conf SourceConfig) time.Duration {
+	if seconds, ok := conf["timeout_seconds"].(float64); ok && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if configuration.SourceTimeoutSeconds > 0 {
+		return time.Duration(configuration.SourceTimeoutSeconds) * time.Second
+	}
+	return DEFAULT_SOURCE_TIMEOUT_SECONDS * time.Second
+}
+
+func (si *SourceInstance) record(result string, latency time.Duration, err error) {
+	sourceRequestCount.With("source", si.Name, "result", result).Add(1)
+	if result != "rejected" {
+		sourceRequestLatency.With("source", si.Name).Observe(latency.Seconds())
+	}
+
+	h := si.health
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	now := time.Now().Unix()
+	switch result {
+		case "rejected":
+			h.Rejected += 1
+			return
+		case "success":
+			h.Successes += 1
+			h.LastSuccess = now
+		case "timeout":
+			h.Timeouts += 1
+			h.LastFailure = now
+			h.LastError = err.Error()
+		default:
+			h.Failures += 1
+			h.LastFailure = now
+			h.LastError = err.Error()
+	}
+	h.Requests += 1
+	latency_ms := latency.Nanoseconds() / int64(time.Millisecond)
+	h.LastLatencyMs = latency_ms
+	if h.Requests == 1 {
+		h.AvgLatencyMs = float64(latency_ms)
+	} else {
+		h.AvgLatencyMs += SOURCE_LATENCY_SMOOTHING * (float64(latency_ms) - h.AvgLatencyMs)
+	}
+}
+
+// execute runs a search through the instance's circuit breaker, giving up
+// once its deadline passes. A search that times out keeps running in the
+// background but its results are discarded.
+func (si *SourceInstance) execute(opts map[string]interface{}) ([]ItemSource, error) {
+	begin := time.Now()
+	res, err := si.breaker.Execute(func() (interface{}, error) {
+		type searchResult struct {
+			sources []ItemSource
+			err error
+		}
+		done := make(chan searchResult, 1)
+		go func() {
+			found, err := si.search(opts)
+			done <- searchResult{found, err}
+		}()
+		select {
+			case on := <-done:
+				return on.sources, on.err
+			case <-time.After(si.Timeout):
+				return nil, ErrSourceTimeout
+		}
+	})
+	latency := time.Since(begin)
+
+	switch {
+		case err == gobreaker.ErrOpenState || err == gobreaker.ErrTooManyRequests:
+			si.record("rejected", latency, err)
+		case err == ErrSourceTimeout:
+			si.record("timeout", latency, err)
+		case err != nil:
+			si.record("failure", latency, err)
+		default:
+			si.record("success", latency, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	found, _ := res.([]ItemSource)
+	return found, nil
+}
+
+func (si *SourceInstance) Health() map[string]interface{} {
+	si.health.lock.Lock()
+	health := *si.health
+	si.health.lock.Unlock()
+	health.lock = nil
+	ret := map[string]interface{}{
+		"name": si.Name,
+		"type": si.Type,
+		"enabled": si.Enabled,
+		"breaker": si.breaker.State().String(),
+		"timeout_seconds": si.Timeout.Seconds(),
+		"stats": health,
+	}
+
+	/* Routes appear once the source has made its first request */
+	if mirrored, ok := si.Source.(interface{ MirrorStatus() []mirrorRoute }); ok {
+		ret["mirrors"] = mirrored.MirrorStatus()
+	}
+	return ret
+}
+
+func GetSourceHealth() []map[string]interface{} {
+	ret := make([]map[string]interface{}, 0)
+	for _, si := range sourceInstances {
+		ret = append(ret, si.Health())
+	}
+	return ret
+}
+
+func sourceHealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sources": GetSourceHealth(),
+	})
+}
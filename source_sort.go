@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var sizePattern = regexp.MustCompile(`(?i)([0-9]+(?:[.,][0-9]+)?)\s*([kmgt]i?b|b|bytes)`)
+
+var sizeUnits = map[string]float64{
+	"b": 1, "bytes": 1,
+	"kb": 1e3, "mb": 1e6, "gb": 1e9, "tb": 1e12,
+	"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30, "tib": 1 << 40,
+}
+
+// ParseSize turns a humanized size such as "1.37 GiB" or "700 MB" into bytes.
+func ParseSize(size string) (int64, error) {
+	m := sizePattern.FindStringSubmatch(strings.Replace(size, "&nbsp;", " ", -1))
+	if m == nil {
+		return 0, errors.New(fmt.Sprintf("Could not parse size \"%s\"", size))
+	}
+	value, err := strconv.ParseFloat(strings.Replace(m[1], ",", ".", 1), 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(value * sizeUnits[strings.ToLower(m[2])]), nil
+}
+
+/* Rank of each quality when sorting, higher is better */
+var qualityRank = map[string]int{
+	"SD": 1,
+	"720p": 2,
+	"HD": 3,
+	"3D": 3,
+	"1080p": 4,
+	"2160p": 5,
+	"4K": 5,
+}
+
+/* Leading minute count of an OMDb runtime like "142 min" */
+func runtimeMinutes(item map[string]interface{}) int {
+	runtime, _ := item["runtime"].(string)
+	fields := strings.Fields(runtime)
+	if len(fields) == 0 {
+		return 0
+	}
+	minutes, _ := strconv.Atoi(fields[0])
+	return minutes
+}
+
+// annotateBitrates estimates the average bitrate of every source of a
+// resolved item from its size and the item's runtime.
+func annotateBitrates(item map[string]interface{}, sources []ItemSource) {
+	minutes := runtimeMinutes(item)
+	if minutes <= 0 {
+		return
+	}
+	for idx := range sources {
+		on := &sources[idx]
+		if on.SizeBytes <= 0 || (on.TV != nil && on.TV.Episode >= FULL_SEASON_EPISODE) {
+			continue
+		}
+		on.BitrateKbps = int(on.SizeBytes * 8 / int64(minutes * 60) / 1000)
+	}
+}
+
+func optInt64(opts map[string]interface{}, key string) (int64, bool) {
+	switch v := opts[key].(type) {
+		case float64:
+			return int64(v), true
+		case int:
+			return int64(v), true
+		case string:
+			parsed, err := strconv.ParseInt(v, 10, 64)
+			return parsed, err == nil
+	}
+	return 0, false
+}
+
+func optStrings(opts map[string]interface{}, key string) []string {
+	switch v := opts[key].(type) {
+		case string:
+			if len(v) > 0 {
+				return strings.Split(v, ",")
+			}
+		case []interface{}:
+			ret := make([]string, 0)
+			for _, elem := range v {
+				if str, ok := elem.(string); ok {
+					ret = append(ret, str)
+				}
+			}
+			return ret
+	}
+	return nil
+}
+
+// SortAndFilterSources applies the source options of a search request:
+// "min_size"/"max_size" in bytes, "min_seeds", "quality" (one or a list),
+// "max_age_days", "hide_blocked" for sources whose inspection ruled them
+// out, and "sort" by "size", "seeds", "quality" or "age" with "order" "asc"
+// or "desc" (the default, largest/best/newest first). Sources inspected
+// before carry their flags.
+func SortAndFilterSources(sources []ItemSource, opts map[string]interface{}) []ItemSource {
+	min_size, has_min_size := optInt64(opts, "min_size")
+	max_size, has_max_size := optInt64(opts, "max_size")
+	min_seeds, has_min_seeds := optInt64(opts, "min_seeds")
+	max_age_days, has_max_age := optInt64(opts, "max_age_days")
+	qualities := make(map[string]bool)
+	for _, quality := range optStrings(opts, "quality") {
+		qualities[strings.TrimSpace(quality)] = true
+	}
+	oldest := time.Now().Add(-time.Duration(max_age_days) * 24 * time.Hour).Unix()
+	hide_blocked, _ := opts["hide_blocked"].(bool)
+
+	/* Filter, keeping sources whose size or age is unknown unless that is filtered on */
+	ret := make([]ItemSource, 0, len(sources))
+	for _, on := range sources {
+		if has_min_size && on.SizeBytes < min_size {
+			continue
+		}
+		if has_max_size && (on.SizeBytes <= 0 || on.SizeBytes > max_size) {
+			continue
+		}
+		if has_min_seeds && int64(on.SourceCount) < min_seeds {
+			continue
+		}
+		if has_max_age && (on.UploadedAt <= 0 || on.UploadedAt < oldest) {
+			continue
+		}
+		if len(qualities) > 0 && !qualities[on.Quality] {
+			continue
+		}
+		if annotateInspection(&on); hide_blocked && on.Blocked {
+			continue
+		}
+		ret = append(ret, on)
+	}
+
+	/* Sort */
+	var less func(a, b ItemSource) bool
+	switch sort_key, _ := opts["sort"].(string); sort_key {
+		case "size":
+			less = func(a, b ItemSource) bool { return a.SizeBytes < b.SizeBytes }
+		case "seeds":
+			less = func(a, b ItemSource) bool { return a.SourceCount < b.SourceCount }
+		case "quality":
+			less = func(a, b ItemSource) bool { return qualityRank[a.Quality] < qualityRank[b.Quality] }
+		case "age":
+			less = func(a, b ItemSource) bool { return a.UploadedAt < b.UploadedAt }
+		default:
+			return ret
+	}
+	ascending := opts["order"] == "asc"
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ascending {
+			return less(ret[i], ret[j])
+		}
+		return less(ret[j], ret[i])
+	})
+	return ret
+}
@@ -3,16 +3,16 @@ package main
 import (
 	"time"
 	"fmt"
-	"io/ioutil"
 	"net/url"
 	"strconv"
 	"encoding/json"
 	"errors"
 	"strings"
 	"math"
-	"net/http"
+	"sync"
 
 	"github.com/mitchellh/mapstructure"
+	"github.com/sony/gobreaker"
 )
 
 type ItemSourceTV struct {
@@ -24,17 +24,27 @@ type ItemSource struct {
 	ImdbCode string `json:"imdb_code"` // IMDb code of sourced item
 	Quality string `json:"quality"` // 3D, 720p, etc.
 	Size string `json:"size"` // humanized size string
+	SizeBytes int64 `json:"size_bytes"` // size in bytes, 0 if unknown
+	BitrateKbps int `json:"bitrate_kbps,omitempty"` // estimated from the item's runtime
+	UploadedAt int64 `json:"uploaded_at,omitempty"` // unix timestamp of the upload, if known
 	Filename string `json:"filename"` // name of file
 	Url string `json:"url"` // file URL
 	SourceCount int `json:"sources"` // file source count
 	ClientCount int `json:"clients"` // file client count
 	SourceHostname string `json:"source"` // source hostname
 	TV *ItemSourceTV `json:"tv,omitempty"` // TV information, if applicable
+	Release ReleaseInfo `json:"release"` // details parsed from the release name
+	InfoHash string `json:"info_hash,omitempty"` // BitTorrent info hash, if known
+	Origins []string `json:"origins,omitempty"` // hostnames of every source listing this file
+	FetchedAt int64 `json:"fetched_at,omitempty"` // unix timestamp of the search that found it
+	Flags []string `json:"flags,omitempty"` // problems found by inspecting its contents
+	Blocked bool `json:"blocked,omitempty"` // whether those problems rule it out
 }
 
 type SourceApiStorage struct {
 	Token string `json:"token"`
-	ExpiryTime time.Time
+	ExpiresIn float64 `json:"expires_in"` // seconds, if the server says
+	ExpiryTime time.Time `json:"-"`
 }
 
 type SourceA struct {
@@ -45,6 +55,8 @@ type SourceA struct {
 	SourceApiSourceKey string `mapstructure:"source_key"`
 	SourceApiClientKey string `mapstructure:"client_key"`
 	SourceApiHostname string `mapstructure:"hostname"`
+
+	tokens sourceTokenStore
 }
 
 type SourceB struct {
@@ -54,6 +66,7 @@ type SourceB struct {
 	LinkStartKeyword string `mapstructure:"link_start_keyword"`
 	ValidityCheckKeywords []interface{} `mapstructure:"validity_check_keywords"`
 	SourceApiHostname string `mapstructure:"hostname"`
+	Mirrored `mapstructure:",squash"`
 }
 
 type SourceC struct {
@@ -64,62 +77,115 @@ type SourceC struct {
 	SourceApiHostname string `mapstructure:"hostname"`
 	UriStart string `mapstructure:"uri_start"`
 	UriTr []interface{} `mapstructure:"uri_tr"`
+	Mirrored `mapstructure:",squash"`
 }
 
-var sourceApiStorage SourceApiStorage
+const (
+	SOURCE_TOKEN_LIFETIME = 15 * time.Minute /* when the server does not say */
+	SOURCE_TOKEN_MARGIN = 10 * time.Second
+)
+
+// sourceTokenStore keeps the API token of one source. Concurrent searches
+// share a single refresh, and a token the server rejected is dropped so the
+// next request authenticates again.
+type sourceTokenStore struct {
+	lock sync.Mutex
+	current SourceApiStorage
+	refreshing chan struct{} /* closed once the refresh in flight is done */
+	refresh_err error
+}
 
-func getTokenIfNecessary(configuration SourceA) (string, error) {
-	/* Check cached token for validity, and return if valid */
-	expiry_time := sourceApiStorage.ExpiryTime
-	if !expiry_time.IsZero() && (expiry_time.Sub(time.Now().Local()) >= (time.Duration(10) * time.Second)) {
-		return sourceApiStorage.Token, nil
+func (store *sourceTokenStore) Token(fetch func() (SourceApiStorage, error)) (string, error) {
+	store.lock.Lock()
+	for {
+		/* Check cached token for validity, and return if valid */
+		expiry_time := store.current.ExpiryTime
+		if len(store.current.Token) > 0 && expiry_time.Sub(time.Now()) >= SOURCE_TOKEN_MARGIN {
+			token := store.current.Token
+			store.lock.Unlock()
+			return token, nil
+		}
+
+		/* Someone else is already acquiring one, so wait for theirs */
+		if store.refreshing == nil {
+			break
+		}
+		waiting := store.refreshing
+		store.lock.Unlock()
+		<-waiting
+		store.lock.Lock()
+		if err := store.refresh_err; err != nil {
+			store.lock.Unlock()
+			return "", err
+		}
 	}
+	done := make(chan struct{})
+	store.refreshing = done
+	store.lock.Unlock()
 
 	/* Otherwise, acquire a new token */
+	got, err := fetch()
+	store.lock.Lock()
+	store.refresh_err = err
+	if err == nil {
+		store.current = got
+	}
+	store.refreshing = nil
+	close(done)
+	store.lock.Unlock()
+	return got.Token, err
+}
+
+// Invalidate drops token if it is still the current one, so that requests
+// failing with the same stale token only trigger one refresh.
+func (store *sourceTokenStore) Invalidate(token string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.current.Token == token {
+		store.current = SourceApiStorage{}
+	}
+}
+
+func (src *SourceA) fetchToken() (SourceApiStorage, error) {
 	target_url := fmt.Sprintf(
 		"%s?app_id=%s&get_token=get_token",
-		configuration.SourceApiBaseUrl,
-		configuration.SourceApiClientId,
+		src.SourceApiBaseUrl,
+		src.SourceApiClientId,
 	)
 	res, err := netClient.Get(
 		target_url,
 	)
 	if err != nil {
 		fmt.Println("Error:", err)
-		return "", err
+		return SourceApiStorage{}, err
 	}
 	defer res.Body.Close()
 
 	/* Parse the response */
 	var got SourceApiStorage
-	json.NewDecoder(res.Body).Decode(&got)
-
-	/* Cache parsed response */
-	sourceApiStorage.Token = got.Token
-	sourceApiStorage.ExpiryTime = time.Now().Local().Add(15 * time.Minute)
-
-	/* Return parsed response */
-	return got.Token, nil
-}
-
-func detectTitleQuality(title string) (string, error) {
-	qualityTitleMap := map[string]string {
-		"720": "720p",
-		"1080": "1080p",
-		"3D": "3D",
-		"TV HD": "HD",
+	if err = json.NewDecoder(res.Body).Decode(&got); err != nil {
+		return SourceApiStorage{}, err
 	}
-	for _, elem := range configuration.TitleQualityHDKeywords {
-		qualityTitleMap[elem] = "HD"
+	if len(got.Token) == 0 {
+		return SourceApiStorage{}, errors.New(fmt.Sprintf("%s returned no token", src.SourceApiHostname))
 	}
 
-	for k, v := range qualityTitleMap {
-		if strings.Contains(title, k) {
-			return v, nil
-		}
+	/* Honor the lifetime the server gives, if any */
+	lifetime := SOURCE_TOKEN_LIFETIME
+	if got.ExpiresIn > 0 {
+		lifetime = time.Duration(got.ExpiresIn * float64(time.Second))
 	}
+	got.ExpiryTime = time.Now().Add(lifetime)
+	return got, nil
+}
 
-	return "", errors.New("Could not detect quality")
+/* Error responses that mean the token expired or was never valid */
+func isTokenError(got map[string]interface{}) bool {
+	if code, ok := got["error_code"].(float64); ok && (code == 1 || code == 2 || code == 4) {
+		return true
+	}
+	message, _ := got["error"].(string)
+	return strings.Contains(strings.ToLower(message), "token")
 }
 
 func BytesToSize(bytes float64) (string) {
@@ -128,357 +194,614 @@ func BytesToSize(bytes float64) (string) {
 	return fmt.Sprintf("%.2f %s", (bytes / math.Pow(1024, i)), prefixArr[int(i)])
 }
 
-var sources = []func(map[string]interface{}, SourceConfig) ([]ItemSource, error){
-	func (opts map[string]interface{}, conf SourceConfig) (ret []ItemSource, err error) {
-		var configuration SourceA
-		if err := mapstructure.Decode(conf, &configuration); err != nil {
-			return nil, err
+/* Upload dates as SourceB shows them: "03-14 2019", "03-14 12:30" this year, "Today 12:30" or "Y-day 12:30" */
+func parseUploadDate(uploaded string) int64 {
+	now := time.Now()
+	uploaded = strings.TrimSpace(uploaded)
+	if parsed, err := time.Parse("01-02 2006", uploaded); err == nil {
+		return parsed.Unix()
+	}
+	if parsed, err := time.Parse("01-02 15:04", uploaded); err == nil {
+		return parsed.AddDate(now.Year(), 0, 0).Unix()
+	}
+	for prefix, days_ago := range map[string]int{"Today ": 0, "Y-day ": 1} {
+		if !strings.HasPrefix(uploaded, prefix) {
+			continue
+		}
+		if parsed, err := time.Parse("15:04", strings.TrimPrefix(uploaded, prefix)); err == nil {
+			day := now.AddDate(0, 0, -days_ago)
+			return time.Date(day.Year(), day.Month(), day.Day(), parsed.Hour(), parsed.Minute(), 0, 0, time.UTC).Unix()
 		}
-		ret = make([]ItemSource, 0)
+	}
+	return 0
+}
+
+// matchReleaseImdb finds the IMDb id of a release from the title and year in
+// its name, remembering the answer for a day. Finding none may just mean the
+// lookup failed, so that is only remembered for a few minutes.
+func matchReleaseImdb(release ReleaseInfo) string {
+	if len(release.Title) == 0 {
+		return ""
+	}
+	item_type := "movie"
+	if release.TV != nil {
+		item_type = "show"
+	}
+	key := []byte(fmt.Sprintf("%s%s|%d|%s", TITLE_KEY_ID, strings.ToLower(release.Title), release.Year, item_type))
+	if cached, err := cache.Get(key); err == nil {
+		return string(cached)
+	}
+	imdb_id, _ := lookupImdbByTitle(release.Title, release.Year, item_type)
+	if len(imdb_id) == 0 {
+		cache.Set(key, []byte(imdb_id), /*10 minutes=*/10 * 60)
+	} else {
+		cache.Set(key, []byte(imdb_id), /*24 hours=*/24 * 60 * 60)
+	}
+	return imdb_id
+}
+
+type SourceCapabilities struct {
+	Keyword bool `json:"keyword"` // can search by free-text keyword
+	Imdb bool `json:"imdb"` // can search by IMDb id
+	TV bool `json:"tv"` // returns TV episodes
+}
+
+// Source searches a single configured site for releases of an item.
+type Source interface {
+	Capabilities() SourceCapabilities
+	Search(opts map[string]interface{}) ([]ItemSource, error)
+}
+
+type SourceInstance struct {
+	Name string `json:"name"` // unique instance name, defaults to type and position
+	Type string `json:"type"`
+	Enabled bool `json:"enabled"`
+	Capabilities SourceCapabilities `json:"capabilities"`
+	Timeout time.Duration `json:"-"`
+	Config SourceConfig `json:"-"`
+	Source Source `json:"-"`
+	breaker *gobreaker.CircuitBreaker
+	health *SourceHealth
+}
+
+/* Source types by the name used in each config entry's "type" field */
+var sourceTypes = map[string]func(SourceConfig) (Source, error){
+	"source_a": func(conf SourceConfig) (Source, error) {
+		src := &SourceA{}
+		err := mapstructure.Decode(conf, src)
+		return src, err
+	},
+	"source_b": func(conf SourceConfig) (Source, error) {
+		src := &SourceB{}
+		err := mapstructure.Decode(conf, src)
+		return src, err
+	},
+	"source_c": func(conf SourceConfig) (Source, error) {
+		src := &SourceC{}
+		err := mapstructure.Decode(conf, src)
+		return src, err
+	},
+	"scraper": func(conf SourceConfig) (Source, error) {
+		src := &ScrapeSource{}
+		err := mapstructure.Decode(conf, src)
+		return src, err
+	},
+	"torznab": func(conf SourceConfig) (Source, error) {
+		src := &TorznabSource{}
+		err := mapstructure.Decode(conf, src)
+		return src, err
+	},
+	"newznab": func(conf SourceConfig) (Source, error) {
+		src := &TorznabSource{}
+		err := mapstructure.Decode(conf, src)
+		return src, err
+	},
+}
+
+/* Types assumed for config entries without a "type", by position, as sources used to be matched */
+var legacySourceTypes = []string{"source_a", "source_b", "source_c"}
+
+func (src *SourceA) Capabilities() SourceCapabilities {
+	return SourceCapabilities{Keyword: true, Imdb: true, TV: true}
+}
+
+func (src *SourceB) Capabilities() SourceCapabilities {
+	return SourceCapabilities{Keyword: true, Imdb: true, TV: false}
+}
 
-		/* Generate search parameters */
-		token, err := getTokenIfNecessary(configuration)
+func (src *SourceC) Capabilities() SourceCapabilities {
+	return SourceCapabilities{Keyword: true, Imdb: true, TV: false}
+}
+
+var sourceInstances []*SourceInstance
+
+// LoadSources instantiates every configured source through the type registry.
+func LoadSources() (error) {
+	instances := make([]*SourceInstance, 0)
+	names := make(map[string]bool)
+	for idx, conf := range configuration.Sources {
+		source_type, _ := conf["type"].(string)
+		if len(source_type) == 0 && idx < len(legacySourceTypes) {
+			source_type = legacySourceTypes[idx]
+			fmt.Printf("Warning: source %d has no \"type\", assuming \"%s\"\n", idx, source_type)
+		}
+		constructor, ok := sourceTypes[source_type]
+		if !ok {
+			return errors.New(fmt.Sprintf("Unknown type \"%s\" for source %d", source_type, idx))
+		}
+		src, err := constructor(conf)
 		if err != nil {
-			return nil, err
+			return errors.New(fmt.Sprintf("Could not configure source %d: %s", idx, err))
+		}
+
+		name, _ := conf["name"].(string)
+		if len(name) == 0 {
+			name = fmt.Sprintf("%s_%d", source_type, idx)
+		}
+		if names[name] {
+			return errors.New(fmt.Sprintf("Duplicate source name \"%s\"", name))
 		}
-		searchParams := url.Values{
-			"sort": {configuration.SourceApiSortKey},
-			"limit": {strconv.Itoa(configuration.SourceApiResultLimit)},
-			"format": {"json_extended"},
-			"app_id": {configuration.SourceApiClientId},
-			"mode": {"search"},
-			"token": {token},
+		names[name] = true
+		enabled := true
+		if flag, ok := conf["enabled"].(bool); ok {
+			enabled = flag
 		}
-		searchParams.Set("min_" + configuration.SourceApiSortKey, strconv.Itoa(3))
+		instances = append(instances, &SourceInstance{
+			Name: name,
+			Type: source_type,
+			Enabled: enabled,
+			Capabilities: src.Capabilities(),
+			Timeout: sourceTimeout(conf),
+			Config: conf,
+			Source: src,
+			breaker: newSourceBreaker(name),
+			health: &SourceHealth{lock: &sync.Mutex{}},
+		})
+	}
+	sourceInstances = instances
+	return nil
+}
 
-		if imdb_id, ok := opts["id"].(string); ok {
-			searchParams.Set("search_imdb", imdb_id)
-		} else if keyword, ok := opts["keyword"].(string); ok {
-			searchParams.Set("search_string", keyword)
+// Supports reports whether the instance can serve a search with these options.
+func (si *SourceInstance) Supports(opts map[string]interface{}) bool {
+	if !si.Enabled {
+		return false
+	}
+	if _, ok := opts["id"].(string); ok && !si.Capabilities.Imdb {
+		return false
+	}
+	if _, ok := opts["keyword"].(string); ok && !si.Capabilities.Keyword {
+		return false
+	}
+	if is_tv, _ := opts["tv"].(bool); is_tv && !si.Capabilities.TV {
+		return false
+	}
+	return true
+}
+
+func (si *SourceInstance) search(opts map[string]interface{}) (ret []ItemSource, err error) {
+	/* A malformed response must not take down the whole search */
+	defer func() {
+		if r := recover(); r != nil {
+			ret = nil
+			err = errors.New(fmt.Sprintf("Source %s was panicking, recovered value: %v (%s)", si.Name, r, identifyPanic()))
 		}
+	}()
+	found, err := si.Source.Search(opts)
+	return prepareSources(si.Name, found, configStrings(si.Config["trackers"])), err
+}
+
+func (src *SourceA) Search(opts map[string]interface{}) (ret []ItemSource, err error) {
+	ret = make([]ItemSource, 0)
 
-		/* Continue retrying request up to threshold */
-		target_url := fmt.Sprintf("%s?%s", configuration.SourceApiBaseUrl, searchParams.Encode())
+	/* Generate search parameters */
+	searchParams := url.Values{
+		"sort": {src.SourceApiSortKey},
+		"limit": {strconv.Itoa(src.SourceApiResultLimit)},
+		"format": {"json_extended"},
+		"app_id": {src.SourceApiClientId},
+		"mode": {"search"},
+	}
+	searchParams.Set("min_" + src.SourceApiSortKey, strconv.Itoa(3))
+
+	if imdb_id, ok := opts["id"].(string); ok {
+		searchParams.Set("search_imdb", imdb_id)
+	} else if keyword, ok := opts["keyword"].(string); ok {
+		searchParams.Set("search_string", keyword)
+	}
+
+	/* Continue retrying request up to threshold */
+	var results []map[string]interface{}
+
+	for attempt := 1; attempt <= 5; attempt += 1{
+		/* Generate and execute request with a valid token */
+		token, err := src.tokens.Token(src.fetchToken)
+		if err != nil {
+			return nil, err
+		}
+		searchParams.Set("token", token)
+		target_url := fmt.Sprintf("%s?%s", src.SourceApiBaseUrl, searchParams.Encode())
 		fmt.Println(target_url);
-		var results []map[string]interface{}
-
-		for attempt := 1; attempt <= 5; attempt += 1{
-			/* Generate and execute request */
-			res, err := netClient.Get(
-				target_url,
-			)
-			if err != nil {
-				fmt.Println("Error:", err)
-				return nil, err
-			}
-			defer res.Body.Close()
-
-			/* Parse and validate response */
-			var got map[string]interface{}
-			json.NewDecoder(res.Body).Decode(&got)
-			/*
-			pretty_printed, _ := json.MarshalIndent(got, "", "  ")
-			slice_until := int(math.Min(300, float64(len(pretty_printed))))
-			fmt.Println(string(pretty_printed)[0:slice_until])
-			*/
-
-			if error, ok := got["error"]; ok {
-				if strings.Contains(error.(string), "No results found") {
-					return ret, nil
-				}
-				if strings.Contains(error.(string), "Cant find imdb") {
-					return ret, nil
-				}
-				fmt.Println(fmt.Sprintf("Retrying (error %s)", error))
-				time.Sleep(time.Duration(attempt) * time.Second)
-				continue
-			}
+		res, err := netClient.Get(
+			target_url,
+		)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return nil, err
+		}
+		defer res.Body.Close()
 
-			var resultsArr []interface{}
-			for _, v := range got {
-				resultsArr = v.([]interface{}) // first value
-				break
+		/* Parse and validate response */
+		var got map[string]interface{}
+		json.NewDecoder(res.Body).Decode(&got)
+		/*
+		pretty_printed, _ := json.MarshalIndent(got, "", "  ")
+		slice_until := int(math.Min(300, float64(len(pretty_printed))))
+		fmt.Println(string(pretty_printed)[0:slice_until])
+		*/
+
+		if error, ok := got["error"]; ok {
+			if strings.Contains(error.(string), "No results found") {
+				return ret, nil
+			}
+			if strings.Contains(error.(string), "Cant find imdb") {
+				return ret, nil
 			}
-			for _, elem := range resultsArr {
-				results = append(results, elem.(map[string]interface{}))
+			if isTokenError(got) {
+				/* Authenticate again and retry straight away */
+				fmt.Println(fmt.Sprintf("Renewing token (error %s)", error))
+				src.tokens.Invalidate(token)
+				continue
 			}
+			fmt.Println(fmt.Sprintf("Retrying (error %s)", error))
+			time.Sleep(time.Duration(attempt) * time.Second)
+			continue
+		}
 
+		var resultsArr []interface{}
+		for _, v := range got {
+			resultsArr = v.([]interface{}) // first value
 			break
 		}
+		for _, elem := range resultsArr {
+			results = append(results, elem.(map[string]interface{}))
+		}
+
+		break
+	}
+
+	if len(results) == 0 {
+		return nil, errors.New("Could not complete search request!")
+	}
 
-		if len(results) == 0 {
-			return nil, errors.New("Could not complete search request!")
+	/* Convert response to desired format */
+	for _, on := range results {
+		if _, ok := on["episode_info"]; !ok {
+			continue
+		}
+		episode_info, ok := on["episode_info"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if _, ok := episode_info["imdb"]; !ok {
+			continue
 		}
 
-		/* Convert response to desired format */
-		qualityCategoryMap := map[string]string {
-			"720": "720p",
-			"1080": "1080p",
-			"3D": "3D",
-			"TV HD": "HD",
+		category := on["category"].(string)
+		title := on["title"].(string)
+		release := ParseReleaseName(title)
+		quality := release.Quality()
+		if len(quality) == 0 {
+			/* Categories carry the resolution for titles that leave it out */
+			quality = detectQuality(category + " " + title, ParseReleaseName(category))
 		}
-		for _, on := range results {
-			if _, ok := on["episode_info"]; !ok {
-				continue
-			}
-			episode_info, ok := on["episode_info"].(map[string]interface{})
-			if !ok {
-				continue
-			}
-			if _, ok := episode_info["imdb"]; !ok {
-				continue
-			}
 
-			quality, have_quality := "(unknown)", false
-			category := on["category"].(string)
-			title := on["title"].(string)
-			for k, v := range qualityCategoryMap {
-				if strings.Contains(category, k) || strings.Contains(title, k) {
-					have_quality = true
-					quality = v
-					break
-				}
-			}
-			if !have_quality {
-				var tmp_err error
-				quality, tmp_err = detectTitleQuality(title)
-				have_quality = (tmp_err == nil)
-			}
-			if !have_quality {
-				quality = "SD"
-				fmt.Println(fmt.Sprintf(
-					"Warning: Could not detect quality for title %s and category %s",
-					on["title"],
-					on["category"],
-				))
+		humanizedSize := BytesToSize(on["size"].(float64))
+		var uploaded_at int64
+		if pubdate, ok := on["pubdate"].(string); ok {
+			if parsed, err := time.Parse("2006-01-02 15:04:05 -0700", pubdate); err == nil {
+				uploaded_at = parsed.Unix()
 			}
+		}
 
-			humanizedSize := BytesToSize(on["size"].(float64))
-
-			ret = append(ret, ItemSource{
-				ImdbCode: episode_info["imdb"].(string),
-				Quality: quality,
-				Size: humanizedSize,
-				Filename: on["title"].(string),
-				Url: on["download"].(string),
-				SourceCount: int(on[configuration.SourceApiSourceKey].(float64)),
-				ClientCount: int(on[configuration.SourceApiClientKey].(float64)),
-				SourceHostname: configuration.SourceApiHostname,
-			})
-
-			if _, ok := episode_info["seasonnum"]; ok {
-				season_num, _ := strconv.Atoi(episode_info["seasonnum"].(string))
-				ep_num, _ := strconv.Atoi(episode_info["epnum"].(string))
-				ret[len(ret) - 1].TV = &ItemSourceTV{
-					Season: season_num,
-					Episode: ep_num,
-				}
+		ret = append(ret, ItemSource{
+			ImdbCode: episode_info["imdb"].(string),
+			Quality: quality,
+			Size: humanizedSize,
+			SizeBytes: int64(on["size"].(float64)),
+			UploadedAt: uploaded_at,
+			Filename: on["title"].(string),
+			Url: on["download"].(string),
+			SourceCount: int(on[src.SourceApiSourceKey].(float64)),
+			ClientCount: int(on[src.SourceApiClientKey].(float64)),
+			SourceHostname: src.SourceApiHostname,
+			TV: release.TV,
+			Release: release,
+		})
+
+		if _, ok := episode_info["seasonnum"]; ok {
+			season_num, _ := strconv.Atoi(episode_info["seasonnum"].(string))
+			ep_num, _ := strconv.Atoi(episode_info["epnum"].(string))
+			ret[len(ret) - 1].TV = &ItemSourceTV{
+				Season: season_num,
+				Episode: ep_num,
 			}
 		}
+	}
 
-		/* Return converted response */
-		return ret, err
-	},
+	/* Return converted response */
+	return ret, err
+}
 
-	func (opts map[string]interface{}, conf SourceConfig) (ret []ItemSource, err error) {
-		var configuration SourceB
-		if err := mapstructure.Decode(conf, &configuration); err != nil {
-			return nil, err
-		}
-		ret = make([]ItemSource, 0)
+func (src *SourceB) Search(opts map[string]interface{}) (ret []ItemSource, err error) {
+	ret = make([]ItemSource, 0)
 
-		/* Generate url */
-		search_term := ""
-		if imdb_id, ok := opts["id"].(string); ok {
-			search_term = imdb_id
-		} else if _, ok := opts["keyword"].(string); ok {
-			return nil, errors.New("Keyword search is not supported by this source")
-		}
+	/* Generate url */
+	search_term, by_keyword := "", false
+	if imdb_id, ok := opts["id"].(string); ok {
+		search_term = imdb_id
+	} else if keyword, ok := opts["keyword"].(string); ok {
+		search_term, by_keyword = keyword, true
+	}
 
-		form_url := fmt.Sprintf(
-			"%s/s/?q=%s&category=%d&page=%d&orderby=%d",
-			configuration.BaseUrl,
-			search_term,
-			0, /* TODO */
-			configuration.PageNumber,
-			configuration.OrderBy,
-		)
-		fmt.Println(form_url)
+	form_url := fmt.Sprintf(
+		"%s/s/?q=%s&category=%d&page=%d&orderby=%d",
+		src.BaseUrl,
+		url.QueryEscape(search_term),
+		0, /* TODO */
+		src.PageNumber,
+		src.OrderBy,
+	)
+	fmt.Println(form_url)
 
-		// TODO: Race to first parsed response via proxy list
+	/* Download page from the first mirror that serves a result table */
+	bytes, err := src.Get(src.BaseUrl, form_url, func(page []byte) error {
+		if !strings.Contains(string(page), "id=\"searchResult\"") {
+			return errors.New("Could not find search result table")
+		}
+		return nil
+	})
+	if err != nil {
+		return ret, err
+	}
+	body := string(bytes)
 
-		/* Download page */
-		var resp (*http.Response)
-		resp, err = netClient.Get(form_url) // retries are baked in
-		if err != nil {
-			return ret, err
-		}
-		bytes, _ := ioutil.ReadAll(resp.Body)
-		body := string(bytes)
-
-		/* Parse search results */
-		table_arr := strings.Split(body, "id=\"searchResult\"")
-		if len(table_arr) <= 1 {
-			return nil, errors.New("Could not find search result table")
-		}
-		table := strings.Split(table_arr[1], "</table>")[0]
-
-		rows := strings.Split(table, "<tr")[1:]
-		for _, on := range rows {
-			/* Validity check */
-			passed := true
-			for _, itf := range configuration.ValidityCheckKeywords {
-				if kw, ok := itf.(string); ok {
-					/* A string means that the given specific keyword is required */
-					if !strings.Contains(on, kw) {
-						//fmt.Println(fmt.Sprintf("Failed on keyword %s", kw))
-						passed = false
-						break
-					}
-				} else if or_arr, ok := itf.([]string); ok {
-					/* An array means any of the keywords works */
-					or_passed := false
-					for _, kw := range or_arr {
-						if strings.Contains(on, kw) {
-							or_passed = true
-							break
-						}
-					}
-					if !or_passed {
-						passed = false
+	/* Parse search results */
+	table_arr := strings.Split(body, "id=\"searchResult\"")
+	if len(table_arr) <= 1 {
+		return nil, errors.New("Could not find search result table")
+	}
+	table := strings.Split(table_arr[1], "</table>")[0]
+
+	rows := strings.Split(table, "<tr")[1:]
+	for _, on := range rows {
+		/* Validity check */
+		passed := true
+		for _, itf := range src.ValidityCheckKeywords {
+			if kw, ok := itf.(string); ok {
+				/* A string means that the given specific keyword is required */
+				if !strings.Contains(on, kw) {
+					//fmt.Println(fmt.Sprintf("Failed on keyword %s", kw))
+					passed = false
+					break
+				}
+			} else if or_arr, ok := itf.([]string); ok {
+				/* An array means any of the keywords works */
+				or_passed := false
+				for _, kw := range or_arr {
+					if strings.Contains(on, kw) {
+						or_passed = true
 						break
 					}
 				}
+				if !or_passed {
+					passed = false
+					break
+				}
 			}
-			if !passed {
-				continue
-			}
-
-			link := strings.Split(strings.Split(on, configuration.LinkStartKeyword)[1], "\"")[0]
-			link = configuration.LinkStartKeyword + link
+		}
+		if !passed {
+			continue
+		}
 
-			size := strings.Split(strings.Split(on, ", Size ")[1], ",")[0]
-			size = strings.Replace(size, "&nbsp;", " ", -1)
+		link := strings.Split(strings.Split(on, src.LinkStartKeyword)[1], "\"")[0]
+		link = src.LinkStartKeyword + link
 
-			filename := strings.Split(strings.Split(on, "detName\">")[1], "\">")[1]
-			filename = strings.Split(filename, "</a>")[0]
+		size := strings.Split(strings.Split(on, ", Size ")[1], ",")[0]
+		size = strings.Replace(size, "&nbsp;", " ", -1)
+		size_bytes, _ := ParseSize(size)
+		var uploaded_at int64
+		if strings.Contains(on, "Uploaded ") {
+			uploaded := strings.Split(strings.Split(on, "Uploaded ")[1], ",")[0]
+			uploaded_at = parseUploadDate(strings.Replace(uploaded, "&nbsp;", " ", -1))
+		}
 
-			quality, ok := detectTitleQuality(filename)
-			if ok != nil {
-				quality = "SD"
-			}
+		filename := strings.Split(strings.Split(on, "detName\">")[1], "\">")[1]
+		filename = strings.Split(filename, "</a>")[0]
 
-			counts_area := strings.SplitN(on, "td align=\"right\">", 2)
-			counts_area = strings.Split(counts_area[1], "\"right\">")
-			source_count, _ := strconv.Atoi(strings.Split(counts_area[0], "</td>")[0])
-			clients_count, _ := strconv.Atoi(strings.Split(counts_area[1], "</td>")[0])
+		release := ParseReleaseName(filename)
 
-			ret = append(ret, ItemSource{
-				ImdbCode: search_term,
-				Quality: quality,
-				Size: size,
-				Filename: filename,
-				Url: link,
-				SourceCount: source_count,
-				ClientCount: clients_count,
-				SourceHostname: configuration.SourceApiHostname,
-			})
+		/* Rows carry no IMDb id, so keyword results are matched by title and year */
+		imdb_code := search_term
+		if by_keyword {
+			if imdb_code = matchReleaseImdb(release); len(imdb_code) == 0 {
+				continue
+			}
 		}
 
-		return ret, err
-	},
+		counts_area := strings.SplitN(on, "td align=\"right\">", 2)
+		counts_area = strings.Split(counts_area[1], "\"right\">")
+		source_count, _ := strconv.Atoi(strings.Split(counts_area[0], "</td>")[0])
+		clients_count, _ := strconv.Atoi(strings.Split(counts_area[1], "</td>")[0])
+
+		ret = append(ret, ItemSource{
+			ImdbCode: imdb_code,
+			Quality: detectQuality(filename, release),
+			Size: size,
+			SizeBytes: size_bytes,
+			UploadedAt: uploaded_at,
+			Filename: filename,
+			Url: link,
+			SourceCount: source_count,
+			ClientCount: clients_count,
+			SourceHostname: src.SourceApiHostname,
+			TV: release.TV,
+			Release: release,
+		})
+	}
 
-	func (opts map[string]interface{}, conf SourceConfig) (ret []ItemSource, err error) {
-		var configuration SourceC
-		if err := mapstructure.Decode(conf, &configuration); err != nil {
-			return nil, err
-		}
-		ret = make([]ItemSource, 0)
+	return ret, err
+}
 
-		/* Generate url */
-		search_term := ""
-		if imdb_id, ok := opts["id"].(string); ok {
-			search_term = imdb_id
-		} else if _, ok := opts["keyword"].(string); ok {
-			return nil, errors.New("Keyword search is not supported by this source")
-		}
+func (src *SourceC) Search(opts map[string]interface{}) (ret []ItemSource, err error) {
+	ret = make([]ItemSource, 0)
 
-		form_url := fmt.Sprintf(
-			"%s?query_term=%s",
-			configuration.BaseUrl,
-			search_term,
-		)
-		fmt.Println(form_url)
-
-		/* Download page */
-		var resp (*http.Response)
-		for ct := 0;; ct += 1 {
-			resp, err = netClient.Get(form_url)
-			if err != nil {
-				if ct > 5 {
-					return nil, err
-				}
-				continue
+	/* Generate url */
+	search_term, by_keyword := "", false
+	if imdb_id, ok := opts["id"].(string); ok {
+		search_term = imdb_id
+	} else if keyword, ok := opts["keyword"].(string); ok {
+		search_term, by_keyword = keyword, true
+	}
+
+	form_url := fmt.Sprintf(
+		"%s?query_term=%s",
+		src.BaseUrl,
+		url.QueryEscape(search_term),
+	)
+	fmt.Println(form_url)
+
+	/* Download page */
+	var bytes []byte
+	for ct := 0;; ct += 1 {
+		bytes, err = src.Get(src.BaseUrl, form_url, func(page []byte) error {
+			if !strings.Contains(string(page), "\"data\"") {
+				return errors.New("Response carries no data")
 			}
-			break
+			return nil
+		})
+		if err != nil {
+			if ct > 5 {
+				return nil, err
+			}
+			continue
 		}
-		bytes, _ := ioutil.ReadAll(resp.Body)
-		body := string(bytes)
+		break
+	}
+	body := string(bytes)
 
-		var got map[string]interface{}
-		var rows []interface{}
-		json.Unmarshal([]byte(body), &got)
+	var got map[string]interface{}
+	var rows []interface{}
+	json.Unmarshal([]byte(body), &got)
 
-		/* Parse search results */
-		var ok bool
-		got, ok = got["data"].(map[string]interface{})
+	/* Parse search results */
+	var ok bool
+	got, ok = got["data"].(map[string]interface{})
+	if !ok {
+		return nil, err
+	}
+	rows, ok = got["movies"].([]interface{})
+	if !ok {
+		return nil, err
+	}
+
+	/* Movies carry their own IMDb id, so keyword results need no matching */
+	for _, elem := range rows {
+		matched, ok := elem.(map[string]interface{})
 		if !ok {
-			return nil, err
+			continue
 		}
-		rows, ok = got["movies"].([]interface{})
+		imdb_code, _ := matched["imdb_code"].(string)
+		if len(imdb_code) == 0 || (!by_keyword && imdb_code != search_term) {
+			continue
+		}
+		ret = append(ret, src.movieSources(imdb_code, matched)...)
+	}
+
+	return ret, err
+}
+
+func (src *SourceC) movieSources(imdb_code string, matched map[string]interface{}) (ret []ItemSource) {
+	rows, _ := matched[src.SourceLocation].([]interface{})
+	for _, cur := range rows {
+		on, ok := cur.(map[string]interface{})
 		if !ok {
-			return nil, err
+			continue
 		}
 
-		var matched map[string]interface{}
-		for _, on := range rows {
-			if cur, ok := on.(map[string]interface{}); ok && cur["imdb_code"].(string) == search_term {
-				matched = cur
-				break
+		var uri string
+		uri = src.UriStart
+		uri += on["hash"].(string)
+		uri += "&dn=" + url.PathEscape(matched["title"].(string))
+		uri = withTrackers(uri, configStrings(src.UriTr))
+
+		/* No file names here, so describe the release from its fields instead */
+		described := make([]string, 0)
+		for _, key := range []string{"quality", "type", "video_codec", "audio_channels"} {
+			if value, ok := on[key].(string); ok {
+				described = append(described, value)
 			}
 		}
-		if matched == nil {
-			// No match found
-			return ret, err
+		var uploaded_at int64
+		if date, ok := on["date_uploaded_unix"].(float64); ok {
+			uploaded_at = int64(date)
+		}
+		release := ParseReleaseName(strings.Join(described, " "))
+		release.Title, _ = matched["title"].(string)
+		if year, ok := matched["year"].(float64); ok {
+			release.Year = int(year)
 		}
 
-		rows = matched[configuration.SourceLocation].([]interface{})
+		ret = append(ret, ItemSource{
+			ImdbCode: imdb_code,
+			Quality: on["quality"].(string),
+			Size: BytesToSize(on["size_bytes"].(float64)),
+			SizeBytes: int64(on["size_bytes"].(float64)),
+			UploadedAt: uploaded_at,
+			Filename: NO_FILENAME,
+			Url: uri,
+			SourceCount: int(on[src.SourceApiSourceKey].(float64)),
+			ClientCount: int(on[src.SourceApiClientKey].(float64)),
+			SourceHostname: src.SourceApiHostname,
+			Release: release,
+		})
+	}
 
-		for _, cur := range rows {
-			on, ok := cur.(map[string]interface{})
-			if !ok {
-				continue
-			}
+	return ret
+}
 
-			var uri string
-			uri = configuration.UriStart
-			uri += on["hash"].(string)
-			uri += "&dn=" + url.PathEscape(matched["title"].(string))
+// SearchSourcesEach searches every capable source in parallel and calls each
+// with the outcome of every source as soon as it finishes or times out.
+func SearchSourcesEach(opts map[string]interface{}, each func(si *SourceInstance, found []ItemSource, err error)) {
+    /* Only query sources able to handle this kind of search */
+    var selected []*SourceInstance
+    for _, si := range sourceInstances {
+    	if si.Supports(opts) {
+    		selected = append(selected, si)
+    	}
+    }
+    type sourceResult struct {
+    	si *SourceInstance
+    	found []ItemSource
+    	err error
+    }
+    parsed := make(chan sourceResult, len(selected))
 
-			ret = append(ret, ItemSource{
-				ImdbCode: search_term,
-				Quality: on["quality"].(string),
-				Size: BytesToSize(on["size_bytes"].(float64)),
-				Filename: "(no filename available)",
-				Url: uri,
-				SourceCount: int(on[configuration.SourceApiSourceKey].(float64)),
-				ClientCount: int(on[configuration.SourceApiClientKey].(float64)),
-				SourceHostname: configuration.SourceApiHostname,
-			})
-		}
+    /* Search sources in parallel */
+    for _, si := range selected {
+    	go func(si *SourceInstance) {
+    		fmt.Println("Searching source:", si.Name)
+    		res, err := si.execute(opts)
+    		parsed <- sourceResult{si, res, err}
+    		fmt.Println("Done searching source:", si.Name)
+    	} (si)
+    }
 
-		return ret, err
-	},
+    /* Hand results over in the order sources finish */
+    for count := 0; count < len(selected); count++ {
+    	on := <- parsed
+    	each(on.si, on.found, on.err)
+    }
 }
 
 func SearchSourcesParallel(opts map[string]interface{}) (ret []ItemSource, err error) {
@@ -488,50 +811,24 @@ func SearchSourcesParallel(opts map[string]interface{}) (ret []ItemSource, err e
         }
     }()
     err = nil
-    parsed := make(chan []ItemSource, len(sources))
 
-    /* Search sources in parallel */
-    source_idx := 0
-    for _, fn := range sources {
-    	go func(fn func(map[string]interface{}, SourceConfig) ([]ItemSource, error), conf SourceConfig, source_idx int) {
-    		fmt.Println("Searching host:", source_idx)
-    		res, ok := fn(opts, conf)
-    		if ok != nil {
-    			fmt.Println("Warning:", ok)
-    			parsed <- nil
-    		} else {
-    			parsed <- res
-    		}
-    		fmt.Println("Done searching host:", source_idx)
-    	} (fn, configuration.Sources[source_idx], source_idx)
-    	source_idx += 1
-    }
-
-    /* Populate result array from channel */
-    count := 0
-    for ; count < len(sources); {
-    	on := <- parsed
-    	count += 1
-    	if on != nil {
-    		ret = append(ret, on...)
+    /* Slow or failing sources only cost their own results */
+    SearchSourcesEach(opts, func(si *SourceInstance, found []ItemSource, ok error) {
+    	if ok != nil {
+    		fmt.Printf("Warning: source %s: %s\n", si.Name, ok)
+    		return
     	}
-    }
+    	ret = append(ret, found...)
+    })
 
-    /* Return result */
-    return ret, err
+    /* The same torrent is often listed on several sites */
+    return MergeSources(ret), err
 }
 
-
-
-
-
-
-
-
-
-
-
-
-
-
-
+func GetSources() []SourceInstance {
+	ret := make([]SourceInstance, 0)
+	for _, si := range sourceInstances {
+		ret = append(ret, *si)
+	}
+	return ret
+}
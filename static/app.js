@@ -132,7 +132,7 @@ function getWatched() {
 			} else {
 				swal({
 					title: "Trakt Token",
-					text: "Trakt API token is outdated.",
+					text: "Trakt API token is outdated. Use the login button to reauthorize.",
 					icon: "warning",
 					timer: 2500,
 					buttons: false
@@ -156,6 +156,24 @@ function getScrobbles() {
 	});
 }
 
+function traktLoginStart() {
+	return new Promise((resolve, reject) => {
+		apiReq("traktLoginStart", {
+		}, function(data) {
+			resolve(data);
+		});
+	});
+}
+
+function traktLoginStatus() {
+	return new Promise((resolve, reject) => {
+		apiReq("traktLoginStatus", {
+		}, function(data) {
+			resolve(data);
+		});
+	});
+}
+
 function startAirplay(info) {
 	return new Promise((resolve, reject) => {
 		apiReq("startAirplayPlayback", {
@@ -208,10 +226,46 @@ function searchForItem(keyword) {
 	});
 }
 
-function lookupItem(imdb_id) {
+// Streams search progress from the server, calling onEvent with each "sources",
+// "item" and "done" event as it arrives; resolves with the summary event.
+function streamSearch(params, onEvent) {
+	return fetch("/search/stream?" + $.param(params)).then((res) => {
+		var reader = res.body.getReader();
+		var decoder = new TextDecoder();
+		var buffered = "";
+		var summary = null;
+		var pump = () => reader.read().then((chunk) => {
+			if(chunk.done) return summary;
+			buffered += decoder.decode(chunk.value, {stream: true});
+			var lines = buffered.split("\n");
+			buffered = lines.pop();
+			lines.filter((line) => line.length).forEach((line) => {
+				var event = JSON.parse(line);
+				if(event.event === "done") summary = event;
+				onEvent(event);
+			});
+			return pump();
+		});
+		return pump();
+	});
+}
+
+function selectBestSource(imdb_id, profile) {
+	return new Promise((resolve, reject) => {
+		apiReq("selectBestSource", {
+			"id": imdb_id,
+			"profile": profile || ""
+		}, function(data) {
+			resolve(data.selection);
+		});
+	});
+}
+
+function lookupItem(imdb_id, refresh) {
 	return new Promise((resolve, reject) => {
 		apiReq("itemLookup", {
-			"id": imdb_id
+			"id": imdb_id,
+			"refresh": !!refresh
 		}, function(data) {
 			resolve(data);
 		});
@@ -241,17 +295,79 @@ function resolveParallel(ids) {
 	});
 }
 
-function fetchItem(info) {
+function fetchItem(info, force) {
 	return new Promise((resolve, reject) => {
 		apiReq("fetchUri", {
 			"uri": info.uri,
-			"imdb_id": info.imdb_code
+			"imdb_id": info.imdb_code,
+			"force": !!force
 		}, function(data) {
 			resolve(data);
 		});
 	});
 }
 
+function inspectSource(uri) {
+	return new Promise((resolve, reject) => {
+		apiReq("inspectSource", {
+			"uri": uri
+		}, function(data) {
+			resolve(data.inspection);
+		});
+	});
+}
+
+// Send a selected source to the cloud downloader and report the outcome.
+function fetchSelected(info, force) {
+	fetchItem(info, force).then((data) => {
+		console.log("fetch result:", data);
+		$('.loader').hide();
+		if(data.blocked){
+			// Inspection found the contents suspicious; let the user decide.
+			var details = data.inspection.flags.filter((x) => x.blocks).map((x) => x.detail);
+			swal({
+				title: "Suspicious contents",
+				text: details.join("\n"),
+				icon: "warning",
+				buttons: ["Cancel", "Download anyway"],
+				dangerMode: true
+			}).then((confirmed) => {
+				if(confirmed){
+					$('.loader').show();
+					fetchSelected(info, true);
+				}
+			});
+		} else if(data.result !== true){
+			if(!data.enqueued){
+				swal({
+					title: "Unable to download item",
+					text: (data.not_enough_space ? "Not enough space available in cloud" : data.result),
+					icon: "error"
+				});
+			} else {
+				swal({
+					title: "Item queued",
+					text: "Added to queue",
+					icon: "success",
+					buttons: false,
+					timer: 3000
+				});
+			}
+		} else {
+			swal({
+				title: "Download has begun",
+				text: "Successfully began download.",
+				icon: "success",
+				buttons: false,
+				timer: 3000
+			}).then(() => {
+				window.history.pushState(null, null, '#view_downloads');
+				$(window).trigger('hashchange');
+			});
+		}
+	});
+}
+
 function associateItem(info) {
 	return new Promise((resolve, reject) => {
 		apiReq("associateDownload", {
@@ -329,6 +445,40 @@ function iCloudStreamUrl(cloud_id) {
 	});
 }
 
+function getPerson(person_id, name) {
+	return new Promise((resolve, reject) => {
+		apiReq("getPerson", {
+			"id": person_id,
+			"name": name
+		}, function(data) {
+			resolve(data);
+		});
+	});
+}
+
+function searchByPerson(query, role, scope) {
+	return new Promise((resolve, reject) => {
+		apiReq("searchByPerson", {
+			"query": query,
+			"role": role,
+			"scope": scope
+		}, function(data) {
+			resolve(data);
+		});
+	});
+}
+
+function getSubtitles(imdb_id, cloud_id) {
+	return new Promise((resolve, reject) => {
+		apiReq("getSubtitles", {
+			"imdb_id": imdb_id,
+			"id": cloud_id
+		}, function(data) {
+			resolve(data);
+		});
+	});
+}
+
 function getAssociatedDownloads() {
 	return new Promise((resolve, reject) => {
 		apiReq("getAssociatedDownloads", {}, function(data) {
@@ -631,7 +781,8 @@ $(function () {
 				//console.log(cur, highlighted);
 				var img_div = $('<div class="item active"></div>');
 				if(i > 0) img_div.removeClass("active");
-				img_div.append($('<img class="carousel_img" src="' + cur.cover_image + '" alt="' + cur.title + '" />'));
+				var carousel_img = cur.cover_images ? cur.cover_images.full : cur.cover_image;
+				img_div.append($('<img class="carousel_img" src="' + carousel_img + '" alt="' + cur.title + '" />'));
 				var cap = $('<div class="carousel-caption"></div>');
 				cap.append($('<div class="carousel-title"><h3 style="font-size: 2vw; display: inline;">' + cur.title + '</h3>&nbsp;&nbsp;&nbsp;<p class="rating-box">' + (cur.mpaa_rating || "NR") + '</p></div>'));
 				cap.append($(retrieveRatingMarkup(cur.imdb_rating * 10.0)));
@@ -831,7 +982,7 @@ $(function () {
 		if(hash === "watch"){
 			var imdb_id = params.id;
 			$('.loader').show();
-			lookupItem(imdb_id).then((on) => {
+			lookupItem(imdb_id, params.refresh === "1").then((on) => {
 				console.log(on);
 				$('.loader').hide();
 				currentItem = on;
@@ -865,7 +1016,38 @@ $(function () {
 			// customRefreshMessage = "Successfully executed search on server.";
 			// customRefreshTimer = 1000;
 			setTimeout(() => {
-				populateGrid((limit) => searchForItem(params.key), /*limit=*/12 * 1);
+				// Show matches as the sources turn them up, then lay out the full results.
+				var found = [];
+				$('#grid').empty();
+				$('#empty-search').hide();
+				var streamed = streamSearch({"keyword": params.key}, (event) => {
+					if(event.event !== "item" || event.item.unreleased) return;
+					found.push(event.item);
+					$('#grid').append(retrieveCoverMarkup(event.item, {}));
+					resizeWhenLoaded();
+				}).then(() => found, () => searchForItem(params.key));
+				populateGrid((limit) => streamed, /*limit=*/12 * 1);
+			}, 150);
+		} else if(hash === "person"){
+			// Filmography of a person, or catalog items crediting them if `scope` is given.
+			$('#carousel_space').empty();
+			$('#downloads').hide();
+			$('.quota-bars').hide();
+			setTimeout(() => {
+				populateGrid((limit) => {
+					return new Promise((resolve, reject) => {
+						var found = params.scope ? searchByPerson(params.id || params.name, params.role || "", params.scope).then((data) => {
+							return data.results.map((on) => on.imdb_id);
+						}) : getPerson(params.id || "", params.name || "").then((data) => {
+							return data.filmography.map((on) => on.imdb_id);
+						});
+						found.then((ids) => {
+							resolveParallel(ids).then((resolved) => {
+								resolve(resolved.resolved);
+							});
+						});
+					});
+				}, /*limit=*/12 * 1);
 			}, 150);
 		} else if(hash === "hide_recommendation"){
 			var rec_obj = JSON.parse(params["obj"]);
@@ -901,6 +1083,45 @@ $(function () {
 					setTimeout(refreshHomepage, 150);
 				});
 			});
+		} else if(hash === "trakt_login"){
+			traktLoginStart().then((info) => {
+				if(!info || !info.user_code){
+					swal({
+						title: "Unable to start Trakt login",
+						icon: "error"
+					});
+					return;
+				}
+				swal({
+					title: "Authorize Trakt",
+					text: "Go to " + info.verification_url + " and enter code " + info.user_code + ".",
+					icon: "info",
+					buttons: false
+				});
+				var traktLoginInterval = setInterval(() => {
+					traktLoginStatus().then((status) => {
+						if(!status || status.status === "pending"){
+							return;
+						}
+						clearInterval(traktLoginInterval);
+						if(status.status === "authorized"){
+							swal({
+								title: "Trakt authorized",
+								text: "Successfully logged in to Trakt.",
+								icon: "success",
+								buttons: false,
+								timer: 2000
+							});
+						} else {
+							swal({
+								title: "Trakt login " + status.status,
+								text: (status.err || ""),
+								icon: "error"
+							});
+						}
+					});
+				}, (info.interval || 5) * 1000);
+			});
 		} else if(hash === "refresh"){
 			$('#downloads').hide();
 			$('.quota-bars').hide();
@@ -1418,7 +1639,8 @@ $(function () {
 					var url = file_data.url;
 					lastDownloadedItem = {
 						url: url,
-						item: on
+						item: on,
+						cloud_id: cloud_id
 					};
 					openPage({
 						"path": "/static/watch.html",
@@ -1489,38 +1711,7 @@ $(function () {
 		} else if(type === "quality_select"){
 			$('#frameModal').modal('hide');
 			$('.loader').show();
-			fetchItem(data).then((data) => {
-				console.log("fetch result:", data);
-				$('.loader').hide();
-				if(data.result !== true){
-					if(!data.enqueued){
-						swal({
-							title: "Unable to download item",
-							text: (data.not_enough_space ? "Not enough space available in cloud" : data.result),
-							icon: "error"
-						});
-					} else {
-						swal({
-							title: "Item queued",
-							text: "Added to queue",
-							icon: "success",
-							buttons: false,
-							timer: 3000
-						});
-					}
-				} else {
-					swal({
-						title: "Download has begun",
-						text: "Successfully began download.",
-						icon: "success",
-						buttons: false,
-						timer: 3000
-					}).then(() => {
-						window.history.pushState(null, null, '#view_downloads');
-						$(window).trigger('hashchange');
-					});
-				}
-			});
+			fetchSelected(data, false);
 		} else if(type === "associate_select") {
 			$('#frameModal').modal('hide');
 			$('.loader').show();
@@ -1555,6 +1746,10 @@ $(function () {
 						}
 					}
 				}
+				var imdb_code = lastDownloadedItem.item ? lastDownloadedItem.item.imdb_code : "";
+				return getSubtitles(imdb_code, lastDownloadedItem.cloud_id || "");
+			}).then((subtitles) => {
+				lastDownloadedItem.subtitles = subtitles.subtitles || [];
 				$('.loader').hide();
 				sendFrameMessage(lastDownloadedItem);
 			});
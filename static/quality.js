@@ -30,7 +30,7 @@ function renderOptions(event, item){
     	$('#quality_header').text("Select Source:");
     	$('#none_available').text("No sources available.");
     }
-    $('#cover-img').attr('src', item.cover_image);
+    $('#cover-img').attr('src', item.cover_images ? item.cover_images.full : item.cover_image);
     $('#summary-text').text(item.summary);
     $('#mpaa-rating').text(item.mpaa_rating);
     $('.imdb-rating').css('width', (item.imdb_rating * 10) + "%");
@@ -266,7 +266,14 @@ function renderOptions(event, item){
 				li.attr("data-toggle", "tooltip");
 				li.attr("title", on.filename);
 			}
-			var desc_arr = [on.quality, on.size, on.sources + " hosts", on.clients + " clients", on.source];
+			var desc_arr = [on.quality, on.size, on.sources + " hosts", on.clients + " clients", (on.origins && on.origins.length > 1) ? on.origins.join(", ") : on.source];
+			if(on.bitrate_kbps) desc_arr.splice(2, 0, "~" + (on.bitrate_kbps / 1000.0).toFixed(1) + " Mbps");
+			if(on.release){
+				var audio = [on.release.audio, on.release.audio_channels].filter((x) => x).join(" ");
+				var details = [on.release.source, on.release.codec, on.release.hdr, audio, on.release.edition].filter((x) => x);
+				if(details.length) desc_arr.splice(1, 0, details.join(" "));
+			}
+			if(on.flags && on.flags.length) desc_arr.push((on.blocked ? "blocked: " : "flagged: ") + on.flags.join(", "));
 			if(on.tv){
 				if(on.tv.episode < 10000) desc_arr.unshift("S" + on.tv.season + "E" + on.tv.episode);
 				else desc_arr.unshift("S" + on.tv.season);
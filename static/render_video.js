@@ -27,6 +27,13 @@ $(function(){
 			mime_type_guess = "video/webm"; // workaround to allow .mkv files to be played
 		}
 		elem.append('<source src="' + stream_url + '" type="' + mime_type_guess + '"></source>');
+		for(var track of (video.subtitles || [])){
+			elem.append($('<track kind="subtitles" />').attr({
+				src: track.url,
+				srclang: track.language,
+				label: track.label
+			}));
+		}
 		$('#player').append(elem);
 
 		// Implement player auto-resizing.
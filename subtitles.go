@@ -0,0 +1,657 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	SUBTITLE_DOWNLOAD_DIR = "subtitles"
+	OpenSubtitlesBaseUrl = "https://api.opensubtitles.com/api/v1"
+)
+
+var subtitleExtensions = map[string]string{
+	".srt": "srt",
+	".ass": "ass",
+	".ssa": "ass",
+	".vtt": "vtt",
+}
+
+/* Common language names and ISO 639-2 codes mapped to the ISO 639-1 codes browsers expect */
+var subtitleLanguages = map[string]string{
+	"english": "en", "eng": "en",
+	"spanish": "es", "spa": "es",
+	"french": "fr", "fre": "fr", "fra": "fr",
+	"german": "de", "ger": "de", "deu": "de",
+	"italian": "it", "ita": "it",
+	"portuguese": "pt", "por": "pt",
+	"dutch": "nl", "dut": "nl", "nld": "nl",
+	"russian": "ru", "rus": "ru",
+	"japanese": "ja", "jpn": "ja",
+	"chinese": "zh", "chi": "zh", "zho": "zh",
+	"korean": "ko", "kor": "ko",
+	"arabic": "ar", "ara": "ar",
+	"hindi": "hi", "hin": "hi",
+	"swedish": "sv", "swe": "sv",
+	"polish": "pl", "pol": "pl",
+}
+
+type SubtitleTrack struct {
+	ID string `json:"id"`
+	ImdbID string `json:"imdb_id,omitempty"`
+	Language string `json:"language"` /* ISO 639-1 code, empty if unknown */
+	Label string `json:"label"`
+	Format string `json:"format"` /* "srt", "ass" or "vtt" */
+	Source string `json:"source"` /* "sidecar" or the provider name */
+	Url string `json:"url"` /* WebVTT rendition served by this instance */
+	Path string `json:"-"`
+}
+
+type SubtitleResult struct {
+	Provider string `json:"provider"`
+	ID string `json:"id"`
+	ImdbID string `json:"imdb_id"`
+	Language string `json:"language"`
+	Format string `json:"format"`
+	Name string `json:"name"`
+	Downloads int `json:"downloads"`
+	Rating float64 `json:"rating"`
+}
+
+// SubtitleProvider searches an external subtitle database by IMDb ID.
+type SubtitleProvider interface {
+	Name() string
+	Search(imdb_id string, language string) ([]SubtitleResult, error)
+	Download(result SubtitleResult) ([]byte, error)
+}
+
+/* Subtitle tracks known to this instance, keyed by track id */
+type SubtitleLibrary struct {
+	lock *sync.Mutex
+	tracks map[string]*SubtitleTrack
+}
+
+var subtitleLibrary = SubtitleLibrary{
+	lock: &sync.Mutex{},
+	tracks: make(map[string]*SubtitleTrack),
+}
+
+func subtitleTrackId(path string) string {
+	sum := sha1.Sum([]byte(path))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+func (sl *SubtitleLibrary) Register(track *SubtitleTrack) {
+	track.ID = subtitleTrackId(track.Path)
+	track.Url = "/subtitles?id=" + track.ID
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	sl.tracks[track.ID] = track
+}
+
+func (sl *SubtitleLibrary) Get(id string) (SubtitleTrack, bool) {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	track, ok := sl.tracks[id]
+	if !ok {
+		return SubtitleTrack{}, false
+	}
+	return *track, true
+}
+
+func subtitleLanguageLabel(language string) string {
+	for name, code := range subtitleLanguages {
+		if code == language && len(name) > 3 {
+			return strings.Title(name)
+		}
+	}
+	if len(language) > 0 {
+		return strings.ToUpper(language)
+	}
+	return "Unknown"
+}
+
+func parseSubtitleLanguage(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if code, ok := subtitleLanguages[tag]; ok {
+		return code
+	}
+	if len(tag) == 2 {
+		return tag
+	}
+	return ""
+}
+
+// findSidecarSubtitles looks for subtitle files next to a video that share its
+// base name, e.g. "Movie.srt", "Movie.en.srt" or "Movie.English.forced.srt".
+func findSidecarSubtitles(video_path string) []*SubtitleTrack {
+	dir := filepath.Dir(video_path)
+	base := strings.TrimSuffix(filepath.Base(video_path), filepath.Ext(video_path))
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	tracks := make([]*SubtitleTrack, 0)
+	for _, f := range files {
+		name := f.Name()
+		format, ok := subtitleExtensions[strings.ToLower(filepath.Ext(name))]
+		if !ok || f.IsDir() || !strings.HasPrefix(name, base) {
+			continue
+		}
+
+		/* Any dotted tags between the base name and extension may name the language */
+		tags := strings.TrimSuffix(strings.TrimPrefix(name, base), filepath.Ext(name))
+		if len(tags) > 0 && !strings.HasPrefix(tags, ".") {
+			continue
+		}
+		language, forced := "", false
+		for _, tag := range strings.Split(tags, ".") {
+			if strings.EqualFold(tag, "forced") {
+				forced = true
+			} else if code := parseSubtitleLanguage(tag); len(code) > 0 {
+				language = code
+			}
+		}
+		label := subtitleLanguageLabel(language)
+		if forced {
+			label += " (Forced)"
+		}
+		track := &SubtitleTrack{
+			Language: language,
+			Label: label,
+			Format: format,
+			Source: "sidecar",
+			Path: filepath.Join(dir, name),
+		}
+		subtitleLibrary.Register(track)
+		tracks = append(tracks, track)
+	}
+	return tracks
+}
+
+func subtitleDownloadDir(imdb_id string) string {
+	return filepath.Join(SUBTITLE_DOWNLOAD_DIR, filepath.Base(imdb_id))
+}
+
+// DownloadedTracks lists subtitles previously fetched from providers for an item.
+func (sl *SubtitleLibrary) DownloadedTracks(imdb_id string) []*SubtitleTrack {
+	tracks := make([]*SubtitleTrack, 0)
+	files, err := ioutil.ReadDir(subtitleDownloadDir(imdb_id))
+	if err != nil {
+		return tracks
+	}
+	for _, f := range files {
+		/* Stored as "<language>.<provider>.<id>.<ext>" */
+		format, ok := subtitleExtensions[strings.ToLower(filepath.Ext(f.Name()))]
+		parts := strings.SplitN(f.Name(), ".", 3)
+		if !ok || len(parts) < 3 {
+			continue
+		}
+		track := &SubtitleTrack{
+			ImdbID: imdb_id,
+			Language: parts[0],
+			Label: subtitleLanguageLabel(parts[0]),
+			Format: format,
+			Source: parts[1],
+			Path: filepath.Join(subtitleDownloadDir(imdb_id), f.Name()),
+		}
+		sl.Register(track)
+		tracks = append(tracks, track)
+	}
+	return tracks
+}
+
+// TracksForItem gathers sidecar subtitles of the item's local files (or only
+// the given download if cloud_id is set) plus any downloaded ones.
+func (sl *SubtitleLibrary) TracksForItem(imdb_id string, cloud_id string) []SubtitleTrack {
+	ret := make([]SubtitleTrack, 0)
+	downloadPool.lock.Lock()
+	for _, on := range downloadPool.pool {
+		if (len(cloud_id) > 0 && on.CloudID != cloud_id) || (len(cloud_id) == 0 && on.ImdbID != imdb_id) {
+			continue
+		}
+		for _, track := range on.Subtitles {
+			ret = append(ret, *track)
+		}
+	}
+	downloadPool.lock.Unlock()
+	if len(imdb_id) > 0 {
+		for _, track := range sl.DownloadedTracks(imdb_id) {
+			ret = append(ret, *track)
+		}
+	}
+	return ret
+}
+
+func (sl *SubtitleLibrary) Save(result SubtitleResult, content []byte) (*SubtitleTrack, error) {
+	if len(result.ImdbID) == 0 {
+		return nil, errors.New("Subtitle has no IMDb id")
+	}
+	format := result.Format
+	if _, ok := subtitleExtensions["." + format]; !ok {
+		format = "srt"
+	}
+	language := parseSubtitleLanguage(result.Language)
+	if len(language) == 0 {
+		language = "und"
+	}
+
+	/* Provider ids may contain anything, so keep only safe characters */
+	safe_id := regexp.MustCompile("[^A-Za-z0-9_-]").ReplaceAllString(result.ID, "_")
+	dir := subtitleDownloadDir(result.ImdbID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s.%s.%s.%s", language, result.Provider, safe_id, format))
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		return nil, err
+	}
+	track := &SubtitleTrack{
+		ImdbID: result.ImdbID,
+		Language: language,
+		Label: subtitleLanguageLabel(language),
+		Format: format,
+		Source: result.Provider,
+		Path: path,
+	}
+	sl.Register(track)
+	return track, nil
+}
+
+/* Conversion to WebVTT */
+
+func decodeSubtitleText(content []byte) string {
+	content = bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(content) {
+		/* Older subtitles are commonly Latin-1, which maps directly onto runes */
+		runes := make([]rune, len(content))
+		for idx, b := range content {
+			runes[idx] = rune(b)
+		}
+		return strings.Replace(string(runes), "\r\n", "\n", -1)
+	}
+	return strings.Replace(strings.Replace(string(content), "\r\n", "\n", -1), "\r", "\n", -1)
+}
+
+var srtTimingRegex = regexp.MustCompile(`(\d{1,2}:\d{2}:\d{2})[,.](\d{1,3})\s*-->\s*(\d{1,2}:\d{2}:\d{2})[,.](\d{1,3})`)
+
+func srtToVtt(text string) string {
+	var out bytes.Buffer
+	out.WriteString("WEBVTT\n\n")
+	for _, block := range regexp.MustCompile(`\n\s*\n`).Split(strings.TrimSpace(text), -1) {
+		lines := strings.Split(block, "\n")
+		for idx, line := range lines {
+			if m := srtTimingRegex.FindStringSubmatch(line); m != nil {
+				fmt.Fprintf(&out, "%s.%s --> %s.%s\n", padVttHours(m[1]), padVttMillis(m[2]), padVttHours(m[3]), padVttMillis(m[4]))
+				out.WriteString(strings.Join(lines[idx + 1:], "\n"))
+				out.WriteString("\n\n")
+				break
+			}
+		}
+	}
+	return out.String()
+}
+
+func padVttHours(t string) string {
+	if strings.Index(t, ":") == 1 {
+		return "0" + t
+	}
+	return t
+}
+
+func padVttMillis(ms string) string {
+	return strings.Repeat("0", 3 - len(ms)) + ms
+}
+
+func assTimeToVtt(t string) string {
+	/* H:MM:SS.cc -> HH:MM:SS.mmm */
+	t = strings.TrimSpace(t)
+	dot := strings.LastIndex(t, ".")
+	if dot == -1 {
+		return padVttHours(t) + ".000"
+	}
+	frac := (t[dot + 1:] + "000")[:3]
+	return padVttHours(t[:dot]) + "." + frac
+}
+
+var assOverrideRegex = regexp.MustCompile(`\{[^}]*\}`)
+
+func assToVtt(text string) string {
+	var out bytes.Buffer
+	out.WriteString("WEBVTT\n\n")
+	in_events := false
+	fields := []string{"layer", "start", "end", "style", "name", "marginl", "marginr", "marginv", "effect", "text"}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			in_events = strings.EqualFold(line, "[Events]")
+			continue
+		}
+		if !in_events {
+			continue
+		}
+		if strings.HasPrefix(line, "Format:") {
+			fields = strings.Split(strings.ToLower(strings.TrimPrefix(line, "Format:")), ",")
+			for idx := range fields {
+				fields[idx] = strings.TrimSpace(fields[idx])
+			}
+			continue
+		}
+		if !strings.HasPrefix(line, "Dialogue:") {
+			continue
+		}
+
+		/* Text is always the last field and may itself contain commas */
+		values := strings.SplitN(strings.TrimPrefix(line, "Dialogue:"), ",", len(fields))
+		if len(values) != len(fields) {
+			continue
+		}
+		cue := make(map[string]string)
+		for idx, field := range fields {
+			cue[field] = values[idx]
+		}
+		cue_text := assOverrideRegex.ReplaceAllString(cue["text"], "")
+		cue_text = strings.NewReplacer("\\N", "\n", "\\n", "\n", "\\h", " ").Replace(cue_text)
+		if len(strings.TrimSpace(cue_text)) == 0 {
+			continue
+		}
+		fmt.Fprintf(&out, "%s --> %s\n%s\n\n", assTimeToVtt(cue["start"]), assTimeToVtt(cue["end"]), strings.TrimSpace(cue_text))
+	}
+	return out.String()
+}
+
+func convertToVtt(format string, content []byte) (string, error) {
+	text := decodeSubtitleText(content)
+	switch format {
+		case "vtt":
+			return text, nil
+		case "srt":
+			return srtToVtt(text), nil
+		case "ass":
+			return assToVtt(text), nil
+	}
+	return "", errors.New("Unsupported subtitle format")
+}
+
+func subtitlesHandler(w http.ResponseWriter, r *http.Request) {
+	track, ok := subtitleLibrary.Get(r.URL.Query().Get("id"))
+	if !ok {
+		http.Error(w, "No subtitle track with that id", http.StatusNotFound)
+		return
+	}
+	content, err := ioutil.ReadFile(track.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	vtt, err := convertToVtt(track.Format, content)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	fmt.Fprint(w, vtt)
+}
+
+/* Providers */
+
+var subtitleProviderTypes = map[string]func(SourceConfig) (SubtitleProvider, error){
+	"opensubtitles": func(conf SourceConfig) (SubtitleProvider, error) {
+		provider := &OpenSubtitlesProvider{}
+		if err := mapstructure.Decode(conf, provider); err != nil {
+			return nil, err
+		}
+		if len(provider.BaseUrl) == 0 {
+			provider.BaseUrl = OpenSubtitlesBaseUrl
+		}
+		return provider, nil
+	},
+	"local": func(conf SourceConfig) (SubtitleProvider, error) {
+		provider := &LocalSubtitleProvider{}
+		if err := mapstructure.Decode(conf, provider); err != nil {
+			return nil, err
+		}
+		if len(provider.Directory) == 0 {
+			return nil, errors.New("Local subtitle provider requires a `directory`")
+		}
+		return provider, nil
+	},
+}
+
+func subtitleProviders() []SubtitleProvider {
+	providers := make([]SubtitleProvider, 0)
+	for _, conf := range configuration.SubtitleProviders {
+		provider_type, _ := conf["type"].(string)
+		constructor, ok := subtitleProviderTypes[provider_type]
+		if !ok {
+			fmt.Println("Warning: unknown subtitle provider type:", provider_type)
+			continue
+		}
+		provider, err := constructor(conf)
+		if err != nil {
+			fmt.Println("Warning: could not configure subtitle provider:", err)
+			continue
+		}
+		providers = append(providers, provider)
+	}
+	return providers
+}
+
+func findSubtitleProvider(name string) (SubtitleProvider, error) {
+	for _, provider := range subtitleProviders() {
+		if provider.Name() == name {
+			return provider, nil
+		}
+	}
+	return nil, errors.New("Unknown subtitle provider")
+}
+
+// SearchSubtitles queries every configured provider, ordered by popularity.
+func SearchSubtitles(imdb_id string, language string) ([]SubtitleResult, error) {
+	ret := make([]SubtitleResult, 0)
+	var last_err error
+	providers := subtitleProviders()
+	for _, provider := range providers {
+		results, err := provider.Search(imdb_id, language)
+		if err != nil {
+			fmt.Println("Warning: subtitle search failed:", err)
+			last_err = err
+			continue
+		}
+		ret = append(ret, results...)
+	}
+	if len(ret) == 0 && last_err != nil {
+		return nil, last_err
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Downloads > ret[j].Downloads
+	})
+	return ret, nil
+}
+
+func DownloadSubtitle(result SubtitleResult) (*SubtitleTrack, error) {
+	provider, err := findSubtitleProvider(result.Provider)
+	if err != nil {
+		return nil, err
+	}
+	content, err := provider.Download(result)
+	if err != nil {
+		return nil, err
+	}
+	return subtitleLibrary.Save(result, content)
+}
+
+// OpenSubtitlesProvider talks to the OpenSubtitles.com REST API.
+type OpenSubtitlesProvider struct {
+	BaseUrl string `mapstructure:"base_url"`
+	ApiKey string `mapstructure:"api_key"`
+	UserAgent string `mapstructure:"user_agent"`
+}
+
+func (p *OpenSubtitlesProvider) Name() string {
+	return "opensubtitles"
+}
+
+func (p *OpenSubtitlesProvider) request(method string, path string, body interface{}) (map[string]interface{}, error) {
+	var body_bytes []byte
+	if body != nil {
+		var err error
+		if body_bytes, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, _ := http.NewRequest(method, p.BaseUrl + path, bytes.NewReader(body_bytes))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Api-Key", p.ApiKey)
+	if len(p.UserAgent) > 0 {
+		req.Header.Set("User-Agent", p.UserAgent)
+	}
+	res, err := netClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, errors.New(fmt.Sprintf("OpenSubtitles %s %s failed with status %d", method, path, res.StatusCode))
+	}
+	var ret map[string]interface{}
+	if err = json.NewDecoder(res.Body).Decode(&ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (p *OpenSubtitlesProvider) Search(imdb_id string, language string) ([]SubtitleResult, error) {
+	/* The API takes numeric IMDb ids */
+	params := url.Values{}
+	params.Set("imdb_id", strings.TrimLeft(strings.TrimPrefix(imdb_id, "tt"), "0"))
+	if len(language) > 0 {
+		params.Set("languages", language)
+	}
+	res, err := p.request("GET", "/subtitles?" + params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]SubtitleResult, 0)
+	data, _ := res["data"].([]interface{})
+	for _, on_v := range data {
+		on, _ := on_v.(map[string]interface{})
+		attrs, _ := on["attributes"].(map[string]interface{})
+		files, _ := attrs["files"].([]interface{})
+		if len(files) == 0 {
+			continue
+		}
+		file, _ := files[0].(map[string]interface{})
+		file_id, _ := file["file_id"].(float64)
+		name, _ := file["file_name"].(string)
+		lang, _ := attrs["language"].(string)
+		downloads, _ := attrs["download_count"].(float64)
+		rating, _ := attrs["ratings"].(float64)
+		ret = append(ret, SubtitleResult{
+			Provider: p.Name(),
+			ID: fmt.Sprintf("%.0f", file_id),
+			ImdbID: imdb_id,
+			Language: lang,
+			Format: "srt",
+			Name: name,
+			Downloads: int(downloads),
+			Rating: rating,
+		})
+	}
+	return ret, nil
+}
+
+func (p *OpenSubtitlesProvider) Download(result SubtitleResult) ([]byte, error) {
+	/* Exchange the file id for a temporary download link */
+	file_id, err := strconv.ParseInt(result.ID, 10, 64)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid OpenSubtitles file id \"%s\"", result.ID))
+	}
+	res, err := p.request("POST", "/download", map[string]interface{}{
+		"file_id": file_id,
+		"sub_format": "srt",
+	})
+	if err != nil {
+		return nil, err
+	}
+	link, ok := res["link"].(string)
+	if !ok {
+		return nil, errors.New("OpenSubtitles did not return a download link")
+	}
+	resp, err := netClient.Get(link)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, errors.New(fmt.Sprintf("OpenSubtitles download failed with status %d", resp.StatusCode))
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// LocalSubtitleProvider serves subtitles from a directory laid out as
+// "<directory>/<imdb id>/<language>/<file>", standing in for a remote
+// database when testing or offline.
+type LocalSubtitleProvider struct {
+	Directory string `mapstructure:"directory"`
+}
+
+func (p *LocalSubtitleProvider) Name() string {
+	return "local"
+}
+
+func (p *LocalSubtitleProvider) Search(imdb_id string, language string) ([]SubtitleResult, error) {
+	ret := make([]SubtitleResult, 0)
+	item_dir := filepath.Join(p.Directory, filepath.Base(imdb_id))
+	languages, err := ioutil.ReadDir(item_dir)
+	if err != nil {
+		return ret, nil
+	}
+	for _, lang_dir := range languages {
+		if !lang_dir.IsDir() || (len(language) > 0 && lang_dir.Name() != language) {
+			continue
+		}
+		files, _ := ioutil.ReadDir(filepath.Join(item_dir, lang_dir.Name()))
+		for _, f := range files {
+			format, ok := subtitleExtensions[strings.ToLower(filepath.Ext(f.Name()))]
+			if !ok {
+				continue
+			}
+			ret = append(ret, SubtitleResult{
+				Provider: p.Name(),
+				ID: lang_dir.Name() + "/" + f.Name(),
+				ImdbID: imdb_id,
+				Language: lang_dir.Name(),
+				Format: format,
+				Name: f.Name(),
+			})
+		}
+	}
+	return ret, nil
+}
+
+func (p *LocalSubtitleProvider) Download(result SubtitleResult) ([]byte, error) {
+	/* Keep lookups inside the configured directory */
+	path := filepath.Join(p.Directory, filepath.Base(result.ImdbID), filepath.Clean("/" + result.ID))
+	return ioutil.ReadFile(path)
+}
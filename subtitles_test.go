@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestConvertToVtt(t *testing.T) {
+	cases := []struct {
+		format string
+		content string
+		want string
+	}{
+		{"srt", "1\n00:00:01,000 --> 00:00:02,500\nHello\n\n2\n00:00:03,000 --> 00:00:04,000\nTwo\nlines\n",
+			"WEBVTT\n\n00:00:01.000 --> 00:00:02.500\nHello\n\n00:00:03.000 --> 00:00:04.000\nTwo\nlines\n\n"},
+		/* Windows line endings, a byte order mark and single digit hours */
+		{"srt", "\xef\xbb\xbf1\r\n0:01:02,500 --> 0:01:03.250\r\nHi\r\n",
+			"WEBVTT\n\n00:01:02.500 --> 00:01:03.250\nHi\n\n"},
+		/* Blocks without timing are dropped */
+		{"srt", "garbage\n\n1\n00:00:01,000 --> 00:00:02,000\nOk\n",
+			"WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nOk\n\n"},
+		{"srt", "1\n00:00:01,000 --> 00:00:02,000\nCaf\xe9\n",
+			"WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nCafé\n\n"},
+		{"ass", "[Script Info]\nTitle: x\n\n[Events]\nFormat: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n" +
+			"Dialogue: 0,0:00:01.50,0:00:03.00,Default,,0,0,0,,{\\i1}Hello{\\i0}, there\\Nfriend\n" +
+			"Dialogue: 0,0:00:04.00,0:00:05.00,Default,,0,0,0,,{\\pos(1,1)}\n" +
+			"Comment: 0,0:00:06.00,0:00:07.00,Default,,0,0,0,,ignored\n",
+			"WEBVTT\n\n00:00:01.500 --> 00:00:03.000\nHello, there\nfriend\n\n"},
+		/* Fields in a different order */
+		{"ass", "[Events]\nFormat: Start, End, Text\nDialogue: 1:02:03.4,1:02:05,Later\n",
+			"WEBVTT\n\n01:02:03.400 --> 01:02:05.000\nLater\n\n"},
+		{"vtt", "WEBVTT\r\n\r\n00:00:01.000 --> 00:00:02.000\r\nAs is\r\n",
+			"WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nAs is\n"},
+	}
+	for _, c := range cases {
+		got, err := convertToVtt(c.format, []byte(c.content))
+		if err != nil || got != c.want {
+			t.Errorf("convertToVtt(%q, %q) = %q, %v\n want %q", c.format, c.content, got, err, c.want)
+		}
+	}
+	if _, err := convertToVtt("sub", []byte("{1}{2}Text")); err == nil {
+		t.Errorf("convertToVtt accepted an unsupported format")
+	}
+}
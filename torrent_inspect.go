@@ -0,0 +1,416 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	TORRENT_KEY_ID = "torrentKeyId-"
+	MAX_TORRENT_BYTES = 10 * 1024 * 1024
+	MAX_BENCODE_DEPTH = 64 /* real torrents nest a handful of levels */
+	DEFAULT_INSPECT_MIN_VIDEO_MB = 150
+)
+
+type TorrentFile struct {
+	Path string `json:"path"`
+	Size int64 `json:"size"`
+}
+
+type TorrentMeta struct {
+	InfoHash string `json:"info_hash"`
+	Name string `json:"name"`
+	Files []TorrentFile `json:"files"`
+	TotalSize int64 `json:"total_size"`
+	PieceLength int64 `json:"piece_length"`
+	Trackers []string `json:"trackers,omitempty"`
+}
+
+type InspectionFlag struct {
+	Kind string `json:"kind"` // executable, archive, no_video, sample, small_video, language, password
+	Detail string `json:"detail"`
+	Blocks bool `json:"blocks"` // whether the source should not be downloaded
+}
+
+type SourceInspection struct {
+	Uri string `json:"uri"`
+	Meta *TorrentMeta `json:"meta,omitempty"` // nil if the metadata could not be fetched
+	Flags []InspectionFlag `json:"flags"`
+	Blocked bool `json:"blocked"`
+	Error string `json:"error,omitempty"`
+}
+
+/* Bencode */
+
+type bdecoder struct {
+	data []byte
+	pos int
+	info_start int
+	info_end int
+}
+
+// decode reads one value at d.pos. Input comes from arbitrary sites, so every
+// length and terminator is checked and nesting is bounded.
+func (d *bdecoder) decode(depth int) (interface{}, error) {
+	if d.pos >= len(d.data) {
+		return nil, errors.New("Unexpected end of bencoded data")
+	}
+	if depth > MAX_BENCODE_DEPTH {
+		return nil, errors.New("Bencoded data is nested too deeply")
+	}
+	switch c := d.data[d.pos]; {
+		case c == 'i':
+			end := d.pos + 1
+			for end < len(d.data) && d.data[end] != 'e' {
+				end += 1
+			}
+			if end >= len(d.data) {
+				return nil, errors.New("Unterminated bencoded integer")
+			}
+			value, err := strconv.ParseInt(string(d.data[d.pos + 1:end]), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			d.pos = end + 1
+			return value, nil
+		case c == 'l':
+			d.pos += 1
+			list := make([]interface{}, 0)
+			for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+				elem, err := d.decode(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, elem)
+			}
+			if d.pos >= len(d.data) {
+				return nil, errors.New("Unterminated bencoded list")
+			}
+			d.pos += 1
+			return list, nil
+		case c == 'd':
+			d.pos += 1
+			dict := make(map[string]interface{})
+			for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+				key, err := d.decode(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				key_str, ok := key.(string)
+				if !ok {
+					return nil, errors.New("Bencoded dictionary key is not a string")
+				}
+				/* The info hash is taken over the exact bytes of the top-level info dictionary */
+				start := d.pos
+				value, err := d.decode(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				if depth == 0 && key_str == "info" {
+					d.info_start, d.info_end = start, d.pos
+				}
+				dict[key_str] = value
+			}
+			if d.pos >= len(d.data) {
+				return nil, errors.New("Unterminated bencoded dictionary")
+			}
+			d.pos += 1
+			return dict, nil
+		case c >= '0' && c <= '9':
+			colon := d.pos
+			for colon < len(d.data) && d.data[colon] != ':' {
+				colon += 1
+			}
+			length, err := strconv.Atoi(string(d.data[d.pos:colon]))
+			if err != nil || colon >= len(d.data) || length < 0 || length > len(d.data) - colon - 1 {
+				return nil, errors.New("Malformed bencoded string")
+			}
+			value := string(d.data[colon + 1:colon + 1 + length])
+			d.pos = colon + 1 + length
+			return value, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unexpected byte %q in bencoded data", d.data[d.pos]))
+}
+
+// ParseTorrent reads the name, files and info hash of a .torrent file.
+func ParseTorrent(data []byte) (*TorrentMeta, error) {
+	d := &bdecoder{data: data}
+	decoded, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	root, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Torrent is not a dictionary")
+	}
+	info, ok := root["info"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Torrent has no info dictionary")
+	}
+	hash := sha1.Sum(data[d.info_start:d.info_end])
+
+	meta := &TorrentMeta{InfoHash: hex.EncodeToString(hash[:]), Files: make([]TorrentFile, 0)}
+	meta.Name, _ = info["name"].(string)
+	meta.PieceLength, _ = info["piece length"].(int64)
+	if announce, ok := root["announce"].(string); ok {
+		meta.Trackers = append(meta.Trackers, announce)
+	}
+	tiers, _ := root["announce-list"].([]interface{})
+	for _, tier := range tiers {
+		meta.Trackers = append(meta.Trackers, configStrings(tier)...)
+	}
+
+	/* Single-file torrents only have a length, multi-file ones a list of paths */
+	if length, ok := info["length"].(int64); ok {
+		meta.Files = append(meta.Files, TorrentFile{Path: meta.Name, Size: length})
+	}
+	files, _ := info["files"].([]interface{})
+	for _, elem := range files {
+		file, ok := elem.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		size, _ := file["length"].(int64)
+		parts := append([]string{meta.Name}, configStrings(file["path"])...)
+		meta.Files = append(meta.Files, TorrentFile{Path: strings.Join(parts, "/"), Size: size})
+	}
+	if len(meta.Files) == 0 {
+		return nil, errors.New("Torrent lists no files")
+	}
+	for _, file := range meta.Files {
+		meta.TotalSize += file.Size
+	}
+	return meta, nil
+}
+
+/* Fetching metadata */
+
+func downloadTorrent(uri string) (*TorrentMeta, error) {
+	resp, err := netClient.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, errors.New(fmt.Sprintf("%s returned %s", uri, resp.Status))
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_TORRENT_BYTES + 1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MAX_TORRENT_BYTES {
+		return nil, errors.New(fmt.Sprintf("%s is larger than %s", uri, BytesToSize(MAX_TORRENT_BYTES)))
+	}
+	return ParseTorrent(data)
+}
+
+// FetchTorrentMeta gets the metadata behind a source link. Torrent links are
+// downloaded; magnets are looked up through their exact source ("xs") and
+// the torrent caches configured under "torrent_metadata_urls".
+func FetchTorrentMeta(uri string) (*TorrentMeta, error) {
+	magnet, err := ParseMagnet(uri)
+	if err != nil {
+		if err = ValidateSourceUri(uri); err != nil {
+			return nil, err
+		}
+		return downloadTorrent(uri)
+	}
+	if strings.HasPrefix(magnet.InfoHash, "btmh:") {
+		return nil, errors.New("Metadata of v2-only torrents cannot be fetched")
+	}
+
+	candidates := make([]string, 0)
+	for _, xs := range magnet.Extra["xs"] {
+		if strings.HasPrefix(xs, "http://") || strings.HasPrefix(xs, "https://") {
+			candidates = append(candidates, xs)
+		}
+	}
+	for _, template := range configuration.TorrentMetadataUrls {
+		candidates = append(candidates, expandScrapeTemplate(template, map[string]string{
+			"hash": magnet.InfoHash,
+			"hash_upper": strings.ToUpper(magnet.InfoHash),
+		}, false))
+	}
+	if len(candidates) == 0 {
+		return nil, errors.New("No way to fetch the metadata of this magnet; configure \"torrent_metadata_urls\"")
+	}
+
+	/* Caches may answer with some other torrent, so check the hash */
+	last_err := errors.New("No torrent cache had this torrent")
+	for _, candidate := range candidates {
+		meta, err := downloadTorrent(candidate)
+		if err != nil {
+			last_err = err
+			continue
+		}
+		if meta.InfoHash != magnet.InfoHash {
+			last_err = errors.New(fmt.Sprintf("%s returned a different torrent", candidate))
+			continue
+		}
+		return meta, nil
+	}
+	return nil, last_err
+}
+
+/* Checking contents */
+
+var (
+	videoExtensions = []string{".mkv", ".mp4", ".avi", ".m4v", ".mov", ".wmv", ".ts", ".m2ts", ".webm", ".mpg", ".mpeg"}
+	executableExtensions = []string{".exe", ".msi", ".bat", ".cmd", ".com", ".scr", ".pif", ".vbs", ".js", ".jar", ".apk", ".lnk", ".ps1", ".dmg", ".app"}
+	archiveExtensions = []string{".rar", ".zip", ".7z", ".tar", ".gz", ".bz2", ".xz", ".iso", ".img"}
+	splitArchive = regexp.MustCompile(`(?i)\.(r\d{2}|\d{3}|part\d+\.rar)$`)
+	sampleName = regexp.MustCompile(`(?i)(^|[^a-z])(sample|trailer|preview)([^a-z]|$)`)
+	passwordName = regexp.MustCompile(`(?i)passw(or)?d|\.url$`)
+	releaseLanguages = map[string]*regexp.Regexp{
+		"french": regexp.MustCompile(`(?i)\b(french|truefrench|vff|vostfr)\b`),
+		"german": regexp.MustCompile(`(?i)\bgerman\b`),
+		"italian": regexp.MustCompile(`(?i)\b(italian|ita)\b`),
+		"spanish": regexp.MustCompile(`(?i)\b(spanish|castellano|latino)\b`),
+		"russian": regexp.MustCompile(`(?i)\b(russian|rus)\b`),
+		"hindi": regexp.MustCompile(`(?i)\bhindi\b`),
+		"korean": regexp.MustCompile(`(?i)\bkorean\b`),
+		"japanese": regexp.MustCompile(`(?i)\bjapanese\b`),
+		"chinese": regexp.MustCompile(`(?i)\b(chinese|chs|cht)\b`),
+	}
+)
+
+func hasExtension(name string, extensions []string) bool {
+	return indexFold(extensions, path.Ext(name)) >= 0
+}
+
+// InspectTorrent looks for contents that make a source unlikely to be the
+// movie it claims to be, or unsafe to download.
+func InspectTorrent(meta *TorrentMeta) []InspectionFlag {
+	flags := make([]InspectionFlag, 0)
+	flag := func(kind string, blocks bool, format string, args ...interface{}) {
+		flags = append(flags, InspectionFlag{Kind: kind, Detail: fmt.Sprintf(format, args...), Blocks: blocks})
+	}
+
+	var largest_video *TorrentFile
+	archives := 0
+	for idx, file := range meta.Files {
+		name := path.Base(file.Path)
+		switch {
+			case hasExtension(name, executableExtensions):
+				flag("executable", true, "%s is a program", file.Path)
+			case hasExtension(name, archiveExtensions) || splitArchive.MatchString(name):
+				archives += 1
+			case hasExtension(name, videoExtensions):
+				if largest_video == nil || file.Size > largest_video.Size {
+					largest_video = &meta.Files[idx]
+				}
+		}
+		if passwordName.MatchString(name) {
+			flag("password", false, "%s suggests the contents are locked or point elsewhere", file.Path)
+		}
+	}
+
+	/* The movie itself should be the largest video, and not packed up */
+	min_video_mb := configuration.InspectMinVideoMB
+	if min_video_mb <= 0 {
+		min_video_mb = DEFAULT_INSPECT_MIN_VIDEO_MB
+	}
+	switch {
+		case largest_video == nil && archives > 0:
+			flag("archive", true, "the video is packed in %d archive file(s)", archives)
+		case largest_video == nil:
+			flag("no_video", true, "no video files among %d file(s)", len(meta.Files))
+		default:
+			if archives > 0 {
+				flag("archive", false, "%d archive file(s) besides the video", archives)
+			}
+			if sampleName.MatchString(path.Base(largest_video.Path)) {
+				flag("sample", true, "the largest video, %s, is a sample", largest_video.Path)
+			}
+			if largest_video.Size < int64(min_video_mb) * 1024 * 1024 {
+				flag("small_video", true, "the largest video is only %s", BytesToSize(float64(largest_video.Size)))
+			}
+	}
+
+	/* Dubbed or subtitled releases name their language */
+	accepted := configuration.InspectLanguages
+	names := []string{meta.Name}
+	if largest_video != nil {
+		names = append(names, path.Base(largest_video.Path))
+	}
+	languages := make([]string, 0)
+	for language, pattern := range releaseLanguages {
+		if indexFold(accepted, language) >= 0 {
+			continue
+		}
+		for _, name := range names {
+			if pattern.MatchString(strings.NewReplacer(".", " ", "_", " ").Replace(name)) {
+				languages = append(languages, language)
+				break
+			}
+		}
+	}
+	sort.Strings(languages)
+	for _, language := range languages {
+		flag("language", false, "the release is tagged as %s", language)
+	}
+	return flags
+}
+
+// InspectSource fetches and checks the metadata behind a source link. Results
+// are cached by info hash, so sources listed again show their flags.
+func InspectSource(uri string) SourceInspection {
+	report := SourceInspection{Uri: uri, Flags: make([]InspectionFlag, 0)}
+	if hash := InfoHashOf(uri); len(hash) > 0 {
+		if cached, ok := cachedInspection(hash); ok {
+			cached.Uri = uri
+			return cached
+		}
+	}
+
+	meta, err := FetchTorrentMeta(uri)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Meta = meta
+	report.Flags = InspectTorrent(meta)
+	for _, on := range report.Flags {
+		report.Blocked = report.Blocked || on.Blocks
+	}
+	if inspection_bytes, err := json.Marshal(report); err == nil {
+		cache.Set([]byte(TORRENT_KEY_ID + meta.InfoHash), inspection_bytes, /*7 days=*/7 * 24 * 60 * 60)
+	}
+	return report
+}
+
+func cachedInspection(info_hash string) (SourceInspection, bool) {
+	var report SourceInspection
+	cached, err := cache.Get([]byte(TORRENT_KEY_ID + info_hash))
+	if err != nil || cached == nil {
+		return report, false
+	}
+	return report, json.Unmarshal(cached, &report) == nil
+}
+
+// annotateInspection marks a source that was inspected before with the
+// kinds of problems found, without fetching anything.
+func annotateInspection(on *ItemSource) {
+	if len(on.InfoHash) == 0 {
+		return
+	}
+	report, ok := cachedInspection(on.InfoHash)
+	if !ok {
+		return
+	}
+	on.Flags = make([]string, 0)
+	for _, flag := range report.Flags {
+		on.Flags = append(on.Flags, flag.Kind)
+	}
+	on.Blocked = report.Blocked
+}
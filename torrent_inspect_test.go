@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func bencodeString(s string) string {
+	return fmt.Sprintf("%d:%s", len(s), s)
+}
+
+func TestParseTorrent(t *testing.T) {
+	info := "d" + bencodeString("files") + "l" +
+		"d" + bencodeString("length") + "i900000000e" + bencodeString("path") + "l" + bencodeString("Movie.2019.1080p.mkv") + "ee" +
+		"d" + bencodeString("length") + "i1000e" + bencodeString("path") + "l" + bencodeString("Extras") + bencodeString("setup.exe") + "ee" +
+		"e" + bencodeString("name") + bencodeString("Movie.2019.1080p") + bencodeString("piece length") + "i262144e" + "e"
+	torrent := "d" + bencodeString("announce") + bencodeString("udp://tracker:80") + bencodeString("info") + info + "e"
+
+	meta, err := ParseTorrent([]byte(torrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte(info))
+	if meta.InfoHash != hex.EncodeToString(sum[:]) {
+		t.Errorf("info hash %s is not the hash of the info dictionary", meta.InfoHash)
+	}
+	if len(meta.Files) != 2 || meta.Files[1].Path != "Movie.2019.1080p/Extras/setup.exe" || meta.TotalSize != 900001000 {
+		t.Errorf("unexpected files %+v (total %d)", meta.Files, meta.TotalSize)
+	}
+	if len(meta.Trackers) != 1 || meta.PieceLength != 262144 {
+		t.Errorf("unexpected trackers %v or piece length %d", meta.Trackers, meta.PieceLength)
+	}
+}
+
+func TestParseTorrentRejectsMalformed(t *testing.T) {
+	cases := map[string]string{
+		"unterminated dictionaries": "d4:infod6:lengthi5e4:name3:abc",
+		"unterminated list": "d4:infod5:filesld6:lengthi5eee",
+		"unterminated integer": "d4:infod6:lengthi5",
+		"string past the end": "d4:infod4:name10:abce",
+		"overflowing string length": "d4:infod4:name9223372036854775807:abcee",
+		"negative string length": "d4:infod4:name-1:ee",
+		"deep nesting": strings.Repeat("l", 10 * 1024 * 1024),
+		"deep nesting in info": "d4:info" + strings.Repeat("d1:a", 1000),
+		"no info dictionary": "d8:announce3:abce",
+		"no files": "d4:infod4:name3:abcee",
+		"empty": "",
+	}
+	for name, data := range cases {
+		if meta, err := ParseTorrent([]byte(data)); err == nil {
+			t.Errorf("%s: expected an error, got %+v", name, meta)
+		}
+	}
+}
+
+func TestInspectTorrent(t *testing.T) {
+	configuration.InspectMinVideoMB = 0
+	configuration.InspectLanguages = nil
+	cases := []struct {
+		name string
+		files []TorrentFile
+		kinds []string
+		blocked bool
+	}{
+		{"clean", []TorrentFile{{"Movie.2019.1080p.mkv", 2e9}, {"Movie.nfo", 1e3}}, nil, false},
+		{"executable", []TorrentFile{{"Movie.2019.1080p.mkv", 2e9}, {"Codec.exe", 1e5}}, []string{"executable"}, true},
+		{"packed", []TorrentFile{{"movie.rar", 1e8}, {"movie.r00", 1e8}}, []string{"archive"}, true},
+		{"no video", []TorrentFile{{"readme.txt", 1e3}}, []string{"no_video"}, true},
+		{"sample", []TorrentFile{{"Movie.2019.1080p-sample.mkv", 5e8}}, []string{"sample"}, true},
+		{"small", []TorrentFile{{"Movie.2019.1080p.mkv", 5e7}}, []string{"small_video"}, true},
+		{"language", []TorrentFile{{"Movie.2019.FRENCH.1080p.mkv", 2e9}}, []string{"language"}, false},
+		{"password", []TorrentFile{{"Movie.2019.1080p.mkv", 2e9}, {"Password.txt", 1e2}}, []string{"password"}, false},
+	}
+	for _, c := range cases {
+		flags := InspectTorrent(&TorrentMeta{Name: "Movie", Files: c.files})
+		kinds := make([]string, 0)
+		blocked := false
+		for _, on := range flags {
+			kinds = append(kinds, on.Kind)
+			blocked = blocked || on.Blocks
+		}
+		if strings.Join(kinds, ",") != strings.Join(c.kinds, ",") || blocked != c.blocked {
+			t.Errorf("%s: got flags %v (blocked %v), expected %v (blocked %v)", c.name, kinds, blocked, c.kinds, c.blocked)
+		}
+	}
+}
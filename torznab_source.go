@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TorznabSource queries an indexer speaking the Torznab (or Newznab) API,
+// as offered by most indexers and by aggregators in front of them.
+type TorznabSource struct {
+	ApiUrl string `mapstructure:"api_url"` // e.g. https://indexer.example/api
+	ApiKey string `mapstructure:"api_key"`
+	Categories []int `mapstructure:"categories"` // restrict results to these categories
+	SourceApiHostname string `mapstructure:"hostname"`
+	Mirrored `mapstructure:",squash"` // mirrors stand in for api_url
+
+	caps_once sync.Once
+	caps torznabCaps
+}
+
+type torznabSearchCaps struct {
+	Available string `xml:"available,attr"`
+	SupportedParams string `xml:"supportedParams,attr"`
+}
+
+type torznabCaps struct {
+	XMLName xml.Name
+	Code string `xml:"code,attr"` // set on <error> responses
+	Description string `xml:"description,attr"`
+	Search torznabSearchCaps `xml:"searching>search"`
+	TVSearch torznabSearchCaps `xml:"searching>tv-search"`
+	MovieSearch torznabSearchCaps `xml:"searching>movie-search"`
+}
+
+type torznabAttr struct {
+	Name string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type torznabItem struct {
+	Title string `xml:"title"`
+	Link string `xml:"link"`
+	PubDate string `xml:"pubDate"`
+	Size int64 `xml:"size"`
+	Enclosure struct {
+		Url string `xml:"url,attr"`
+		Length int64 `xml:"length,attr"`
+	} `xml:"enclosure"`
+	Attrs []torznabAttr `xml:"attr"` // torznab:attr or newznab:attr
+}
+
+type torznabFeed struct {
+	XMLName xml.Name
+	Code string `xml:"code,attr"` // set on <error> responses
+	Description string `xml:"description,attr"`
+	Items []torznabItem `xml:"channel>item"`
+}
+
+func (caps torznabSearchCaps) supports(param string) bool {
+	if caps.Available != "yes" {
+		return false
+	}
+	for _, on := range strings.Split(caps.SupportedParams, ",") {
+		if strings.TrimSpace(on) == param {
+			return true
+		}
+	}
+	return false
+}
+
+func (src *TorznabSource) request(params url.Values) ([]byte, error) {
+	params.Set("apikey", src.ApiKey)
+	return src.Get(src.ApiUrl, src.ApiUrl + "?" + params.Encode(), nil)
+}
+
+// loadCaps asks the indexer what it can search by. If that fails every kind
+// of search is assumed to work, so a flaky caps endpoint does not disable it.
+func (src *TorznabSource) loadCaps() torznabCaps {
+	src.caps_once.Do(func() {
+		src.caps = torznabCaps{
+			Search: torznabSearchCaps{"yes", "q"},
+			TVSearch: torznabSearchCaps{"yes", "q,season,ep,imdbid"},
+			MovieSearch: torznabSearchCaps{"yes", "q,imdbid"},
+		}
+		body, err := src.request(url.Values{"t": {"caps"}})
+		if err != nil {
+			fmt.Printf("Warning: could not fetch caps of %s, assuming full support: %s\n", src.ApiUrl, err)
+			return
+		}
+		var caps torznabCaps
+		if err = xml.Unmarshal(body, &caps); err != nil {
+			fmt.Printf("Warning: could not parse caps of %s, assuming full support: %s\n", src.ApiUrl, err)
+			return
+		}
+		if caps.XMLName.Local != "caps" {
+			if caps.XMLName.Local == "error" {
+				fmt.Printf("Warning: indexer %s answered caps with error %s: %s, assuming full support\n", src.ApiUrl, caps.Code, caps.Description)
+			} else {
+				fmt.Printf("Warning: unexpected caps response from %s, assuming full support\n", src.ApiUrl)
+			}
+			return
+		}
+		src.caps = caps
+	})
+	return src.caps
+}
+
+func (src *TorznabSource) Capabilities() SourceCapabilities {
+	caps := src.loadCaps()
+	return SourceCapabilities{
+		Keyword: caps.Search.supports("q") || caps.MovieSearch.supports("q"),
+		Imdb: caps.MovieSearch.supports("imdbid") || caps.TVSearch.supports("imdbid") || caps.MovieSearch.supports("q"),
+		TV: caps.TVSearch.Available == "yes",
+	}
+}
+
+func optInt(opts map[string]interface{}, key string) int {
+	value, _ := optInt64(opts, key)
+	return int(value)
+}
+
+/* Title and year to search by when the indexer cannot search by IMDb id */
+func imdbSearchTerm(imdb_id string) string {
+	got, err := omdbQuery(url.Values{"i": {imdb_id}})
+	if err != nil {
+		return ""
+	}
+	title, _ := got["Title"].(string)
+	year, _ := got["Year"].(string)
+	if len(year) >= 4 {
+		title += " " + year[:4]
+	}
+	return title
+}
+
+func (src *TorznabSource) Search(opts map[string]interface{}) (ret []ItemSource, err error) {
+	ret = make([]ItemSource, 0)
+	caps := src.loadCaps()
+
+	/* Pick the search function and the parameters the indexer understands */
+	is_tv, _ := opts["tv"].(bool)
+	search, search_caps := "search", caps.Search
+	if is_tv {
+		search, search_caps = "tvsearch", caps.TVSearch
+	} else if caps.MovieSearch.Available == "yes" {
+		search, search_caps = "movie", caps.MovieSearch
+	}
+	params := url.Values{"t": {search}, "extended": {"1"}}
+	imdb_id, by_id := opts["id"].(string)
+	if by_id && search_caps.supports("imdbid") {
+		params.Set("imdbid", strings.TrimPrefix(imdb_id, "tt"))
+	} else if by_id {
+		term := imdbSearchTerm(imdb_id)
+		if len(term) == 0 || !search_caps.supports("q") {
+			return nil, errors.New("This indexer cannot search by IMDb id")
+		}
+		params.Set("q", term)
+	} else if keyword, ok := opts["keyword"].(string); ok {
+		params.Set("q", keyword)
+	}
+	if season := optInt(opts, "season"); season > 0 && search_caps.supports("season") {
+		params.Set("season", strconv.Itoa(season))
+		if episode := optInt(opts, "episode"); episode > 0 && search_caps.supports("ep") {
+			params.Set("ep", strconv.Itoa(episode))
+		}
+	}
+	if len(src.Categories) > 0 {
+		categories := make([]string, 0)
+		for _, on := range src.Categories {
+			categories = append(categories, strconv.Itoa(on))
+		}
+		params.Set("cat", strings.Join(categories, ","))
+	}
+
+	/* Execute the request */
+	body, err := src.request(params)
+	if err != nil {
+		return nil, err
+	}
+	var feed torznabFeed
+	if err = xml.Unmarshal(body, &feed); err != nil {
+		return nil, err
+	}
+	if feed.XMLName.Local == "error" {
+		return nil, errors.New(fmt.Sprintf("Indexer error %s: %s", feed.Code, feed.Description))
+	}
+
+	/* Convert response to desired format */
+	for _, item := range feed.Items {
+		on := src.itemSource(item)
+		if len(on.ImdbCode) == 0 {
+			if by_id {
+				/* Searching by title: only keep releases that look like the right item */
+				on.ImdbCode = imdb_id
+				if params.Get("imdbid") == "" && matchReleaseImdb(on.Release) != imdb_id {
+					continue
+				}
+			} else if on.ImdbCode = matchReleaseImdb(on.Release); len(on.ImdbCode) == 0 {
+				continue
+			}
+		}
+		if by_id && on.ImdbCode != imdb_id {
+			continue
+		}
+		ret = append(ret, on)
+	}
+	return ret, nil
+}
+
+func (src *TorznabSource) itemSource(item torznabItem) ItemSource {
+	attrs := make(map[string]string)
+	for _, attr := range item.Attrs {
+		attrs[attr.Name] = attr.Value
+	}
+
+	release := ParseReleaseName(item.Title)
+	on := ItemSource{
+		Filename: item.Title,
+		Url: item.Link,
+		SourceHostname: src.SourceApiHostname,
+		Quality: detectQuality(item.Title, release),
+		TV: release.TV,
+		Release: release,
+	}
+	if len(item.Enclosure.Url) > 0 {
+		on.Url = item.Enclosure.Url
+	}
+	if magnet, ok := attrs["magneturl"]; ok && len(magnet) > 0 {
+		on.Url = magnet
+	}
+
+	/* IMDb ids come without the "tt" prefix, and zero-padding varies */
+	for _, key := range []string{"imdb", "imdbid"} {
+		if number, err := strconv.Atoi(strings.TrimPrefix(attrs[key], "tt")); err == nil && number > 0 {
+			on.ImdbCode = fmt.Sprintf("tt%07d", number)
+			break
+		}
+	}
+
+	on.SizeBytes = item.Size
+	if size, err := strconv.ParseInt(attrs["size"], 10, 64); err == nil {
+		on.SizeBytes = size
+	}
+	if on.SizeBytes <= 0 {
+		on.SizeBytes = item.Enclosure.Length
+	}
+	if on.SizeBytes > 0 {
+		on.Size = BytesToSize(float64(on.SizeBytes))
+	}
+
+	/* Peers include seeders */
+	on.SourceCount, _ = strconv.Atoi(attrs["seeders"])
+	if peers, err := strconv.Atoi(attrs["peers"]); err == nil && peers >= on.SourceCount {
+		on.ClientCount = peers - on.SourceCount
+	} else if leechers, err := strconv.Atoi(attrs["leechers"]); err == nil {
+		on.ClientCount = leechers
+	}
+
+	if season, err := strconv.Atoi(attrs["season"]); err == nil {
+		on.TV = &ItemSourceTV{Season: season, Episode: FULL_SEASON_EPISODE}
+		if episode, err := strconv.Atoi(attrs["episode"]); err == nil {
+			on.TV.Episode = episode
+		}
+	}
+	if published, err := time.Parse(time.RFC1123Z, item.PubDate); err == nil {
+		on.UploadedAt = published.Unix()
+	}
+	return on
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/42minutes/go-trakt"
+)
+
+const (
+	TRAKT_TOKEN_FILENAME = "trakt_token.json"
+	TRAKT_REDIRECT_URI = "urn:ietf:wg:oauth:2.0:oob"
+	TRAKT_REFRESH_MARGIN = 2 * time.Hour
+	TRAKT_REFRESH_RETRY = 10 * time.Minute /* wait after a failed refresh before trying again */
+)
+
+const (
+	TraktDeviceCodeUrl = "/oauth/device/code"
+	TraktDeviceTokenUrl = "/oauth/device/token"
+	TraktTokenUrl = "/oauth/token"
+)
+
+type TraktToken struct {
+	AccessToken string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn int64 `json:"expires_in"` /* lifetime of access token in seconds */
+	CreatedAt int64 `json:"created_at"` /* unix timestamp in seconds, 0 if unknown */
+}
+
+type TraktDeviceCode struct {
+	DeviceCode string `json:"device_code"`
+	UserCode string `json:"user_code"`
+	VerificationUrl string `json:"verification_url"`
+	ExpiresIn int `json:"expires_in"`
+	Interval int `json:"interval"`
+}
+
+type TraktAuth struct {
+	lock *sync.Mutex
+	token TraktToken
+	retry_refresh time.Time
+
+	/* Device code login state */
+	device *TraktDeviceCode
+	device_expiry time.Time
+	device_status string /* "idle", "pending", "authorized", "denied", "expired", "error" */
+	device_err string
+}
+
+var traktAuth = TraktAuth{
+	lock: &sync.Mutex{},
+	device_status: "idle",
+}
+
+func (tok TraktToken) ExpiryTime() time.Time {
+	if tok.CreatedAt == 0 || tok.ExpiresIn == 0 {
+		return time.Time{}
+	}
+	return time.Unix(tok.CreatedAt + tok.ExpiresIn, 0)
+}
+
+func (ta *TraktAuth) applyToken(tok TraktToken) {
+	ta.token = tok
+	traktClient = trakt.NewClientWith(
+		configuration.TraktBaseUrl,
+		"Trakt Golang Client",
+		configuration.TraktClientId,
+		trakt.TokenAuth{AccessToken: tok.AccessToken},
+		nil,
+	)
+}
+
+func (ta *TraktAuth) ReadFromDisk() {
+	ta.lock.Lock()
+	defer ta.lock.Unlock()
+
+	/* Fall back to configured tokens if nothing has been persisted yet */
+	tok := TraktToken{
+		AccessToken: configuration.TraktAccessToken,
+		RefreshToken: configuration.TraktRefreshToken,
+	}
+	content, err := ioutil.ReadFile(TRAKT_TOKEN_FILENAME)
+	if err == nil {
+		var saved TraktToken
+		if err = json.Unmarshal(content, &saved); err == nil && len(saved.AccessToken) > 0 {
+			tok = saved
+		} else {
+			fmt.Println("Could not parse saved Trakt token:", err)
+		}
+	}
+	ta.applyToken(tok)
+}
+
+func (ta *TraktAuth) saveToDisk() (error) {
+	tok_json, err := json.Marshal(ta.token)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(TRAKT_TOKEN_FILENAME, tok_json, 0600)
+}
+
+func (ta *TraktAuth) AccessToken() string {
+	ta.lock.Lock()
+	defer ta.lock.Unlock()
+	return ta.token.AccessToken
+}
+
+func (ta *TraktAuth) Client() *trakt.Client {
+	ta.lock.Lock()
+	defer ta.lock.Unlock()
+	return traktClient
+}
+
+func traktPostJson(path string, payload map[string]interface{}) (int, []byte, error) {
+	payload_bytes, err := json.Marshal(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	req, _ := http.NewRequest("POST", configuration.TraktBaseUrl + path, bytes.NewReader(payload_bytes))
+	req.Header.Set("Content-Type", "application/json")
+	res, err := netClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	res_bytes, err := ioutil.ReadAll(res.Body)
+	return res.StatusCode, res_bytes, err
+}
+
+func (ta *TraktAuth) storeToken(res_bytes []byte) (error) {
+	var tok TraktToken
+	if err := json.Unmarshal(res_bytes, &tok); err != nil {
+		return err
+	}
+	if len(tok.AccessToken) == 0 {
+		return errors.New("Trakt did not return an access token")
+	}
+	if tok.CreatedAt == 0 {
+		tok.CreatedAt = time.Now().Unix()
+	}
+	ta.applyToken(tok)
+	return ta.saveToDisk()
+}
+
+func (ta *TraktAuth) refreshLocked() (error) {
+	if len(ta.token.RefreshToken) == 0 {
+		return errors.New("No Trakt refresh token available")
+	}
+
+	/* Exchange refresh token for a new token pair */
+	status, res_bytes, err := traktPostJson(TraktTokenUrl, map[string]interface{}{
+		"refresh_token": ta.token.RefreshToken,
+		"client_id": configuration.TraktClientId,
+		"client_secret": configuration.TraktClientSecret,
+		"redirect_uri": TRAKT_REDIRECT_URI,
+		"grant_type": "refresh_token",
+	})
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return errors.New(fmt.Sprintf("Trakt token refresh failed with status %d", status))
+	}
+
+	/* Persist rotated tokens, since the old refresh token is now invalid */
+	return ta.storeToken(res_bytes)
+}
+
+func (ta *TraktAuth) Refresh() (error) {
+	ta.lock.Lock()
+	defer ta.lock.Unlock()
+	return ta.refreshLocked()
+}
+
+// RefreshRejected refreshes after Trakt.tv refused access_token, unless
+// another request already replaced it in the meantime.
+func (ta *TraktAuth) RefreshRejected(access_token string) (error) {
+	ta.lock.Lock()
+	defer ta.lock.Unlock()
+	if ta.token.AccessToken != access_token {
+		return nil
+	}
+	fmt.Println("Trakt rejected the access token, refreshing it")
+	return ta.refreshLocked()
+}
+
+func (ta *TraktAuth) EnsureFresh() {
+	ta.lock.Lock()
+	defer ta.lock.Unlock()
+	if len(ta.token.RefreshToken) == 0 || time.Now().Before(ta.retry_refresh) {
+		return
+	}
+
+	/* Tokens of unknown age, such as configured ones, are refreshed to date them */
+	expiry_time := ta.token.ExpiryTime()
+	if !expiry_time.IsZero() && time.Until(expiry_time) >= TRAKT_REFRESH_MARGIN {
+		return
+	}
+	fmt.Println("Refreshing Trakt access token")
+	if err := ta.refreshLocked(); err != nil {
+		fmt.Println("Warning: could not refresh Trakt token:", err)
+		ta.retry_refresh = time.Now().Add(TRAKT_REFRESH_RETRY)
+	}
+}
+
+func (ta *TraktAuth) MonitorExpiry() {
+	for {
+		/* Sleep until the token enters its refresh window */
+		ta.lock.Lock()
+		expiry_time := ta.token.ExpiryTime()
+		ta.lock.Unlock()
+		wait := 1 * time.Hour
+		if !expiry_time.IsZero() {
+			wait = time.Until(expiry_time) - TRAKT_REFRESH_MARGIN
+		}
+		if wait < 1 * time.Minute {
+			wait = 1 * time.Minute
+		}
+		time.Sleep(wait)
+
+		ta.EnsureFresh()
+	}
+}
+
+func (ta *TraktAuth) StartDeviceLogin() (map[string]interface{}, error) {
+	/* Request a device and user code */
+	status, res_bytes, err := traktPostJson(TraktDeviceCodeUrl, map[string]interface{}{
+		"client_id": configuration.TraktClientId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if status != 200 {
+		return nil, errors.New(fmt.Sprintf("Trakt device code request failed with status %d", status))
+	}
+	var code TraktDeviceCode
+	if err = json.Unmarshal(res_bytes, &code); err != nil {
+		return nil, err
+	}
+
+	/* Record login state and poll for authorization in background */
+	ta.lock.Lock()
+	ta.device = &code
+	ta.device_expiry = time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	ta.device_status = "pending"
+	ta.device_err = ""
+	ta.lock.Unlock()
+	go ta.pollDeviceToken(code)
+
+	return map[string]interface{}{
+		"user_code": code.UserCode,
+		"verification_url": code.VerificationUrl,
+		"expires_in": code.ExpiresIn,
+		"interval": code.Interval,
+	}, nil
+}
+
+func (ta *TraktAuth) setDeviceStatus(code TraktDeviceCode, status string, err_msg string) {
+	ta.lock.Lock()
+	defer ta.lock.Unlock()
+
+	/* Ignore stale pollers from superseded login attempts */
+	if ta.device == nil || ta.device.DeviceCode != code.DeviceCode {
+		return
+	}
+	ta.device_status = status
+	ta.device_err = err_msg
+}
+
+func (ta *TraktAuth) pollDeviceToken(code TraktDeviceCode) {
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		status, res_bytes, err := traktPostJson(TraktDeviceTokenUrl, map[string]interface{}{
+			"code": code.DeviceCode,
+			"client_id": configuration.TraktClientId,
+			"client_secret": configuration.TraktClientSecret,
+		})
+		if err != nil {
+			fmt.Println("Warning: Trakt device token poll failed:", err)
+			continue
+		}
+		switch status {
+			case 200:
+				ta.lock.Lock()
+				err = ta.storeToken(res_bytes)
+				ta.lock.Unlock()
+				if err != nil {
+					ta.setDeviceStatus(code, "error", err.Error())
+				} else {
+					ta.setDeviceStatus(code, "authorized", "")
+				}
+				return
+			case 400:
+				/* User has not authorized yet */
+				continue
+			case 429:
+				interval += 1 * time.Second
+				continue
+			case 404:
+				ta.setDeviceStatus(code, "error", "Invalid device code")
+				return
+			case 409:
+				ta.setDeviceStatus(code, "error", "Device code already used")
+				return
+			case 410:
+				ta.setDeviceStatus(code, "expired", "")
+				return
+			case 418:
+				ta.setDeviceStatus(code, "denied", "")
+				return
+			default:
+				fmt.Println("Warning: unexpected Trakt device token status:", status)
+		}
+	}
+	ta.setDeviceStatus(code, "expired", "")
+}
+
+func (ta *TraktAuth) LoginStatus() map[string]interface{} {
+	ta.lock.Lock()
+	defer ta.lock.Unlock()
+	ret := map[string]interface{}{
+		"status": ta.device_status,
+		"has_token": len(ta.token.AccessToken) > 0,
+	}
+	if len(ta.device_err) > 0 {
+		ret["err"] = ta.device_err
+	}
+	if ta.device != nil && ta.device_status == "pending" {
+		ret["user_code"] = ta.device.UserCode
+		ret["verification_url"] = ta.device.VerificationUrl
+		ret["expires_in"] = int(time.Until(ta.device_expiry).Seconds())
+	}
+	if expiry_time := ta.token.ExpiryTime(); !expiry_time.IsZero() {
+		ret["expires_at"] = expiry_time.Unix()
+	}
+	return ret
+}
+
+func (ta *TraktAuth) WaitForDeviceLogin() (error) {
+	for {
+		ta.lock.Lock()
+		status, err_msg := ta.device_status, ta.device_err
+		ta.lock.Unlock()
+		switch status {
+			case "pending":
+				time.Sleep(1 * time.Second)
+			case "authorized":
+				return nil
+			case "error":
+				return errors.New(err_msg)
+			default:
+				return errors.New("Trakt login " + status)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+const (
+	TRAKT_KEY_ID = "traktKeyId-"
+	TRAKT_PAGE_LIMIT = 100
+	TRAKT_MAX_RATE_LIMIT_RETRIES = 3
+)
+
+type TraktStatusError struct {
+	Method string
+	Path string
+	StatusCode int
+}
+
+func (e TraktStatusError) Error() string {
+	return fmt.Sprintf("Trakt %s %s failed with status %d", e.Method, e.Path, e.StatusCode)
+}
+
+// TraktLimiter is shared by every Trakt.tv call so that concurrent requests
+// stay under the per-user API limits (1000 GETs per 5 minutes, 1 write per
+// second) and all back off together once Trakt answers 429.
+type TraktLimiter struct {
+	lock *sync.Mutex
+	get_bucket *ratelimit.Bucket
+	write_bucket *ratelimit.Bucket
+	blocked_until time.Time
+}
+
+var traktLimiter = TraktLimiter{
+	lock: &sync.Mutex{},
+	get_bucket: ratelimit.NewBucketWithRate(1000.0 / 300.0, 20),
+	write_bucket: ratelimit.NewBucketWithRate(1.0, 1),
+}
+
+func (tl *TraktLimiter) Wait(method string) {
+	/* Honor any server-imposed pause first */
+	tl.lock.Lock()
+	blocked_until := tl.blocked_until
+	tl.lock.Unlock()
+	if wait := time.Until(blocked_until); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	if method == "GET" {
+		tl.get_bucket.Wait(1)
+	} else {
+		tl.write_bucket.Wait(1)
+	}
+}
+
+func (tl *TraktLimiter) Block(wait time.Duration) {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	if until := time.Now().Add(wait); until.After(tl.blocked_until) {
+		tl.blocked_until = until
+	}
+}
+
+func parseRetryAfter(header string) time.Duration {
+	if seconds, err := strconv.Atoi(strings.TrimSpace(header)); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(header); err == nil && time.Until(when) > 0 {
+		return time.Until(when)
+	}
+	return 1 * time.Second
+}
+
+type TraktCachedResponse struct {
+	ETag string
+	LastModified string
+	PageCount int
+	Body []byte
+}
+
+type traktResponse struct {
+	StatusCode int
+	Header http.Header
+	Body []byte
+}
+
+func traktDo(method string, path string, body interface{}, header http.Header) (*traktResponse, error) {
+	var body_bytes []byte
+	if body != nil {
+		var err error
+		if body_bytes, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+
+	reauthorized := false
+	for attempt := 0;; attempt += 1 {
+		traktAuth.EnsureFresh()
+		traktLimiter.Wait(method)
+		access_token := traktAuth.AccessToken()
+
+		/* Generate request */
+		var body_reader io.Reader
+		if body_bytes != nil {
+			body_reader = bytes.NewReader(body_bytes)
+		}
+		req, _ := http.NewRequest(method, configuration.TraktBaseUrl + path, body_reader)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer " + access_token)
+		req.Header.Set("trakt-api-version", "2")
+		req.Header.Set("trakt-api-key", configuration.TraktClientId)
+
+		/* Execute request */
+		res, err := netClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		res_bytes, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		/* Back off everyone on rate limiting, then retry */
+		if res.StatusCode == 429 {
+			wait := parseRetryAfter(res.Header.Get("Retry-After"))
+			traktLimiter.Block(wait)
+			fmt.Printf("Trakt rate limit hit, pausing for %s\n", wait)
+			if attempt < TRAKT_MAX_RATE_LIMIT_RETRIES {
+				continue
+			}
+		}
+		/* An expired or revoked token gets one refresh and retry */
+		if res.StatusCode == 401 && !reauthorized {
+			reauthorized = true
+			err := traktAuth.RefreshRejected(access_token)
+			if err == nil {
+				continue
+			}
+			fmt.Println("Warning: could not refresh Trakt token:", err)
+		}
+		if res.StatusCode >= 400 {
+			return nil, TraktStatusError{method, path, res.StatusCode}
+		}
+		return &traktResponse{res.StatusCode, res.Header, res_bytes}, nil
+	}
+}
+
+func traktRequest(method string, path string, body interface{}) (interface{}, error) {
+	res, err := traktDo(method, path, body, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret interface{}
+	json.Unmarshal(res.Body, &ret)
+	return ret, nil
+}
+
+func traktRequestGet(path string) (interface{}, error) {
+	return traktRequest("GET", path, nil)
+}
+
+func traktCachedGet(path string) (*TraktCachedResponse, error) {
+	/* Check cache for a validator */
+	var cached TraktCachedResponse
+	have_cached := false
+	cache_key := []byte(TRAKT_KEY_ID + path)
+	if cached_bytes, err := cache.Get(cache_key); err == nil && cached_bytes != nil {
+		dec := gob.NewDecoder(bytes.NewBuffer(cached_bytes))
+		have_cached = dec.Decode(&cached) == nil
+	}
+	header := http.Header{}
+	if have_cached {
+		if len(cached.ETag) > 0 {
+			header.Set("If-None-Match", cached.ETag)
+		}
+		if len(cached.LastModified) > 0 {
+			header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	/* Revalidate */
+	res, err := traktDo("GET", path, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotModified && have_cached {
+		return &cached, nil
+	}
+
+	/* Store fresh response */
+	page_count, _ := strconv.Atoi(res.Header.Get("X-Pagination-Page-Count"))
+	fresh := TraktCachedResponse{
+		ETag: res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		PageCount: page_count,
+		Body: res.Body,
+	}
+	if len(fresh.ETag) > 0 || len(fresh.LastModified) > 0 {
+		if fresh_bytes, err := GetBytes(fresh); err == nil {
+			cache.Set(cache_key, fresh_bytes, /*24 hours=*/24 * 60 * 60)
+		}
+	}
+	return &fresh, nil
+}
+
+// traktGetAll walks every page of a paginated Trakt.tv list endpoint,
+// revalidating each page against the cache.
+func traktGetAll(path string) ([]map[string]interface{}, error) {
+	ret := make([]map[string]interface{}, 0)
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	for page := 1;; page += 1 {
+		page_path := fmt.Sprintf("%s%spage=%d&limit=%d", path, separator, page, TRAKT_PAGE_LIMIT)
+		res, err := traktCachedGet(page_path)
+		if err != nil {
+			return nil, err
+		}
+		var tmp []map[string]interface{}
+		if err = json.Unmarshal(res.Body, &tmp); err != nil {
+			return nil, err
+		}
+		ret = append(ret, tmp...)
+
+		/* Unpaginated endpoints omit the page count and return everything at once */
+		if page >= res.PageCount || len(tmp) == 0 {
+			break
+		}
+	}
+	return ret, nil
+}
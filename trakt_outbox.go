@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	TRAKT_OUTBOX_FILENAME = "trakt_outbox.json"
+	TRAKT_OUTBOX_MAX_ATTEMPTS = 12
+	TRAKT_OUTBOX_BASE_BACKOFF = 5 * time.Second
+	TRAKT_OUTBOX_MAX_BACKOFF = 30 * time.Minute
+)
+
+type TraktOutboxEntry struct {
+	ID string `json:"id"`
+	Method string `json:"method"`
+	Path string `json:"path"`
+	Body interface{} `json:"body"`
+	CollapseKey string `json:"collapse_key,omitempty"` /* pending entries sharing a key are superseded by newer ones */
+	Created int64 `json:"created"` /* unix timestamp in seconds */
+	Attempts int `json:"attempts"`
+	NextAttempt int64 `json:"next_attempt"` /* unix timestamp in seconds */
+	LastError string `json:"last_error,omitempty"`
+	Failed bool `json:"failed"` /* true once attempts are exhausted or Trakt rejected the write */
+}
+
+type TraktOutbox struct {
+	lock *sync.Mutex
+	send_lock *sync.Mutex
+	entries []*TraktOutboxEntry
+	wake chan bool
+}
+
+var traktOutbox = TraktOutbox{
+	lock: &sync.Mutex{},
+	send_lock: &sync.Mutex{},
+	wake: make(chan bool, 1),
+}
+
+func (ob *TraktOutbox) ReadFromDisk() {
+	content, err := ioutil.ReadFile(TRAKT_OUTBOX_FILENAME)
+	if err != nil {
+		return
+	}
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	if err = json.Unmarshal(content, &ob.entries); err != nil {
+		fmt.Println("Could not parse Trakt outbox:", err)
+	}
+}
+
+func (ob *TraktOutbox) saveToDisk() (error) {
+	outbox_json, err := json.Marshal(ob.entries)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(TRAKT_OUTBOX_FILENAME, outbox_json, 0644)
+}
+
+func (ob *TraktOutbox) notify() {
+	select {
+		case ob.wake <- true:
+		default:
+	}
+}
+
+func filterOutbox(vs []*TraktOutboxEntry, f func(*TraktOutboxEntry) bool) []*TraktOutboxEntry {
+	vsf := make([]*TraktOutboxEntry, 0)
+	for _, v := range vs {
+		if f(v) {
+			vsf = append(vsf, v)
+		}
+	}
+	return vsf
+}
+
+func isRetryableTraktError(err error) bool {
+	status_err, ok := err.(TraktStatusError)
+	if !ok {
+		/* Network errors are always worth retrying */
+		return true
+	}
+	code := status_err.StatusCode
+	return code == 401 || code == 408 || code == 429 || code >= 500
+}
+
+func isDuplicateTraktError(err error) bool {
+	/* Trakt answers 409 when a scrobble or checkin was already recorded */
+	status_err, ok := err.(TraktStatusError)
+	return ok && status_err.StatusCode == 409
+}
+
+func traktOutboxBackoff(attempts int) time.Duration {
+	backoff := time.Duration(float64(TRAKT_OUTBOX_BASE_BACKOFF) * math.Pow(2, float64(attempts - 1)))
+	if backoff > TRAKT_OUTBOX_MAX_BACKOFF || backoff <= 0 {
+		backoff = TRAKT_OUTBOX_MAX_BACKOFF
+	}
+	return backoff
+}
+
+func (ob *TraktOutbox) Submit(method string, path string, body interface{}, collapse_key string) (map[string]interface{}, error) {
+	/* Durably record the write before attempting it */
+	now := time.Now()
+	entry := &TraktOutboxEntry{
+		ID: strconv.FormatInt(now.UnixNano(), 36),
+		Method: method,
+		Path: path,
+		Body: body,
+		CollapseKey: collapse_key,
+		Created: now.Unix(),
+		NextAttempt: now.Unix(),
+	}
+	ob.lock.Lock()
+	if len(collapse_key) > 0 {
+		ob.entries = filterOutbox(ob.entries, func(v *TraktOutboxEntry) bool {
+			if v.Failed || v.CollapseKey != collapse_key {
+				return true
+			}
+			mergePartialUpdate(entry, v)
+			return false
+		})
+	}
+	ob.entries = append(ob.entries, entry)
+	if err := ob.saveToDisk(); err != nil {
+		fmt.Println("Warning: could not save Trakt outbox:", err)
+	}
+	ob.lock.Unlock()
+
+	/* Try to deliver immediately so callers see Trakt's response when online */
+	res, delivered, err := ob.flush(entry.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !delivered {
+		ob.notify()
+		return map[string]interface{}{
+			"queued": true,
+			"outbox_id": entry.ID,
+		}, nil
+	}
+	ret, _ := res.(map[string]interface{})
+	if ret == nil {
+		ret = make(map[string]interface{})
+	}
+	return ret, nil
+}
+
+/* A PUT only changes the fields it names, so one superseding another of the */
+/* same resource keeps the fields it does not set itself */
+func mergePartialUpdate(entry *TraktOutboxEntry, superseded *TraktOutboxEntry) {
+	if entry.Method != "PUT" || superseded.Method != "PUT" || entry.Path != superseded.Path {
+		return
+	}
+	body, ok := entry.Body.(map[string]interface{})
+	old_body, old_ok := superseded.Body.(map[string]interface{})
+	if !ok || !old_ok {
+		return
+	}
+	merged := make(map[string]interface{})
+	for k, v := range old_body {
+		merged[k] = v
+	}
+	for k, v := range body {
+		merged[k] = v
+	}
+	entry.Body = merged
+}
+
+// outboxDelivered tells whether a Submit result is Trakt.tv's response, as
+// opposed to the write having been queued for a later attempt.
+func outboxDelivered(res map[string]interface{}) bool {
+	queued, _ := res["queued"].(bool)
+	return !queued
+}
+
+// Pending tells whether a write submitted under collapse_key is still waiting
+// to be delivered. Failed writes do not count, so callers push them again.
+func (ob *TraktOutbox) Pending(collapse_key string) bool {
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	for _, on := range ob.entries {
+		if !on.Failed && on.CollapseKey == collapse_key {
+			return true
+		}
+	}
+	return false
+}
+
+// flush delivers due entries in submission order, stopping at the first one
+// that has to be retried later so writes are never replayed out of order. If
+// target is non-empty, its outcome is reported back to the caller.
+func (ob *TraktOutbox) flush(target string) (interface{}, bool, error) {
+	ob.send_lock.Lock()
+	defer ob.send_lock.Unlock()
+	for {
+		/* Pick the oldest pending entry */
+		ob.lock.Lock()
+		var entry *TraktOutboxEntry
+		for _, on := range ob.entries {
+			if !on.Failed {
+				entry = on
+				break
+			}
+		}
+		if entry == nil || entry.NextAttempt > time.Now().Unix() {
+			ob.lock.Unlock()
+			return nil, false, nil
+		}
+		entry.Attempts += 1
+		ob.lock.Unlock()
+
+		/* Attempt delivery */
+		res, err := traktRequest(entry.Method, entry.Path, entry.Body)
+		if err != nil && isDuplicateTraktError(err) {
+			err = nil
+		}
+
+		ob.lock.Lock()
+		if err == nil {
+			ob.entries = filterOutbox(ob.entries, func(v *TraktOutboxEntry) bool {
+				return v != entry
+			})
+		} else {
+			entry.LastError = err.Error()
+			if !isRetryableTraktError(err) || entry.Attempts >= TRAKT_OUTBOX_MAX_ATTEMPTS {
+				entry.Failed = true
+			} else {
+				entry.NextAttempt = time.Now().Add(traktOutboxBackoff(entry.Attempts)).Unix()
+			}
+		}
+		if save_err := ob.saveToDisk(); save_err != nil {
+			fmt.Println("Warning: could not save Trakt outbox:", save_err)
+		}
+		failed := entry.Failed
+		ob.lock.Unlock()
+
+		if err != nil {
+			fmt.Println("Warning: Trakt outbox delivery failed:", err)
+		}
+		if entry.ID == target {
+			if failed {
+				return nil, false, err
+			}
+			return res, err == nil, nil
+		}
+		if err != nil && !failed {
+			/* Head of line must be retried later */
+			return nil, false, nil
+		}
+	}
+}
+
+func (ob *TraktOutbox) Run() {
+	for {
+		/* Sleep until woken or the next entry is due */
+		wait := TRAKT_OUTBOX_MAX_BACKOFF
+		ob.lock.Lock()
+		for _, on := range ob.entries {
+			if on.Failed {
+				continue
+			}
+			wait = time.Until(time.Unix(on.NextAttempt, 0))
+			break
+		}
+		ob.lock.Unlock()
+		if wait < 1 * time.Second {
+			wait = 1 * time.Second
+		}
+		select {
+			case <-ob.wake:
+			case <-time.After(wait):
+		}
+
+		ob.flush("")
+	}
+}
+
+func (ob *TraktOutbox) Entries() map[string]interface{} {
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	pending := make([]TraktOutboxEntry, 0)
+	failed := make([]TraktOutboxEntry, 0)
+	for _, on := range ob.entries {
+		if on.Failed {
+			failed = append(failed, *on)
+		} else {
+			pending = append(pending, *on)
+		}
+	}
+	return map[string]interface{}{
+		"pending": pending,
+		"failed": failed,
+	}
+}
+
+func (ob *TraktOutbox) Retry(id string) (bool) {
+	/* Requeue failed entries (all of them if no id is given) */
+	ob.lock.Lock()
+	found := false
+	for _, on := range ob.entries {
+		if on.Failed && (len(id) == 0 || on.ID == id) {
+			on.Failed = false
+			on.Attempts = 0
+			on.NextAttempt = time.Now().Unix()
+			found = true
+		}
+	}
+	ob.saveToDisk()
+	ob.lock.Unlock()
+	ob.notify()
+	return found
+}
+
+func (ob *TraktOutbox) Discard(id string) (bool) {
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	count := len(ob.entries)
+	ob.entries = filterOutbox(ob.entries, func(v *TraktOutboxEntry) bool {
+		return v.ID != id
+	})
+	ob.saveToDisk()
+	return len(ob.entries) != count
+}
@@ -0,0 +1,676 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	WATCH_STORE_FILENAME = "watch_store.json"
+	WATCH_EVENT_MATCH_WINDOW = 60 * 60 /* seconds between a local and remote play to consider them the same */
+	DEFAULT_TRAKT_SYNC_MINUTES = 15
+)
+
+type WatchEvent struct {
+	ImdbID string `json:"imdb_id"`
+	ItemType string `json:"item_type"` /* "movie" or "show" */
+	WatchedAt int64 `json:"watched_at"` /* unix timestamp in seconds */
+	TraktID int64 `json:"trakt_id,omitempty"` /* Trakt.tv history id, once known */
+	Synced bool `json:"synced"` /* true once Trakt.tv has it */
+	DeletedAt int64 `json:"deleted_at,omitempty"` /* tombstone until Trakt.tv confirms removal */
+}
+
+type WatchlistEntry struct {
+	ImdbID string `json:"imdb_id"`
+	ItemType string `json:"item_type"`
+	UpdatedAt int64 `json:"updated_at"` /* unix timestamp in seconds of last add or removal */
+	Synced bool `json:"synced"`
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+type PlaybackPosition struct {
+	ImdbID string `json:"imdb_id"`
+	ItemType string `json:"item_type"`
+	Progress float64 `json:"progress"` /* percent watched */
+	UpdatedAt int64 `json:"updated_at"`
+	Synced bool `json:"synced"`
+}
+
+type WatchStore struct {
+	lock *sync.Mutex
+	sync_lock *sync.Mutex
+	History []*WatchEvent `json:"history"`
+	Watchlist map[string]*WatchlistEntry `json:"watchlist"`
+	Playback map[string]*PlaybackPosition `json:"playback"`
+	LastSync int64 `json:"last_sync"`
+	LastSyncError string `json:"last_sync_error,omitempty"`
+}
+
+var watchStore = WatchStore{
+	lock: &sync.Mutex{},
+	sync_lock: &sync.Mutex{},
+	Watchlist: make(map[string]*WatchlistEntry),
+	Playback: make(map[string]*PlaybackPosition),
+}
+
+func traktSyncEnabled() bool {
+	return !configuration.TraktSyncDisabled && len(configuration.TraktClientId) > 0
+}
+
+func parseTraktTime(v interface{}) int64 {
+	s, _ := v.(string)
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+func formatTraktTime(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
+
+func (ws *WatchStore) ReadFromDisk() {
+	content, err := ioutil.ReadFile(WATCH_STORE_FILENAME)
+	if err != nil {
+		return
+	}
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if err = json.Unmarshal(content, ws); err != nil {
+		fmt.Println("Could not parse watch store:", err)
+	}
+	if ws.Watchlist == nil {
+		ws.Watchlist = make(map[string]*WatchlistEntry)
+	}
+	if ws.Playback == nil {
+		ws.Playback = make(map[string]*PlaybackPosition)
+	}
+}
+
+func (ws *WatchStore) saveToDisk() (error) {
+	store_json, err := json.Marshal(ws)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(WATCH_STORE_FILENAME, store_json, 0644)
+}
+
+// Update runs fn with the store locked and persists the result.
+func (ws *WatchStore) Update(fn func()) (error) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	fn()
+	return ws.saveToDisk()
+}
+
+func (ws *WatchStore) AddToWatchlist(item_type string, item_id string) (*WatchlistEntry, error) {
+	entry := &WatchlistEntry{
+		ImdbID: item_id,
+		ItemType: item_type,
+		UpdatedAt: time.Now().Unix(),
+	}
+	err := ws.Update(func() {
+		ws.Watchlist[item_id] = entry
+	})
+	return entry, err
+}
+
+func (ws *WatchStore) RemoveFromWatchlist(item_type string, item_id string) (*WatchlistEntry, error) {
+	/* Keep a tombstone so the next sync does not resurrect the item */
+	entry := &WatchlistEntry{
+		ImdbID: item_id,
+		ItemType: item_type,
+		UpdatedAt: time.Now().Unix(),
+		Deleted: true,
+	}
+	err := ws.Update(func() {
+		ws.Watchlist[item_id] = entry
+	})
+	return entry, err
+}
+
+func (ws *WatchStore) GetWatchlist() []string {
+	ws.lock.Lock()
+	var entries []*WatchlistEntry
+	for _, on := range ws.Watchlist {
+		if !on.Deleted {
+			entries = append(entries, on)
+		}
+	}
+	ws.lock.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].UpdatedAt < entries[j].UpdatedAt
+	})
+	ids := make([]string, 0)
+	for _, on := range entries {
+		ids = append(ids, on.ImdbID)
+	}
+	return ids
+}
+
+func (ws *WatchStore) AddWatchEvent(item_type string, item_id string, watched_at int64) (*WatchEvent, error) {
+	event := &WatchEvent{
+		ImdbID: item_id,
+		ItemType: item_type,
+		WatchedAt: watched_at,
+	}
+	err := ws.Update(func() {
+		ws.History = append(ws.History, event)
+		delete(ws.Playback, item_id)
+	})
+	return event, err
+}
+
+func (ws *WatchStore) RemoveWatchEvents(item_id string) ([]*WatchEvent, error) {
+	var removed []*WatchEvent
+	now := time.Now().Unix()
+	err := ws.Update(func() {
+		for _, on := range ws.History {
+			if on.ImdbID == item_id && on.DeletedAt == 0 {
+				on.DeletedAt = now
+				on.Synced = false
+				removed = append(removed, on)
+			}
+		}
+	})
+	return removed, err
+}
+
+func (ws *WatchStore) GetHistory() []string {
+	ws.lock.Lock()
+	var events []*WatchEvent
+	for _, on := range ws.History {
+		if on.DeletedAt == 0 {
+			events = append(events, on)
+		}
+	}
+	ws.lock.Unlock()
+
+	/* Most recent first, like Trakt.tv */
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].WatchedAt > events[j].WatchedAt
+	})
+	var ids []string
+	for _, on := range events {
+		ids = append(ids, on.ImdbID)
+	}
+	return deDup(ids)
+}
+
+func (ws *WatchStore) SetPlayback(item_type string, item_id string, progress float64) (*PlaybackPosition, error) {
+	position := &PlaybackPosition{
+		ImdbID: item_id,
+		ItemType: item_type,
+		Progress: progress,
+		UpdatedAt: time.Now().Unix(),
+	}
+	err := ws.Update(func() {
+		ws.Playback[item_id] = position
+	})
+	return position, err
+}
+
+func (ws *WatchStore) GetPlayback() []map[string]interface{} {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	/* Same shape as Trakt.tv playback progress, which the frontend consumes */
+	ret := make([]map[string]interface{}, 0)
+	for _, on := range ws.Playback {
+		ret = append(ret, map[string]interface{}{
+			"type": on.ItemType,
+			"progress": on.Progress,
+			"paused_at": formatTraktTime(on.UpdatedAt),
+			on.ItemType: map[string]interface{}{
+				"ids": map[string]interface{}{
+					"imdb": on.ImdbID,
+				},
+			},
+		})
+	}
+	return ret
+}
+
+func (ws *WatchStore) SyncStatus() map[string]interface{} {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	pending := 0
+	for _, on := range ws.History {
+		if !on.Synced {
+			pending += 1
+		}
+	}
+	for _, on := range ws.Watchlist {
+		if !on.Synced {
+			pending += 1
+		}
+	}
+	for _, on := range ws.Playback {
+		if !on.Synced {
+			pending += 1
+		}
+	}
+	ret := map[string]interface{}{
+		"enabled": traktSyncEnabled(),
+		"last_sync": ws.LastSync,
+		"pending": pending,
+	}
+	if len(ws.LastSyncError) > 0 {
+		ret["err"] = ws.LastSyncError
+	}
+	return ret
+}
+
+func traktRemoteImdb(on map[string]interface{}, field string) string {
+	item, ok := on[field].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	ids := filterTraktIds([]map[string]interface{}{item})
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[0]
+}
+
+func traktBatchObj(item_type string, items []map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		item_type + "s": items,
+	}
+}
+
+func (ws *WatchStore) syncWatchlist(stats map[string]int) (error) {
+	/* Pull remote watchlist */
+	remote_arr, err := traktGetAll(MovieWatchlistGetUrl)
+	if err != nil {
+		return err
+	}
+	remote := make(map[string]int64)
+	for _, on := range remote_arr {
+		if id := traktRemoteImdb(on, "movie"); len(id) > 0 {
+			remote[id] = parseTraktTime(on["listed_at"])
+		}
+	}
+
+	/* Reconcile, newest change wins */
+	var to_add, to_remove []*WatchlistEntry
+	ws.lock.Lock()
+	for id, listed_at := range remote {
+		local, ok := ws.Watchlist[id]
+		if !ok {
+			ws.Watchlist[id] = &WatchlistEntry{
+				ImdbID: id,
+				ItemType: "movie",
+				UpdatedAt: listed_at,
+				Synced: true,
+			}
+			stats["pulled"] += 1
+		} else if local.Deleted && local.UpdatedAt >= listed_at {
+			if !local.Synced {
+				to_remove = append(to_remove, local)
+			}
+		} else if local.Deleted {
+			/* Re-added on Trakt.tv after the local removal */
+			local.Deleted = false
+			local.UpdatedAt = listed_at
+			local.Synced = true
+			stats["pulled"] += 1
+		} else {
+			local.Synced = true
+		}
+	}
+	for id, local := range ws.Watchlist {
+		if _, ok := remote[id]; ok || local.ItemType != "movie" {
+			continue
+		}
+		if local.Deleted {
+			/* Removal confirmed */
+			delete(ws.Watchlist, id)
+		} else if !local.Synced || local.UpdatedAt > ws.LastSync {
+			to_add = append(to_add, local)
+		} else {
+			/* Removed on Trakt.tv */
+			delete(ws.Watchlist, id)
+			stats["removed"] += 1
+		}
+	}
+	ws.saveToDisk()
+	ws.lock.Unlock()
+
+	/* Push local changes; entries stay unsynced until Trakt.tv has them, so a */
+	/* queued add is pushed again rather than mistaken for a remote removal */
+	for url, entries := range map[string][]*WatchlistEntry{WatchlistAddUrl: to_add, WatchlistRemoveUrl: to_remove} {
+		if len(entries) == 0 {
+			continue
+		}
+		var items []map[string]interface{}
+		for _, on := range entries {
+			items = append(items, map[string]interface{}{
+				"ids": map[string]interface{}{"imdb": on.ImdbID},
+			})
+		}
+		/* Each batch holds every unsynced entry, so it supersedes a queued one */
+		res, err := traktOutbox.Submit("POST", url, traktBatchObj("movie", items), "watchlist:" + url)
+		if err != nil {
+			return err
+		}
+		if !outboxDelivered(res) {
+			stats["queued"] += len(entries)
+			continue
+		}
+		ws.Update(func() {
+			for _, on := range entries {
+				on.Synced = true
+			}
+		})
+		stats["pushed"] += len(entries)
+	}
+	return nil
+}
+
+func (ws *WatchStore) syncHistory(stats map[string]int) (error) {
+	/* Pull remote history */
+	remote_arr, err := traktGetAll(HistoryGetUrl)
+	if err != nil {
+		return err
+	}
+
+	/* Reconcile: plays are additive, removals are tombstoned until confirmed */
+	var to_add, to_remove []*WatchEvent
+	remote_ids := make(map[int64]bool)
+	remote_imdb := make(map[string]bool)
+	ws.lock.Lock()
+	for _, on := range remote_arr {
+		item_type := "movie"
+		id := traktRemoteImdb(on, "movie")
+		if len(id) == 0 {
+			item_type = "show"
+			id = traktRemoteImdb(on, "show")
+		}
+		if len(id) == 0 {
+			continue
+		}
+		trakt_id := int64(0)
+		if v, ok := on["id"].(float64); ok {
+			trakt_id = int64(v)
+		}
+		watched_at := parseTraktTime(on["watched_at"])
+		remote_ids[trakt_id] = true
+		remote_imdb[id] = true
+
+		/* Match by history id, else by item and nearby time */
+		var match *WatchEvent
+		tombstoned := false
+		for _, local := range ws.History {
+			if local.ImdbID != id {
+				continue
+			}
+			if local.DeletedAt >= watched_at {
+				tombstoned = true
+			}
+			if local.TraktID == trakt_id || (local.TraktID == 0 && abs64(local.WatchedAt - watched_at) <= WATCH_EVENT_MATCH_WINDOW) {
+				match = local
+				break
+			}
+		}
+		if match != nil {
+			match.TraktID = trakt_id
+			if match.DeletedAt == 0 {
+				match.Synced = true
+			} else if !match.Synced {
+				to_remove = append(to_remove, match)
+			}
+		} else if !tombstoned {
+			ws.History = append(ws.History, &WatchEvent{
+				ImdbID: id,
+				ItemType: item_type,
+				WatchedAt: watched_at,
+				TraktID: trakt_id,
+				Synced: true,
+			})
+			stats["pulled"] += 1
+		}
+	}
+	kept := make([]*WatchEvent, 0)
+	for _, local := range ws.History {
+		if local.DeletedAt > 0 && !remote_imdb[local.ImdbID] {
+			/* Removal confirmed */
+			continue
+		}
+		if local.DeletedAt == 0 && local.TraktID != 0 && !remote_ids[local.TraktID] {
+			/* Removed on Trakt.tv */
+			stats["removed"] += 1
+			continue
+		}
+		if local.DeletedAt == 0 && !local.Synced {
+			to_add = append(to_add, local)
+		}
+		kept = append(kept, local)
+	}
+	ws.History = kept
+	ws.saveToDisk()
+	ws.lock.Unlock()
+
+	/* Push local plays with their original watch times. Plays are not */
+	/* idempotent on Trakt.tv, so skip those whose own write is still queued */
+	for _, item_type := range []string{"movie", "show"} {
+		var items []map[string]interface{}
+		var entries []*WatchEvent
+		for _, on := range to_add {
+			if on.ItemType == item_type && !traktOutbox.Pending(historyWriteKey(on)) {
+				items = append(items, map[string]interface{}{
+					"ids": map[string]interface{}{"imdb": on.ImdbID},
+					"watched_at": formatTraktTime(on.WatchedAt),
+				})
+				entries = append(entries, on)
+			}
+		}
+		if len(items) == 0 {
+			continue
+		}
+		/* Each batch holds every unsynced play, so it supersedes a queued one */
+		res, err := traktOutbox.Submit("POST", HistoryAddUrl, traktBatchObj(item_type, items), "history:add:" + item_type)
+		if err != nil {
+			return err
+		}
+		if !outboxDelivered(res) {
+			stats["queued"] += len(entries)
+			continue
+		}
+		ws.Update(func() {
+			for _, on := range entries {
+				on.Synced = true
+			}
+		})
+		stats["pushed"] += len(entries)
+	}
+
+	/* Push local removals by history id */
+	if len(to_remove) > 0 {
+		var trakt_ids []int64
+		for _, on := range to_remove {
+			trakt_ids = append(trakt_ids, on.TraktID)
+		}
+		res, err := traktOutbox.Submit("POST", HistoryRemoveUrl, map[string]interface{}{"ids": trakt_ids}, "history:remove")
+		if err != nil {
+			return err
+		}
+		if !outboxDelivered(res) {
+			stats["queued"] += len(to_remove)
+		} else {
+			ws.Update(func() {
+				for _, on := range to_remove {
+					on.Synced = true
+				}
+			})
+			stats["pushed"] += len(to_remove)
+		}
+	}
+	return nil
+}
+
+/* Collapse key of the write recording a single play */
+func historyWriteKey(on *WatchEvent) string {
+	return fmt.Sprintf("history:%s:%d", on.ImdbID, on.WatchedAt)
+}
+
+func (ws *WatchStore) syncPlayback(stats map[string]int) (error) {
+	/* Pull remote playback progress */
+	remote_arr, err := traktGetAll(PlaybackGetUrl)
+	if err != nil {
+		return err
+	}
+
+	/* Reconcile, most recent position wins */
+	var to_push []*PlaybackPosition
+	remote := make(map[string]bool)
+	ws.lock.Lock()
+	for _, on := range remote_arr {
+		id := traktRemoteImdb(on, "movie")
+		if len(id) == 0 {
+			continue
+		}
+		remote[id] = true
+		paused_at := parseTraktTime(on["paused_at"])
+		progress, _ := on["progress"].(float64)
+		local, ok := ws.Playback[id]
+		if ok && local.UpdatedAt >= paused_at {
+			if !local.Synced && local.Progress != progress {
+				to_push = append(to_push, local)
+			}
+			continue
+		}
+		ws.Playback[id] = &PlaybackPosition{
+			ImdbID: id,
+			ItemType: "movie",
+			Progress: progress,
+			UpdatedAt: paused_at,
+			Synced: true,
+		}
+		stats["pulled"] += 1
+	}
+	for id, local := range ws.Playback {
+		if remote[id] || local.ItemType != "movie" {
+			continue
+		}
+		if local.Synced {
+			/* Finished or cleared on Trakt.tv */
+			delete(ws.Playback, id)
+			stats["removed"] += 1
+		} else {
+			to_push = append(to_push, local)
+		}
+	}
+	ws.saveToDisk()
+	ws.lock.Unlock()
+
+	/* Push local positions as paused scrobbles */
+	for _, on := range to_push {
+		video_obj := map[string]interface{}{
+			"movie": map[string]interface{}{
+				"ids": map[string]interface{}{"imdb": on.ImdbID},
+			},
+			"progress": on.Progress,
+		}
+		res, err := traktOutbox.Submit("POST", ScrobblePauseUrl, video_obj, "scrobble:" + on.ImdbID)
+		if err != nil {
+			return err
+		}
+		if !outboxDelivered(res) {
+			/* Left unsynced, so it is not taken for one cleared on Trakt.tv */
+			stats["queued"] += 1
+			continue
+		}
+		ws.Update(func() {
+			on.Synced = true
+		})
+		stats["pushed"] += 1
+	}
+	return nil
+}
+
+// SyncTrakt replicates the local store with Trakt.tv in both directions.
+func (ws *WatchStore) SyncTrakt() (map[string]interface{}, error) {
+	if !traktSyncEnabled() {
+		return nil, errors.New("Trakt.tv sync is disabled")
+	}
+	ws.sync_lock.Lock()
+	defer ws.sync_lock.Unlock()
+
+	started := time.Now().Unix()
+	stats := map[string]int{
+		"pulled": 0,
+		"pushed": 0,
+		"removed": 0,
+	}
+	err := ws.syncWatchlist(stats)
+	if err == nil {
+		err = ws.syncHistory(stats)
+	}
+	if err == nil {
+		err = ws.syncPlayback(stats)
+	}
+
+	ws.Update(func() {
+		if err != nil {
+			ws.LastSyncError = err.Error()
+		} else {
+			ws.LastSync = started
+			ws.LastSyncError = ""
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"pulled": stats["pulled"],
+		"pushed": stats["pushed"],
+		"removed": stats["removed"],
+		"queued": stats["queued"],
+	}, nil
+}
+
+// EnsureSynced performs an initial sync so a fresh store is populated from
+// Trakt.tv before it is first read. Once a sync has failed, reads are served
+// locally and the background sync keeps retrying instead.
+func (ws *WatchStore) EnsureSynced() {
+	ws.lock.Lock()
+	never_synced := ws.LastSync == 0 && len(ws.LastSyncError) == 0
+	ws.lock.Unlock()
+	if never_synced && traktSyncEnabled() {
+		if _, err := ws.SyncTrakt(); err != nil {
+			fmt.Println("Warning: initial Trakt.tv sync failed:", err)
+		}
+	}
+}
+
+func (ws *WatchStore) RunSync() {
+	interval := time.Duration(configuration.TraktSyncIntervalMinutes) * time.Minute
+	if interval <= 0 {
+		interval = DEFAULT_TRAKT_SYNC_MINUTES * time.Minute
+	}
+	for {
+		if traktSyncEnabled() {
+			if stats, err := ws.SyncTrakt(); err != nil {
+				fmt.Println("Warning: Trakt.tv sync failed:", err)
+			} else {
+				fmt.Println("Trakt.tv sync complete:", stats)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}